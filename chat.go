@@ -7,9 +7,16 @@ import "dht"
 import "io/ioutil"
 import "time"
 import "github.com/pmylund/sortutil"
-import "path/filepath"
+import "strings"
+import "errors"
+import "os/exec"
+import "sort"
+import "sync"
 
 func main() {	
+	if len(os.Args) > 1 {
+		os.Exit(runCommand(os.Args[1], os.Args[2:]))
+	}
 	startChat()
 	//testsort()
 }
@@ -40,6 +47,91 @@ func input(reader *bufio.Reader) string {
 	return input
 }
 
+// changes the settings of our terminal
+func stty(args ...string) error {
+	cmd := exec.Command("stty", args...)
+	cmd.Stdin = os.Stdin
+	return cmd.Run()
+}
+
+// reads a line without echoing it, where the terminal allows
+func inputSecret(reader *bufio.Reader) string {
+	if stty("-echo") == nil {
+		defer fmt.Println("")
+		defer stty("echo")
+	}
+	return input(reader)
+}
+
+// reads a line like input, calling typing as each key is
+// pressed and complete when tab is. where the terminal allows,
+// it hands us keys as they are pressed and we echo and erase
+// them ourselves
+func inputTyping(reader *bufio.Reader, typing func(), complete func(line string) (string, []string)) string {
+	if stty("-icanon", "-echo", "min", "1") != nil {
+		return input(reader)
+	}
+	defer stty("icanon", "echo")
+	line := make([]rune, 0)
+	for {
+		r, _, err := reader.ReadRune()
+		if err != nil || r == '\n' {
+			fmt.Println("")
+			return string(line)
+		}
+		if r == 127 || r == '\b' {
+			if len(line) > 0 {
+				line = line[:len(line)-1]
+				fmt.Printf("\b \b")
+			}
+			continue
+		}
+		if r == '\t' {
+			completed, candidates := complete(string(line))
+			if len(candidates) > 1 {
+				// show the choices and carry on below them
+				fmt.Printf("\n%s\n%s", strings.Join(candidates, "  "), string(line))
+			} else if completed != string(line) {
+				fmt.Printf("%s%s", strings.Repeat("\b \b", len(line)), completed)
+				line = []rune(completed)
+			}
+			continue
+		}
+		line = append(line, r)
+		fmt.Printf("%c", r)
+		typing()
+	}
+}
+
+// who is typing to us, and until when
+var typingMu sync.Mutex
+var typingUntil = make(map[string]time.Time)
+
+// records signal, returns true if it changes who is shown typing
+func showSignal(signal dht.SignalArgs) bool {
+	typingMu.Lock()
+	defer typingMu.Unlock()
+	_, wasTyping := typingUntil[signal.FromUsername]
+	if signal.Kind == dht.TypingSignal {
+		typingUntil[signal.FromUsername] = time.Now().Add(dht.TypingFor)
+		return !wasTyping
+	}
+	delete(typingUntil, signal.FromUsername)
+	return wasTyping
+}
+
+// returns true if peer is typing to us
+func isTyping(peer string) bool {
+	typingMu.Lock()
+	defer typingMu.Unlock()
+	until, typing := typingUntil[peer]
+	if typing && time.Now().After(until) {
+		delete(typingUntil, peer)
+		return false
+	}
+	return typing
+}
+
 func startChat() {
 	reader := bufio.NewReader(os.Stdin)
 	
@@ -57,40 +149,61 @@ func startChat() {
 	address := input(reader)
 	
 	// search for this user's history
-	files, _ := filepath.Glob("/tmp/*.gob")
-	userfile := ""
-	user := new(dht.User)
-	for _, file := range files {
-		if file == dht.UsernameToPath(username) {
-			userfile = file
-		}
-	}
+	var user *dht.User
 	
-	// did we find the file?
-	if userfile != "" {
-		// we found this user, load from file
-		user = dht.Login(username, address)
+	// did we find the profile?
+	if dht.DefaultStorage.Exists(username) {
+		// we found this user, load from storage
+		fmt.Printf("Enter passphrase (leave empty if you didn't set one): ")
+		user, err = dht.LoginWithPassphrase(username, address, inputSecret(reader))
+		for errors.Is(err, dht.ErrWrongPassphrase) || errors.Is(err, dht.ErrPassphraseRequired) {
+			fmt.Printf("\n[*] That passphrase doesn't open `%s`'s history. Try again: ", username)
+			user, err = dht.LoginWithPassphrase(username, address, inputSecret(reader))
+		}
 		
 	} else {
 		// we did not find a matching user
 		fmt.Printf("\n[*] Looks like you haven't logged in on this computer before! Would you like to create a new network, or join an existing one?\n")
 		fmt.Printf("Join existing? Type (Y/N):")
 		join := input(reader)
+		fmt.Printf("\n[*] Choose a passphrase to encrypt your history on this computer (leave empty for none): ")
+		passphrase := inputSecret(reader)
 		
 		if join == "Y" || join == "y" {
 			// join existing network, ask for boostrap IP
 			fmt.Printf("\n[*] To join an existing network, please enter an IP address/port of a friend (xxx.xxx.xxx.xxx:yyyy): ")
 			boostrapAddress := input(reader)
-			user = dht.RegisterAndLogin(username, address, boostrapAddress)
+			user, err = dht.RegisterWithPassphrase(username, address, boostrapAddress, passphrase)
+
+			// let them try someone else if their friend is offline
+			for errors.Is(err, dht.ErrBootstrapUnreachable) {
+				fmt.Printf("\n[*] `%s` is not online. Please enter the IP address/port of another friend: ", boostrapAddress)
+				boostrapAddress = input(reader)
+				user, err = dht.RegisterWithPassphrase(username, address, boostrapAddress, passphrase)
+			}
 			
 		} else {
 			// creating a new network, simply create new user
 			// use bogus address and start with empty routing table
-			user = dht.RegisterAndLogin(username, address, "")
+			user, err = dht.RegisterWithPassphrase(username, address, "", passphrase)
 			
 		}
 	}	
 	
+	if errors.Is(err, dht.ErrUsernameTaken) {
+		fmt.Printf("\n[*] Could not log in as `%s`, the username is already taken.\n", username)
+		return
+	} else if errors.Is(err, dht.ErrAddressInUse) {
+		fmt.Printf("\n[*] Could not listen on %s, is another Peerchat already using it?\n", address)
+		return
+	} else if errors.Is(err, dht.ErrProfileTooNew) {
+		fmt.Printf("\n[*] `%s` was saved by a newer version of Peerchat, please upgrade.\n", username)
+		return
+	} else if err != nil {
+		fmt.Printf("\n[*] Could not log in as `%s`: %v\n", username, err)
+		return
+	}
+
 	// we're now logged in with a user
 	fmt.Printf("Connecting to Peerchat")
 	time.Sleep(300 * time.Millisecond)
@@ -103,6 +216,11 @@ func startChat() {
 	// prompt them to chat
 	// fmt.Printf("Connected as user: %+v\n", user)
 	
+	// follow everyone we've talked to
+	for _, peer := range user.Peers() {
+		user.Watch(peer)
+	}
+
 	// update loop
 	go func() {
 		notifications := user.GetNotificationsChannel()
@@ -111,22 +229,79 @@ func startChat() {
 			paint(user)
 		}
 	}()
+
+	// people typing to us, who stop showing once their last
+	// signal runs out
+	go func() {
+		signals := user.GetSignalsChannel()
+		for {
+			signal := <- signals
+			if showSignal(signal) {
+				paint(user)
+			}
+			if signal.Kind == dht.TypingSignal {
+				time.AfterFunc(dht.TypingFor, func() {
+					if !isTyping(signal.FromUsername) {
+						paint(user)
+					}
+				})
+			}
+		}
+	}()
+
+	// tell the peer we're typing, at most every half TypingFor
+	lastTyping := time.Time{}
+	typing := func(peer string) func() {
+		return func() {
+			if _, inRoom := roomName(peer); !inRoom && time.Since(lastTyping) > dht.TypingFor / 2 {
+				lastTyping = time.Now()
+				go user.SendSignal(peer, dht.TypingSignal)
+			}
+		}
+	}
+
+	// completes \peer to the contacts it could be
+	complete := func(line string) (string, []string) {
+		if !strings.HasPrefix(line, "\\") {
+			return line, nil
+		}
+		candidates := user.CompleteContact(line[1:])
+		if len(candidates) == 1 {
+			return "\\" + candidates[0], candidates
+		}
+		return line, candidates
+	}
+
+	// contacts coming and going
+	go func() {
+		presences := user.GetPresenceChannel()
+		for {
+			<- presences
+			paint(user)
+		}
+	}()
 	
 	// input loop
 	peer := ""
 	for {
 		// State 1) get a user to chat with
 		if peer == "" {
+			printContacts(user)
 			fmt.Printf("User to chat with: ")
-			peer = input(reader)
+			peer = resolvePeer(user, input(reader))
 			fmt.Printf("Starting to talk to: %s\n", peer)
 			user.UpdateCurrentPeer(peer)
+			watch(user, peer)
 			fmt.Printf("me> ")
 		
 		// State 2) continue chatting
 		} else {
 		
-			text := input(reader)
+			text := inputTyping(reader, typing(peer), complete)
+			if !lastTyping.IsZero() {
+				lastTyping = time.Time{}
+				go user.SendSignal(peer, dht.StoppedTypingSignal)
+			}
 			
 			if text == "" {
 				// do nothing
@@ -135,9 +310,10 @@ func startChat() {
 			
 			} else if text[0] == 92 {
 				// switching users to chat with
-				peer = text[1:]
+				peer = resolvePeer(user, text[1:])
 				fmt.Printf("Swtiching to talk to: %v\n", peer)
 				user.UpdateCurrentPeer(peer)
+				watch(user, peer)
 				fmt.Printf("me> ")
 				paint(user)
 				
@@ -145,12 +321,231 @@ func startChat() {
 			} else if text == "exit" {
 				// exit peerchat
 				fmt.Printf("Exiting Peerchat!\n")
-				user.Logoff()
+				if err := user.Logoff(); err != nil {
+					fmt.Printf("Could not save your history: %v\n", err)
+				}
 				break
 				
+			} else if text == "/passphrase" {
+				// encrypt our history with a new passphrase
+				fmt.Printf("Current passphrase (empty if none): ")
+				old := inputSecret(reader)
+				fmt.Printf("New passphrase (empty to stop encrypting): ")
+				if err := user.ChangePassphrase(old, inputSecret(reader)); err != nil {
+					fmt.Printf("Could not change your passphrase: %v\n", err)
+				} else {
+					fmt.Printf("Passphrase changed.\n")
+				}
+
+			} else if strings.HasPrefix(text, "/status ") {
+				// tell our contacts whether we're around
+				fields := strings.SplitN(strings.TrimSpace(text[len("/status "):]), " ", 2)
+				states := map[string]string{"online": dht.Online, "away": dht.Away, "busy": dht.Busy}
+				state := states[strings.ToLower(fields[0])]
+				status := ""
+				if len(fields) == 2 {
+					status = fields[1]
+				}
+				if err := user.SetPresence(state, status); err != nil {
+					fmt.Printf("Could not set your status, use /status online|away|busy [text]\n")
+				} else {
+					fmt.Printf("You are now %s\n", presence(user.Presence()))
+				}
+
+			} else if text == "/who" {
+				// list our contacts and whether they're around
+				presences := user.Presences()
+				usernames := make([]string, 0, len(presences))
+				for username := range presences {
+					usernames = append(usernames, username)
+				}
+				sort.Strings(usernames)
+				for _, username := range usernames {
+					fmt.Printf("%s: %s\n", username, presence(presences[username]))
+				}
+				fmt.Printf("%d contact(s)\n", len(usernames))
+
+			} else if text == "/contacts" {
+				printContacts(user)
+
+			} else if strings.HasPrefix(text, "/add ") {
+				// add someone to our contacts, maybe with a nickname
+				fields := strings.SplitN(strings.TrimSpace(text[len("/add "):]), " ", 2)
+				nickname := ""
+				if len(fields) == 2 {
+					nickname = strings.TrimSpace(fields[1])
+				}
+				user.AddContact(fields[0], nickname)
+				fmt.Printf("Added `%s` to your contacts\n", fields[0])
+
+			} else if strings.HasPrefix(text, "/remove ") {
+				contact := strings.TrimSpace(text[len("/remove "):])
+				if err := user.RemoveContact(contact); err != nil {
+					fmt.Printf("Could not remove `%s`: %v\n", contact, err)
+				} else {
+					fmt.Printf("Removed `%s` from your contacts\n", contact)
+				}
+
+			} else if strings.HasPrefix(text, "/nick ") || strings.HasPrefix(text, "/note ") {
+				// change what we call a contact or what we know
+				// about them, blank to clear it
+				fields := strings.SplitN(strings.TrimSpace(text[len("/nick "):]), " ", 2)
+				value := ""
+				if len(fields) == 2 {
+					value = strings.TrimSpace(fields[1])
+				}
+				var err error
+				if strings.HasPrefix(text, "/nick ") {
+					err = user.SetNickname(fields[0], value)
+				} else {
+					err = user.SetNotes(fields[0], value)
+				}
+				if err != nil {
+					fmt.Printf("Could not change `%s`: %v\n", fields[0], err)
+				}
+
+			} else if strings.HasPrefix(text, "/pin ") || strings.HasPrefix(text, "/unpin ") {
+				fields := strings.SplitN(text, " ", 2)
+				contact := strings.TrimSpace(fields[1])
+				if err := user.PinContact(contact, fields[0] == "/pin"); err != nil {
+					fmt.Printf("Could not change `%s`: %v\n", contact, err)
+				}
+
+			} else if strings.HasPrefix(text, "/fingerprint") {
+				// show the fingerprint to compare with someone,
+				// ours if no one is named
+				contact := strings.TrimSpace(text[len("/fingerprint"):])
+				if contact == "" {
+					fmt.Printf("Your fingerprint: %s\n", user.Fingerprint())
+				} else if record := user.Node.LookupRecord(contact); record == nil {
+					fmt.Printf("Could not find `%s`\n", contact)
+				} else {
+					fmt.Printf("Fingerprint of `%s`: %s\n", contact, dht.Fingerprint(record.SigningKey))
+				}
+
+			} else if strings.HasPrefix(text, "/verify ") {
+				// check the fingerprint they told us in person
+				fields := strings.SplitN(strings.TrimSpace(text[len("/verify "):]), " ", 2)
+				if len(fields) < 2 {
+					fmt.Printf("Use /verify <username> <fingerprint>\n")
+				} else if err := user.VerifyContact(fields[0], fields[1]); err != nil {
+					fmt.Printf("Could not verify `%s`: %v\n", fields[0], err)
+				} else {
+					fmt.Printf("`%s` is verified\n", fields[0])
+				}
+
+			} else if strings.HasPrefix(text, "/block ") {
+				// stop hearing from someone
+				blocked := strings.TrimSpace(text[len("/block "):])
+				user.Block(blocked)
+				fmt.Printf("Blocked `%s`\n", blocked)
+
+			} else if strings.HasPrefix(text, "/unblock ") {
+				unblocked := strings.TrimSpace(text[len("/unblock "):])
+				user.Unblock(unblocked)
+				fmt.Printf("Unblocked `%s`\n", unblocked)
+
+			} else if text == "/blocked" {
+				blocked := user.BlockList()
+				fmt.Printf("%d blocked user(s): %s\n", len(blocked), strings.Join(blocked, ", "))
+
+			} else if text == "/queue" {
+				printQueue(user)
+
+			} else if strings.HasPrefix(text, "/search ") {
+				// look through our history
+				query, err := dht.ParseSearchQuery(text[len("/search "):])
+				if err != nil {
+					fmt.Printf("Could not search: %v\n", err)
+					continue
+				}
+				results := user.Search(query)
+				for _, msg := range results {
+					with := msg.FromUsername
+					if with == user.Name {
+						with = msg.ToUsername
+					}
+					stamp := time.Unix(msg.Timestamp, 0).Format("2006-01-02 15:04")
+					fmt.Printf("[%s] %s %s> %s\n", stamp, with, msg.FromUsername, msg.Content)
+				}
+				fmt.Printf("%d message(s) found\n", len(results))
+
+			} else if strings.HasPrefix(text, "/edit ") || text == "/delete" || strings.HasPrefix(text, "/react ") {
+				// change the last message we sent, or react to
+				// the last one we got
+				react := strings.HasPrefix(text, "/react ")
+				msg, found := lastMessage(user, peer, !react)
+				if _, inRoom := roomName(peer); inRoom || !found {
+					fmt.Printf("No message to change in this conversation\n")
+					continue
+				}
+				var err error
+				if react {
+					err = user.React(peer, msg.MessageIdentifier, strings.TrimSpace(text[len("/react "):]))
+				} else if text == "/delete" {
+					err = user.DeleteMessage(peer, msg.MessageIdentifier)
+				} else {
+					err = user.EditMessage(peer, msg.MessageIdentifier, text[len("/edit "):])
+				}
+				if err != nil {
+					fmt.Printf("Could not change the message: %v\n", err)
+				}
+				paint(user)
+
+			} else if strings.HasPrefix(text, "/send ") {
+				// offer someone a file
+				path := strings.TrimSpace(text[len("/send "):])
+				if _, inRoom := roomName(peer); inRoom {
+					fmt.Printf("Files can only be sent to one person\n")
+				} else if err := user.SendFile(peer, path); err != nil {
+					fmt.Printf("Could not send `%s`: %v\n", path, err)
+				} else {
+					paint(user)
+				}
+
+			} else if text == "/accept" {
+				// download the files we were offered
+				accepted := 0
+				for _, msg := range user.AllMessagesFromUser(peer) {
+					if msg.Attachment != nil && msg.Attachment.State == dht.FileOffered && user.AcceptFile(peer, msg.MessageIdentifier) == nil {
+						accepted++
+					}
+				}
+				fmt.Printf("Downloading %d file(s)\n", accepted)
+
+			} else if strings.HasPrefix(text, "/create ") {
+				// create a room and switch to it
+				room := strings.TrimSpace(text[len("/create "):])
+				if err := user.CreateRoom(room); err != nil {
+					fmt.Printf("Could not create room `%s`: %v\n", room, err)
+				} else {
+					peer = "#" + room
+					user.UpdateCurrentPeer(peer)
+					paint(user)
+				}
+
+			} else if strings.HasPrefix(text, "/invite ") {
+				// invite someone to the room we're in
+				invitee := strings.TrimSpace(text[len("/invite "):])
+				room, inRoom := roomName(peer)
+				if !inRoom {
+					fmt.Printf("Switch to a room with \\#room before inviting people\n")
+				} else if err := user.InviteToRoom(room, invitee); err != nil {
+					fmt.Printf("Could not invite `%s`: %v\n", invitee, err)
+				} else {
+					paint(user)
+				}
+
+			} else if room, inRoom := roomName(user.CurrentPeer()); inRoom {
+				// send the message to everyone in the room!
+				if err := user.SendRoomMessage(room, text); err != nil {
+					fmt.Printf("Could not send to room `%s`: %v\n", room, err)
+				}
+				paint(user)
+
 			} else {
 				// send the message!
-				user.SendMessage(user.Current, text)
+				user.SendMessage(user.CurrentPeer(), text)
 				paint(user)
 			}
 		}
@@ -166,7 +561,7 @@ func paint(user *dht.User) {
 	
 	// new messages?
 	usersWithPendingMessages := make([]string, 0)
-	for peer, _ := range user.MessageHistory {
+	for _, peer := range user.Peers() {
 		areNew, _ := user.AreNewMessagesFrom(peer)
 		if areNew {
 			usersWithPendingMessages = append(usersWithPendingMessages, peer)
@@ -179,24 +574,220 @@ func paint(user *dht.User) {
 	}
 	fmt.Printf("\n\n========================================\n")
 	
+	// are we in a room?
+	current := user.CurrentPeer()
+	if room, inRoom := roomName(current); inRoom {
+		record, _ := user.Room(room)
+		fmt.Printf("Room `#%s` with %s:\n\n", room, strings.Join(record.Members, ", "))
+
+		messages := make([]dht.SendMessageArgs, 0)
+		for _, msg := range user.RoomMessages(room) {
+			messages = append(messages, *msg)
+		}
+
+		// already in clock order
+		for i := 0; i < len(messages); i++ {
+			msg := messages[i]
+			fmt.Printf("%s> %s\n", msg.FromUsername, msg.Content)
+		}
+
 	// are we current chatting?
-	if user.Current != "" {
-		fmt.Printf("Conversation with `%s`:\n\n", user.Current)
+	} else if current != "" {
+		fmt.Printf("Conversation with %s (%s):\n\n", displayName(user, current), presence(user.Presences()[current]))
 		
-		newMessages := user.AllMessagesFromUser(user.Current)
+		newMessages := user.AllMessagesFromUser(current)
+		user.MarkRead(current)
 		
 		messages := make([]dht.SendMessageArgs, 0)
 		for _, msg := range newMessages {
 			messages = append(messages, *msg)
 		}
 		
-		sortutil.AscByField(messages, "Timestamp")
+		// already in clock order
 		for i := 0; i < len(messages); i++ {
 			msg := messages[i]
-			fmt.Printf("%s> %s\n", msg.FromUsername, msg.Content)
+			if msg.DecryptFailed {
+				fmt.Printf("%s> [message could not be decrypted]\n", msg.FromUsername)
+			} else if msg.FromUsername == user.Name {
+				fmt.Printf("%s> %s %s%s\n", msg.FromUsername, content(&msg), checkmarks(msg.Status), reactions(&msg))
+			} else {
+				fmt.Printf("%s> %s%s\n", msg.FromUsername, content(&msg), reactions(&msg))
+			}
+		}
+		if isTyping(current) {
+			fmt.Printf("%s is typing…\n", current)
 		}
 	}
 	
 	fmt.Printf("=========================================\n")
 	fmt.Printf("me> ")
-}
\ No newline at end of file
+}
+
+// the contact whose username or nickname is name, or name if
+// there isn't one
+func resolvePeer(user *dht.User, name string) string {
+	for _, contact := range user.ContactList() {
+		if strings.EqualFold(contact.Username, name) || (contact.Nickname != "" && strings.EqualFold(contact.Nickname, name)) {
+			return contact.Username
+		}
+	}
+	return name
+}
+
+// names peer the way we know them, with a checkmark if we've
+// verified their fingerprint
+func displayName(user *dht.User, peer string) string {
+	contact, known := user.Contact(peer)
+	name := "`" + peer + "`"
+	if known && contact.Nickname != "" {
+		name = "`" + contact.Nickname + "` (" + peer + ")"
+	}
+	if known && contact.Verified != "" {
+		name += " ✓"
+	}
+	return name
+}
+
+// lists our contacts, pinned ones first
+func printContacts(user *dht.User) {
+	contacts := user.ContactList()
+	if len(contacts) == 0 {
+		return
+	}
+	presences := user.Presences()
+	fmt.Printf("Contacts:\n")
+	for _, contact := range contacts {
+		pin := " "
+		if contact.Pinned {
+			pin = "*"
+		}
+		fmt.Printf("%s %s: %s", pin, displayName(user, contact.Username), presence(presences[contact.Username]))
+		if contact.IpAddr != "" {
+			fmt.Printf(", last at %s", contact.IpAddr)
+		}
+		if contact.Notes != "" {
+			fmt.Printf("\n    %s", contact.Notes)
+		}
+		fmt.Printf("\n")
+	}
+}
+
+// shows what the sender still has to deliver and how it has gone
+func printQueue(user *dht.User) {
+	metrics := user.QueueMetrics()
+	fmt.Printf("%d delivered, %d left with relays, %d batch(es) sent, %d failed attempt(s)\n", metrics.Delivered, metrics.Forwarded, metrics.Batches, metrics.Failures)
+	for _, queue := range metrics.Queues {
+		fmt.Printf("  %s: %d queued", displayName(user, queue.Username), queue.Pending)
+		if queue.Relaying > 0 {
+			fmt.Printf(", %d held for others", queue.Relaying)
+		}
+		if wait := time.Until(queue.NextRetry); wait > 0 {
+			fmt.Printf(", next try in %v after %d attempt(s)", wait.Round(time.Second), queue.Attempts)
+		}
+		fmt.Printf("\n")
+	}
+}
+
+// starts following peer's presence, unless it is a room
+func watch(user *dht.User, peer string) {
+	if _, inRoom := roomName(peer); !inRoom {
+		user.Watch(peer)
+	}
+}
+
+// describes presence like "Away: at lunch", or when they were
+// last seen if they're offline
+func presence(presence dht.PresenceRecord) string {
+	description := presence.State
+	if presence.State == "" {
+		description = dht.Offline
+	}
+	if presence.State == dht.Offline && presence.LastSeen != 0 {
+		description += ", last seen " + time.Unix(presence.LastSeen, 0).Format("2006-01-02 15:04")
+	}
+	if presence.Text != "" && presence.State != dht.Offline {
+		description += ": " + presence.Text
+	}
+	return description
+}
+
+// peers starting with # are rooms, returns the room's name
+func roomName(peer string) (string, bool) {
+	if strings.HasPrefix(peer, "#") {
+		return peer[1:], true
+	}
+	return "", false
+}
+
+// renders what is left of a message after edits and deletions
+func content(msg *dht.SendMessageArgs) string {
+	if msg.Deleted {
+		return "[deleted]"
+	} else if msg.Attachment != nil {
+		return fileSummary(msg)
+	} else if msg.Edited {
+		return msg.Content + " (edited)"
+	}
+	return msg.Content
+}
+
+// renders a file offer, and how far along receiving it is
+func fileSummary(msg *dht.SendMessageArgs) string {
+	attachment := msg.Attachment
+	summary := fmt.Sprintf("[file %s, %d bytes", msg.Content, attachment.Size)
+	switch attachment.State {
+	case dht.FileOffered:
+		summary += ", /accept to download it"
+	case dht.FileDownloading:
+		if attachment.Size > 0 {
+			summary += fmt.Sprintf(", %d%% downloaded", attachment.Received * 100 / attachment.Size)
+		}
+	case dht.FileComplete:
+		summary += ", saved to " + attachment.Path
+	case dht.FileFailed:
+		summary += ", could not be downloaded"
+	}
+	return summary + "]"
+}
+
+// renders how many people reacted to a message with each emoji
+func reactions(msg *dht.SendMessageArgs) string {
+	if len(msg.Reactions) == 0 {
+		return ""
+	}
+	emojis := make([]string, 0, len(msg.Reactions))
+	for emoji, _ := range msg.Reactions {
+		emojis = append(emojis, emoji)
+	}
+	sort.Strings(emojis)
+	counts := make([]string, 0, len(emojis))
+	for _, emoji := range emojis {
+		counts = append(counts, fmt.Sprintf("%s %d", emoji, len(msg.Reactions[emoji])))
+	}
+	return " [" + strings.Join(counts, ", ") + "]"
+}
+
+// returns the last message in our conversation with peer that
+// mine says is ours to change, and isn't deleted
+func lastMessage(user *dht.User, peer string, mine bool) (*dht.SendMessageArgs, bool) {
+	messages := user.AllMessagesFromUser(peer)
+	for i := len(messages) - 1; i >= 0; i-- {
+		if !messages[i].Deleted && (messages[i].FromUsername == user.Name) == mine {
+			return messages[i], true
+		}
+	}
+	return nil, false
+}
+
+// renders the delivery status of a message we sent
+func checkmarks(status string) string {
+	switch status {
+	case dht.Relayed:
+		return "(✓)"
+	case dht.Delivered:
+		return "(✓✓)"
+	case dht.Read:
+		return "(✓✓ read)"
+	}
+	return "(...)"
+}
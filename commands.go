@@ -0,0 +1,94 @@
+package main
+
+import "bufio"
+import "errors"
+import "flag"
+import "fmt"
+import "os"
+import "dht"
+
+const commandsUsage = `usage:
+  peerchat                                       start chatting
+  peerchat export [-format json|text|mbox] [-o file] username [peer ...]
+                                                 write username's conversations with
+                                                 peers, or all of them, to file or stdout
+  peerchat import username file                  merge a json export into username's
+                                                 history, while they are logged off
+`
+
+// runs a peerchat subcommand and returns the exit status
+func runCommand(name string, args []string) int {
+	switch name {
+	case "export":
+		return exportCommand(args)
+	case "import":
+		return importCommand(args)
+	}
+	fmt.Fprint(os.Stderr, commandsUsage)
+	return 2
+}
+
+// loads username's profile without going online, asking for their
+// passphrase if it is encrypted
+func loadProfile(username string) (*dht.User, error) {
+	user, err := dht.LoadProfile(username, "")
+	if errors.Is(err, dht.ErrPassphraseRequired) {
+		fmt.Fprintf(os.Stderr, "Enter passphrase for `%s`: ", username)
+		user, err = dht.LoadProfile(username, inputSecret(bufio.NewReader(os.Stdin)))
+	}
+	return user, err
+}
+
+func exportCommand(args []string) int {
+	flags := flag.NewFlagSet("export", flag.ContinueOnError)
+	format := flags.String("format", dht.ExportJSON, "json, text or mbox")
+	output := flags.String("o", "", "file to write to instead of stdout")
+	if err := flags.Parse(args); err != nil || flags.NArg() < 1 {
+		fmt.Fprint(os.Stderr, commandsUsage)
+		return 2
+	}
+
+	user, err := loadProfile(flags.Arg(0))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not load `%s`: %v\n", flags.Arg(0), err)
+		return 1
+	}
+	w := os.Stdout
+	if *output != "" {
+		if w, err = os.Create(*output); err != nil {
+			fmt.Fprintf(os.Stderr, "Could not create %s: %v\n", *output, err)
+			return 1
+		}
+		defer w.Close()
+	}
+	if err := user.ExportConversations(w, *format, flags.Args()[1:]...); err != nil {
+		fmt.Fprintf(os.Stderr, "Could not export: %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+func importCommand(args []string) int {
+	if len(args) != 2 {
+		fmt.Fprint(os.Stderr, commandsUsage)
+		return 2
+	}
+	user, err := loadProfile(args[0])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not load `%s`: %v\n", args[0], err)
+		return 1
+	}
+	f, err := os.Open(args[1])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not open %s: %v\n", args[1], err)
+		return 1
+	}
+	defer f.Close()
+	added, err := user.ImportConversations(f)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not import %s: %v\n", args[1], err)
+		return 1
+	}
+	fmt.Printf("Imported %d new messages into `%s`\n", added, args[0])
+	return 0
+}
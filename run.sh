@@ -1,3 +1,3 @@
-rm /tmp/*gob
+rm -f "${PEERCHAT_DATA_DIR:-${XDG_DATA_HOME:-$HOME/.local/share}/peerchat}"/*.gob "${PEERCHAT_DATA_DIR:-${XDG_DATA_HOME:-$HOME/.local/share}/peerchat}"/*.journal
 go build
 ./peerchat
\ No newline at end of file
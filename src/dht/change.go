@@ -0,0 +1,189 @@
+package dht
+
+import "errors"
+import "fmt"
+import "sort"
+
+const ChangeTag = "CHANGE"
+
+var ErrNoSuchMessage = errors.New("dht: no such message")
+var ErrNotYourMessage = errors.New("dht: only the sender of a message can change it")
+
+// how many changes we hold from each peer for messages we don't
+// have yet, see OrphanChanges. a variable so tests can lower it
+var OrphanLimit = 100
+
+// Edits, deletions and reactions are messages of their own, of
+// EditKind, DeleteKind or ReactKind, whose Ref is the
+// MessageIdentifier of the message they change. They go through
+// the sender queue and relays like any other message, and are
+// applied to the copy of the message in each side's history.
+// Applying one twice changes nothing, so relays handing them
+// over more than once is harmless.
+
+func isChange(msg *SendMessageArgs) bool {
+	return msg.Kind == EditKind || msg.Kind == DeleteKind || msg.Kind == ReactKind
+}
+
+// replaces the content of a message we sent to peer
+func (user *User) EditMessage(peer string, messageIdentifier int64, content string) error {
+	return user.sendChange(peer, EditKind, messageIdentifier, content)
+}
+
+// retracts a message we sent to peer, for both of us
+func (user *User) DeleteMessage(peer string, messageIdentifier int64) error {
+	return user.sendChange(peer, DeleteKind, messageIdentifier, "")
+}
+
+// reacts to a message in our conversation with peer with emoji
+func (user *User) React(peer string, messageIdentifier int64, emoji string) error {
+	return user.sendChange(peer, ReactKind, messageIdentifier, emoji)
+}
+
+func (user *User) sendChange(peer string, kind string, ref int64, content string) error {
+	/*
+		Applies a change to message ref in our conversation
+		with peer and queues it for peer. Returns
+		ErrNoSuchMessage if we don't have the message or it
+		was deleted, and ErrNotYourMessage if we try to edit
+		or delete a message peer sent.
+	*/
+	user.mu.Lock()
+	msg := user.findMessage(peer, ref)
+	if msg == nil || msg.Deleted {
+		user.mu.Unlock()
+		return fmt.Errorf("%w: %v with %s", ErrNoSuchMessage, ref, peer)
+	}
+	if kind != ReactKind && msg.FromUsername != user.Name {
+		user.mu.Unlock()
+		return ErrNotYourMessage
+	}
+	Print(ChangeTag, "%s queuing %s of message %v to %s", user.Name, kind, ref, peer)
+	change := &SendMessageArgs{Content: content, Timestamp: user.now().Unix(), Clock: user.tick(peer), ToUsername: peer, FromUsername: user.Name, MessageIdentifier: nrand(), Kind: kind, Ref: ref}
+	user.applyChange(peer, change)
+	user.journal(journalEntry{Op: journalChange, Key: peer, Message: change})
+	user.enqueue(peer, change)
+	user.journal(journalEntry{Op: journalPending, Key: peer, Message: change})
+	user.mu.Unlock()
+	user.flushJournal()
+	return nil
+}
+
+// called by SendMessageHandler with user.mu held
+func (user *User) receiveChange(change *SendMessageArgs) {
+	// only the sender can say who a change is from, and the
+	// message it changes is theirs or ours
+	if !change.verified {
+		Print(ChangeTag, "%s dropping unsigned %s from %s", user.Name, change.Kind, change.FromUsername)
+		return
+	}
+	user.observeClock(change.FromUsername, change)
+	user.journal(journalEntry{Op: journalChange, Key: change.FromUsername, Message: change})
+	if user.applyChange(change.FromUsername, change) {
+		user.notify(user.findMessage(change.FromUsername, change.Ref))
+	}
+}
+
+func (user *User) applyChange(peer string, change *SendMessageArgs) bool {
+	/*
+		Applies change to the message it refers to in our
+		conversation with peer, returning whether it changed
+		anything. A change can reach us through a relay
+		before the message it is about, in which case it is
+		held in OrphanChanges until the message arrives. An
+		edit only wins over an earlier edit by its Clock,
+		so edits arriving out of order leave the latest one.
+		Must be called with user.mu held.
+	*/
+	if change.DecryptFailed {
+		return false
+	}
+	msg := user.findMessage(peer, change.Ref)
+	if msg == nil {
+		for _, orphan := range user.OrphanChanges[change.Ref] {
+			if orphan.MessageIdentifier == change.MessageIdentifier {
+				return false
+			}
+		}
+		if user.orphansFrom(change.FromUsername) >= OrphanLimit {
+			Print(ChangeTag, "%s dropping %s from %s, already holding %d changes from them", user.Name, change.Kind, change.FromUsername, OrphanLimit)
+			return false
+		}
+		user.OrphanChanges[change.Ref] = append(user.OrphanChanges[change.Ref], change)
+		return false
+	}
+	if msg.Deleted {
+		return false
+	}
+
+	switch change.Kind {
+	case EditKind:
+		if change.FromUsername != msg.FromUsername || change.order() <= msg.EditClock {
+			return false
+		}
+		user.unindexMessage(msg)
+		msg.Content = change.Content
+		msg.Edited = true
+		msg.EditClock = change.order()
+		user.indexMessage(peer, msg)
+	case DeleteKind:
+		if change.FromUsername != msg.FromUsername {
+			return false
+		}
+		user.unindexMessage(msg)
+		msg.Content = ""
+		msg.Deleted = true
+		msg.Reactions = nil
+	case ReactKind:
+		if change.Content == "" {
+			return false
+		}
+		users := msg.Reactions[change.Content]
+		i := sort.SearchStrings(users, change.FromUsername)
+		if i < len(users) && users[i] == change.FromUsername {
+			return false
+		}
+		if msg.Reactions == nil {
+			msg.Reactions = make(map[string][]string)
+		}
+		users = append(users, "")
+		copy(users[i+1:], users[i:])
+		users[i] = change.FromUsername
+		msg.Reactions[change.Content] = users
+	default:
+		return false
+	}
+	Print(ChangeTag, "%s applied %s from %s to message %v", user.Name, change.Kind, change.FromUsername, change.Ref)
+	return true
+}
+
+// returns how many changes from username are waiting in
+// OrphanChanges. must be called with user.mu held
+func (user *User) orphansFrom(username string) int {
+	held := 0
+	for _, orphans := range user.OrphanChanges {
+		for _, orphan := range orphans {
+			if orphan.FromUsername == username {
+				held++
+			}
+		}
+	}
+	return held
+}
+
+// applies the changes peer sent that were waiting for msg, which
+// was just added to our conversation with them. Changes from
+// anyone else were about some other message of theirs, or made
+// up, and are dropped. must be called with user.mu held
+func (user *User) applyOrphans(peer string, msg *SendMessageArgs) {
+	orphans, ok := user.OrphanChanges[msg.MessageIdentifier]
+	if !ok {
+		return
+	}
+	delete(user.OrphanChanges, msg.MessageIdentifier)
+	for _, change := range orphans {
+		if change.FromUsername == peer {
+			user.applyChange(peer, change)
+		}
+	}
+}
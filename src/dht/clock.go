@@ -0,0 +1,99 @@
+package dht
+
+import "sort"
+import "time"
+
+// Messages are ordered by a hybrid logical clock kept for each
+// conversation. A clock value is a wall time in milliseconds,
+// shifted left by clockLogicalBits, plus a counter in the low
+// bits that breaks ties between messages in the same
+// millisecond. Every message we send gets a value past the last
+// one we sent or saw in its conversation, so a reply always
+// sorts after what it answers even if the sender's wall clock is
+// behind, while messages nobody has answered yet stay in wall
+// clock order.
+const clockLogicalBits = 16
+
+// the clock value at the start of wall time t
+func wallClock(t time.Time) int64 {
+	return t.UnixMilli() << clockLogicalBits
+}
+
+// returns where msg falls in its conversation. Messages sent
+// before there were clocks only have their Timestamp, which is
+// the clock value of the start of that second
+func (msg *SendMessageArgs) order() int64 {
+	if msg.Clock != 0 {
+		return msg.Clock
+	}
+	return wallClock(time.Unix(msg.Timestamp, 0))
+}
+
+// reports whether a sorts before b. Messages sent at the same
+// clock value by different users are ordered by who sent them and
+// then by MessageIdentifier, so both sides of a conversation show
+// it in the same order.
+func messageBefore(a *SendMessageArgs, b *SendMessageArgs) bool {
+	if a.order() != b.order() {
+		return a.order() < b.order()
+	}
+	if a.FromUsername != b.FromUsername {
+		return a.FromUsername < b.FromUsername
+	}
+	return a.MessageIdentifier < b.MessageIdentifier
+}
+
+func sortMessages(msgs []*SendMessageArgs) {
+	sort.SliceStable(msgs, func(i, j int) bool {
+		return messageBefore(msgs[i], msgs[j])
+	})
+}
+
+// the key of a room's clock in Clocks, which can't be a username
+func roomClock(name string) string {
+	return "#" + name
+}
+
+// the wall clock time according to this user. tests set
+// user.wallTime to simulate machines whose clocks disagree
+func (user *User) now() time.Time {
+	if user.wallTime != nil {
+		return user.wallTime()
+	}
+	return time.Now()
+}
+
+// returns the clock value for a message we are sending in the
+// conversation key. must be called with user.mu held
+func (user *User) tick(key string) int64 {
+	next := wallClock(user.now())
+	if last := user.Clocks[key]; next <= last {
+		next = last + 1
+	}
+	user.Clocks[key] = next
+	return next
+}
+
+// sets Clocks from the messages we already have, for profiles
+// saved before there were clocks. must be called with user.mu held
+func (user *User) rebuildClocks() {
+	user.Clocks = make(map[string]int64)
+	for peer, messages := range user.MessageHistory {
+		for _, msg := range messages {
+			user.observeClock(peer, msg)
+		}
+	}
+	for room, messages := range user.RoomHistory {
+		for _, msg := range messages {
+			user.observeClock(roomClock(room), msg)
+		}
+	}
+}
+
+// moves the clock of conversation key past msg, which was just
+// added to it. must be called with user.mu held
+func (user *User) observeClock(key string, msg *SendMessageArgs) {
+	if clock := msg.order(); clock > user.Clocks[key] {
+		user.Clocks[key] = clock
+	}
+}
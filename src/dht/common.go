@@ -1,24 +1,81 @@
 package dht
 
 import "crypto/sha1"
-import "net/rpc"
 import "fmt"
-import "strconv"
 import "crypto/rand"
 import "math/big"
 import "os"
+import "encoding/hex"
 import "time"
 
 // Configurable constants
 const (
-	IDLen = 64
+	IDLen = 160 // width of an ID in bits, must be a multiple of 8
 	K = 20
 	Alpha = 3
 )
 
+// Configurable timings for records stored in the DHT. These
+// are variables so tests can shorten them.
+var (
+	RecordTTL = time.Hour // records expire this long after their owner signed them
+	RepublishEvery = 20 * time.Minute // how often online users sign and store their records again
+	ReplicateEvery = 20 * time.Minute // how often nodes store the records they hold on the K closest nodes
+)
+
+// Routing table maintenance, also variables for tests
+var (
+	MaintainEvery = time.Minute // how often the maintenance loop runs
+	RefreshEvery = time.Hour // buckets without a lookup for this long are refreshed
+	MaxPingFailures = 3 // pings in a row an entry can fail before it is evicted
+	ReplacementCacheSize = K // nodes remembered per full bucket
+)
+
+// returns true if a record signed at seq has outlived RecordTTL.
+// expiry is measured from when the owner signed the record, so
+// nodes re-storing it for replication can't keep it alive
+func isExpired(seq int64) bool {
+	return time.Now().UnixNano() > seq + int64(RecordTTL)
+}
+
 const (
 	Online = "Online"
 	Offline = "Offline"
+	Away = "Away" // online, but not at the keyboard
+	Busy = "Busy" // online, but would rather not be disturbed
+)
+
+// delivery status of a message we sent, in the order they happen
+const (
+	Queued = "Queued" // waiting in our PendingMessages
+	Relayed = "Relayed" // handed to a node holding it for the offline recipient
+	Delivered = "Delivered" // the recipient has it
+	Read = "Read" // the recipient has looked at it
+)
+
+// kinds of SendMessageArgs
+const (
+	TextKind = "" // a chat message
+	AckKind = "Ack" // tells the sender of message Ref that its status changed
+	InviteKind = "Invite" // tells the recipient they were added to Room
+	EditKind = "Edit" // replaces the Content of message Ref with its own
+	DeleteKind = "Delete" // retracts message Ref
+	ReactKind = "React" // adds the emoji in Content to message Ref's reactions
+	FileKind = "File" // offers the file described by Attachment, named Content
+)
+
+// kinds of SignalArgs
+const (
+	TypingSignal = "Typing" // the sender is typing to us, for the next TypingFor
+	StoppedTypingSignal = "StoppedTyping" // the sender sent or cleared what they were typing
+)
+
+// how far the recipient of a file has got with it
+const (
+	FileOffered = "Offered" // bigger than AutoAcceptLimit, waiting for AcceptFile
+	FileDownloading = "Downloading"
+	FileComplete = "Complete" // saved at Attachment.Path
+	FileFailed = "Failed" // the data didn't match the hashes it was offered with
 )
 
 const Debug=0
@@ -32,9 +89,7 @@ func Print(tag string, format string, a ...interface{}) (n int, err error) {
 }
 
 func Short(id ID) string{
-	my_string := strconv.FormatUint(uint64(id), 10)
-	// fmt.Println(my_string)
-	return my_string[:4]
+	return hex.EncodeToString(id[:2])
 }
 
 func nrand() int64 {
@@ -54,31 +109,211 @@ type RoutingEntryDist struct {
 	RoutingEntry RoutingEntry
 }
 
-type ID uint64
+// an ID is a big-endian IDLen bit integer, so the most
+// significant bit of the key space is the top bit of ID[0]
+type ID [IDLen / 8]byte
+
+func (id ID) String() string {
+	return hex.EncodeToString(id[:])
+}
+
+// returns true if a is strictly smaller than b
+func (a ID) Less(b ID) bool {
+	for i := range a {
+		if a[i] != b[i] {
+			return a[i] < b[i]
+		}
+	}
+	return false
+}
+
+// returns the value of bit i, counting from the most significant bit
+func (id ID) Bit(i uint) bool {
+	return id[i/8] & (0x80 >> (i % 8)) != 0
+}
+
+// sorts a slice of RoutingEntryDist by increasing distance
+type ByDistance []RoutingEntryDist
+
+func (s ByDistance) Len() int { return len(s) }
+func (s ByDistance) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s ByDistance) Less(i, j int) bool { return s[i].Distance.Less(s[j].Distance) }
 
 type SendMessageArgs struct {
 	Content string
 	Timestamp int64
+	Clock int64 // where the message falls in its conversation, see clock.go
 	ToUsername string
 	FromUsername string
 	MessageIdentifier int64
+	Sealed []byte // Content encrypted for ToUsername, the only thing relays see
+	DecryptFailed bool // set by the recipient if Sealed could not be opened
+	Kind string // TextKind, or one of the kinds above
+	Ref int64 // MessageIdentifier of the message an ack is about
+	Relayed bool // set by a relay node when it takes the message
+	HeldSince int64 // when the relay node took it, unix seconds
+	Status string // delivery status, only tracked for messages we sent
+	Room string // name of the room a message was sent to, "" for one-to-one chats
+	Edited bool // Content was replaced by an EditKind message
+	EditClock int64 // Clock of the edit Content came from
+	Deleted bool // retracted by its sender, Content is gone
+	Reactions map[string][]string // emoji => users who reacted with it, sorted
+	Attachment *Attachment // the file a FileKind message offers
+	Signature []byte // FromUsername's signature over the message as it travels, see signedBytes
+	verified bool // Signature was checked by receiveMessage, never sent or saved
 }
 
 type SendMessageReply struct {
-	
+	Status string // Delivered if the recipient took it, Relayed if a relay did
+}
+
+// Messages queued for the same recipient, sent together in the
+// order they were queued
+type SendMessagesArgs struct {
+	Messages []SendMessageArgs
+}
+
+type SendMessagesReply struct {
+	Statuses []string // the Status for each of Messages, "" for ones that weren't taken
+}
+
+// A file offered by a FileKind message. Files up to
+// InlineFileLimit carry their Data, sealed like Content, and can
+// be relayed. Bigger ones have ChunkHashes instead and are
+// fetched from the sender's node a chunk at a time.
+type Attachment struct {
+	Size int64
+	Hash []byte // SHA-256 of the whole file
+	ChunkSize int
+	ChunkHashes [][]byte // SHA-256 of each chunk, nil if Data is set
+	Data []byte
+	Sealed []byte // Hash, ChunkHashes and Data sealed for the recipient, while the offer travels
+
+	// kept by each side for itself, never sent
+	State string // the recipient's progress, one of the File states
+	Received int64 // bytes of the file the recipient has saved
+	Path string // where the file is on this machine
+}
+
+type FetchChunkArgs struct {
+	Username string // who is fetching, the chunk is sealed for them
+	MessageIdentifier int64 // of the FileKind message offering the file
+	Index int
+}
+
+type FetchChunkReply struct {
+	Sealed []byte
+}
+
+// A signed claim that Username can be reached at IpAddr.
+// Records are stored under Sha1(Username) and nodes only
+// accept them if the signature verifies, the SigningKey is
+// the one the username was first registered with, and Seq
+// is not older than the record they already hold.
+type UserRecord struct {
+	Username string
+	IpAddr string
+	PublicKey []byte // X25519 key to seal messages for Username with
+	SigningKey []byte // ed25519 key that owns Username
+	Seq int64
+	Signature []byte
+}
+
+// What Username tells the users watching them about
+// themselves, signed with the key their UserRecord is. LastSeen
+// is when it was signed, which is whenever a watcher asks, so a
+// record that can't be refreshed tells its watchers when its
+// owner was last around.
+type PresenceRecord struct {
+	Username string
+	State string // Online, Away, Busy or Offline
+	Text string // a custom status, "" for none
+	LastSeen int64 // unix seconds
+	Seq int64
+	Signature []byte
+}
+
+type SubscribePresenceArgs struct {
+	Username string // who wants to hear about changes
+	IpAddr string // where to push them, the address in Username's record
+	Seq int64
+	Signature []byte // Username's signature over the fields above
+}
+
+type SubscribePresenceReply struct {
+	Presence PresenceRecord
+}
+
+type PresenceReply struct {
+}
+
+// A passing event, like someone typing, sent straight to
+// ToUsername while they are online. Signals are never relayed,
+// stored or deduplicated, and are signed with the key in the
+// sender's UserRecord. Seq is when it was sent, in nanoseconds.
+type SignalArgs struct {
+	FromUsername string
+	ToUsername string
+	Kind string
+	Seq int64
+	Signature []byte
+}
+
+type SignalReply struct {
+}
+
+// Asks a node for the messages it holds for Username, signed
+// with the key in their UserRecord so only they can collect them.
+// Seq is when it was signed, in nanoseconds.
+type PullMailArgs struct {
+	Username string
+	Seq int64
+	Signature []byte
+}
+
+type PullMailReply struct {
+	Messages []SendMessageArgs // sealed for Username
 }
 
 type StoreUserArgs struct {
 	QueryingNodeId ID
 	QueryingIpAddr string
-	AnnouncedUserId ID
-	AnnouncedIpAddr string
+	Record UserRecord
+}
+
+// The membership of a group room, stored under RoomId(Name).
+// Rooms are owned like usernames: the first OwnerKey to
+// publish a room is the only one that can change it.
+type RoomRecord struct {
+	Name string
+	Owner string // username of the room's creator
+	Members []string // usernames, including Owner
+	OwnerKey []byte // ed25519 key of Owner
+	Seq int64
+	Signature []byte
+}
+
+type StoreRoomArgs struct {
+	QueryingNodeId ID
+	QueryingIpAddr string
+	Room RoomRecord
 }
 
 type StoreUserReply struct {
 	QueriedNodeId ID
 }
 
+type FindOwnerArgs struct {
+	QueryingNodeId ID
+	QueryingIpAddr string
+	TargetId ID
+}
+
+type FindOwnerReply struct {
+	QueriedNodeId ID
+	SigningKey []byte // the key TargetId is pinned to, nil if none
+}
+
 type FindIdArgs struct {
 	QueryingNodeId ID
 	QueryingIpAddr string
@@ -89,7 +324,8 @@ type FindIdReply struct {
 	QueriedNodeId ID
 	QueriedIpAddr string
 	TryNodes []RoutingEntryDist // if list is of length 1, then we found it
-	TargetIpAddr string
+	TargetRecord *UserRecord // set if the queried node holds the target user's record
+	TargetRoom *RoomRecord // set if the queried node holds the target room's record
 }
 
 type PingArgs struct {
@@ -104,43 +340,67 @@ type PingReply struct {
 func Sha1(s string) ID {
 	/*
 		Returns a 160 bit integer based on a
-		string input. 
+		string input. If IDLen is narrower than
+		the digest, the most significant bytes
+		are kept.
 	*/
-    h := sha1.New()
-    h.Write([]byte(s))
-    bs := h.Sum(nil)
-    l := len(bs)
-    var a ID
-	for i, b := range bs {
-	    shift := ID((l-i-1) * 8)	
-	    a |= ID(b) << shift
-   	}
-   	return a
+	bs := sha1.Sum([]byte(s))
+	var a ID
+	copy(a[:], bs[:])
+	return a
 }
 
 func Xor(a, b ID) ID {
 	/*
-		Zors together two big.Ints and
+		Xors together two IDs and
 		returns the result.
 	*/
-	return a ^ b
+	var d ID
+	for i := range a {
+		d[i] = a[i] ^ b[i]
+	}
+	return d
 }
 
 func find_n(a, b ID) uint{
-	var IDLen uint
-	IDLen = 64
-	var d, diff ID
-	diff = a ^ b
+	/*
+		Returns the index of the first bit at which
+		a and b differ, which is the index of the
+		k-bucket b belongs in for a node with ID a.
+	*/
+	diff := Xor(a, b)
 	var i uint
 	for i = 0; i < IDLen; i++{
-		d = 1<<(IDLen - 1 - i)
-		if d & diff != 0 { // if true, return i
+		if diff.Bit(i) { // if true, return i
 			return i
 		}
 	}
 	return IDLen - 1
 }
 
+func randomIdInBucket(self ID, n uint) ID {
+	/*
+		Returns a random ID that belongs in bucket n of the
+		node with ID self: it shares self's first n bits
+		and differs at bit n.
+	*/
+	var id ID
+	rand.Read(id[:])
+	for i := uint(0); i <= n; i++ {
+		mask := byte(0x80) >> (i % 8)
+		bit := self.Bit(i)
+		if i == n {
+			bit = !bit
+		}
+		if bit {
+			id[i / 8] |= mask
+		} else {
+			id[i / 8] &^= mask
+		}
+	}
+	return id
+}
+
 func isEqual(entry1 []RoutingEntryDist, entry2 []RoutingEntryDist) bool{
 	if len(entry1) != len(entry2){
 		return false
@@ -180,45 +440,3 @@ func appendToCsv(filename, text string) {
 	    panic(err)
 	}
 }
-
-// call() sends an RPC to the rpcname handler on server srv
-// with arguments args, waits for the reply, and leaves the
-// reply in reply. the reply argument should be a pointer
-// to a reply structure.
-//
-// the return value is true if the server responded, and false
-// if call() was not able to contact the server. in particular,
-// the reply's contents are only valid if call() returned true.
-func call(srv string, rpcname string, args interface{}, reply interface{}) bool {
-
-	// collect data
-	/*
-	n := 640
-	text := fmt.Sprintf("%s, %d, %d, %d, %d\n", rpcname, time.Now().Unix(), K, Alpha, n)
-	filename := fmt.Sprintf("/Users/will/Code/Go/peerchat/writeup/plots/SWEEP.csv")
-	appendToCsv(filename, text)
-	*/
-
-	c:= make(chan bool, 1)
-	go func() { 
-		client, errx := rpc.Dial("tcp", srv)
-		if errx != nil {
-			c <- false
-			return
-		}
-		defer client.Close()
-			
-		err := client.Call(rpcname, args, reply)
-		if err == nil {
-			c <- true
-			return
-		}
-	}()
-
-	select {
-	case result := <- c:
-		return result
-	case <- time.After(time.Second *2):
-		return false
-	}
-}
\ No newline at end of file
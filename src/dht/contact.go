@@ -0,0 +1,208 @@
+package dht
+
+import "crypto/sha256"
+import "encoding/hex"
+import "errors"
+import "fmt"
+import "sort"
+import "strings"
+
+const ContactTag = "CONTACT"
+
+var ErrNoSuchContact = errors.New("dht: no such contact")
+var ErrFingerprintMismatch = errors.New("dht: fingerprint does not match the user's key")
+
+// Someone in our address book. Everything but Username is ours
+// to set, except IpAddr, which is where we last reached them
+type Contact struct {
+	Username string
+	Nickname string // what we call them, Username if ""
+	Notes string
+	Pinned bool // shown before everyone else
+	IpAddr string // their node's address when we last reached them
+	Verified string // the fingerprint we checked with them, "" if we haven't
+}
+
+// the name we show for contact
+func (contact *Contact) DisplayName() string {
+	if contact.Nickname != "" {
+		return contact.Nickname
+	}
+	return contact.Username
+}
+
+// returns the fingerprint of signingKey, in groups of four hex
+// digits so it can be read out and compared by people
+func Fingerprint(signingKey []byte) string {
+	sum := sha256.Sum256(signingKey)
+	digits := hex.EncodeToString(sum[:])
+	groups := make([]string, 0, len(digits) / 4)
+	for i := 0; i < len(digits); i += 4 {
+		groups = append(groups, digits[i:i+4])
+	}
+	return strings.Join(groups, " ")
+}
+
+// returns fingerprint without spaces or case, so that fingerprints
+// typed in any way compare equal
+func normalizeFingerprint(fingerprint string) string {
+	return strings.ToLower(strings.Join(strings.Fields(fingerprint), ""))
+}
+
+// the fingerprint of our own key, for contacts to verify
+func (user *User) Fingerprint() string {
+	return Fingerprint(user.Keys.SignPublic)
+}
+
+func (user *User) AddContact(username string, nickname string) {
+	/*
+		Adds username to our contacts, or changes their
+		nickname if they are already there and nickname
+		isn't empty, and starts watching their presence.
+		Their address is filled in now if they can be
+		found, and whenever we reach them after.
+	*/
+	user.mu.Lock()
+	contact, known := user.Contacts[username]
+	if !known {
+		contact = Contact{Username: username}
+	}
+	if nickname != "" {
+		contact.Nickname = nickname
+	}
+	user.Contacts[username] = contact
+	user.mu.Unlock()
+
+	if record := user.Node.LookupRecord(username); record != nil {
+		user.reached(username, record.IpAddr)
+	}
+	user.Watch(username)
+	user.persist()
+}
+
+func (user *User) RemoveContact(username string) error {
+	user.mu.Lock()
+	_, known := user.Contacts[username]
+	delete(user.Contacts, username)
+	user.mu.Unlock()
+	if !known {
+		return fmt.Errorf("%w: %s", ErrNoSuchContact, username)
+	}
+	user.persist()
+	return nil
+}
+
+// applies change to username's entry in our contacts and saves it
+func (user *User) updateContact(username string, change func(contact *Contact)) error {
+	user.mu.Lock()
+	contact, known := user.Contacts[username]
+	if known {
+		change(&contact)
+		user.Contacts[username] = contact
+	}
+	user.mu.Unlock()
+	if !known {
+		return fmt.Errorf("%w: %s", ErrNoSuchContact, username)
+	}
+	user.persist()
+	return nil
+}
+
+// sets what we call username, "" to use their username
+func (user *User) SetNickname(username string, nickname string) error {
+	return user.updateContact(username, func(contact *Contact) { contact.Nickname = nickname })
+}
+
+func (user *User) SetNotes(username string, notes string) error {
+	return user.updateContact(username, func(contact *Contact) { contact.Notes = notes })
+}
+
+func (user *User) PinContact(username string, pinned bool) error {
+	return user.updateContact(username, func(contact *Contact) { contact.Pinned = pinned })
+}
+
+func (user *User) VerifyContact(username string, fingerprint string) error {
+	/*
+		Marks username as verified if fingerprint, which
+		they told us some other way, is the fingerprint of
+		the key in their UserRecord. Returns ErrNoSuchContact
+		if they aren't in our contacts, ErrUnknownUser if
+		their record can't be found and ErrFingerprintMismatch
+		if it is someone else's key.
+	*/
+	user.mu.Lock()
+	_, known := user.Contacts[username]
+	user.mu.Unlock()
+	if !known {
+		return fmt.Errorf("%w: %s", ErrNoSuchContact, username)
+	}
+	record := user.Node.LookupRecord(username)
+	if record == nil {
+		return fmt.Errorf("%w: %s", ErrUnknownUser, username)
+	}
+	actual := Fingerprint(record.SigningKey)
+	if normalizeFingerprint(fingerprint) != normalizeFingerprint(actual) {
+		return fmt.Errorf("%w: %s", ErrFingerprintMismatch, username)
+	}
+	Print(ContactTag, "%s verified %s", user.Name, username)
+	return user.updateContact(username, func(contact *Contact) { contact.Verified = actual })
+}
+
+// returns our contact username, and whether we have them
+func (user *User) Contact(username string) (Contact, bool) {
+	user.mu.Lock()
+	defer user.mu.Unlock()
+	contact, known := user.Contacts[username]
+	return contact, known
+}
+
+// returns our contacts, pinned ones first, each in order of
+// the name we show for them
+func (user *User) ContactList() []Contact {
+	user.mu.Lock()
+	contacts := make([]Contact, 0, len(user.Contacts))
+	for _, contact := range user.Contacts {
+		contacts = append(contacts, contact)
+	}
+	user.mu.Unlock()
+	sort.Slice(contacts, func(i, j int) bool {
+		if contacts[i].Pinned != contacts[j].Pinned {
+			return contacts[i].Pinned
+		}
+		a, b := strings.ToLower(contacts[i].DisplayName()), strings.ToLower(contacts[j].DisplayName())
+		if a != b {
+			return a < b
+		}
+		return contacts[i].Username < contacts[j].Username
+	})
+	return contacts
+}
+
+// returns the usernames of contacts whose username or nickname
+// starts with prefix, ignoring case, in the order of ContactList.
+// a contact whose name is exactly prefix is the only match
+func (user *User) CompleteContact(prefix string) []string {
+	prefix = strings.ToLower(prefix)
+	matches := make([]string, 0)
+	for _, contact := range user.ContactList() {
+		username, nickname := strings.ToLower(contact.Username), strings.ToLower(contact.Nickname)
+		if username == prefix || (nickname != "" && nickname == prefix) {
+			return []string{contact.Username}
+		}
+		if strings.HasPrefix(username, prefix) || (nickname != "" && strings.HasPrefix(nickname, prefix)) {
+			matches = append(matches, contact.Username)
+		}
+	}
+	return matches
+}
+
+// remembers ipAddr as where username was last reached, if they
+// are one of our contacts
+func (user *User) reached(username string, ipAddr string) {
+	user.mu.Lock()
+	defer user.mu.Unlock()
+	if contact, known := user.Contacts[username]; known && ipAddr != "" {
+		contact.IpAddr = ipAddr
+		user.Contacts[username] = contact
+	}
+}
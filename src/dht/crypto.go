@@ -0,0 +1,180 @@
+package dht
+
+import "crypto/ecdh"
+import "crypto/aes"
+import "crypto/cipher"
+import "crypto/rand"
+import "crypto/sha256"
+import "crypto/ed25519"
+import "encoding/binary"
+import "errors"
+import "time"
+
+// A user's long-term keys. Public is an X25519 key published
+// in the DHT next to the username record, and anyone can use
+// it to seal messages that only the owner of Private can open.
+// SignPublic is an ed25519 key that owns the username: every
+// username record is signed with SignPrivate.
+type KeyPair struct {
+	Public []byte
+	Private []byte
+	SignPublic []byte
+	SignPrivate []byte
+}
+
+var ErrDecrypt = errors.New("dht: message could not be decrypted")
+var ErrBadSignature = errors.New("dht: username record signature does not verify")
+var ErrStaleRecord = errors.New("dht: username record is older than the one held")
+var ErrExpiredRecord = errors.New("dht: record has outlived RecordTTL")
+var ErrUsernameTaken = errors.New("dht: username is already claimed by another key")
+var ErrBadMessage = errors.New("dht: message is not signed by its sender")
+
+func GenerateKeyPair() *KeyPair {
+	priv, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		panic(err)
+	}
+	keys := &KeyPair{Public: priv.PublicKey().Bytes(), Private: priv.Bytes()}
+	keys.ensureSigningKey()
+	return keys
+}
+
+// profiles saved before usernames were signed have no signing
+// key, so they get one the first time they are loaded
+func (keys *KeyPair) ensureSigningKey() {
+	if len(keys.SignPrivate) == ed25519.PrivateKeySize {
+		return
+	}
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		panic(err)
+	}
+	keys.SignPublic = pub
+	keys.SignPrivate = priv
+}
+
+func MakeUserRecord(username string, ipAddr string, keys *KeyPair) UserRecord {
+	/*
+		Creates a username record for ipAddr signed by the
+		owner's key. The sequence number is the current time,
+		so a later announcement always replaces an earlier one.
+	*/
+	record := UserRecord{Username: username, IpAddr: ipAddr, PublicKey: keys.Public, SigningKey: keys.SignPublic, Seq: time.Now().UnixNano()}
+	record.Signature = ed25519.Sign(keys.SignPrivate, record.signedBytes())
+	return record
+}
+
+// the bytes a record's signature covers: each field length
+// prefixed so that no two records encode the same way, then
+// the sequence number
+func signedFields(fields [][]byte, seq int64) []byte {
+	buf := make([]byte, 0, 256)
+	for _, field := range fields {
+		buf = binary.BigEndian.AppendUint32(buf, uint32(len(field)))
+		buf = append(buf, field...)
+	}
+	return binary.BigEndian.AppendUint64(buf, uint64(seq))
+}
+
+func (record *UserRecord) signedBytes() []byte {
+	return signedFields([][]byte{[]byte(record.Username), []byte(record.IpAddr), record.PublicKey, record.SigningKey}, record.Seq)
+}
+
+// returns true if record was signed by the key it carries
+func (record *UserRecord) Verify() bool {
+	if len(record.SigningKey) != ed25519.PublicKeySize {
+		return false
+	}
+	return ed25519.Verify(record.SigningKey, record.signedBytes(), record.Signature)
+}
+
+func sealingKey(shared, ephemeralPub, recipientPub []byte) []byte {
+	h := sha256.New()
+	h.Write(shared)
+	h.Write(ephemeralPub)
+	h.Write(recipientPub)
+	return h.Sum(nil)
+}
+
+func Seal(recipientPub []byte, plaintext []byte, additionalData []byte) ([]byte, error) {
+	/*
+		Encrypts plaintext so that only the holder of the
+		private key matching recipientPub can read it, and
+		only alongside additionalData, which travels in the
+		clear. A fresh ephemeral key is used for every
+		message, and the result is laid out as:
+			ephemeral public key | nonce | AES-GCM ciphertext
+	*/
+	curve := ecdh.X25519()
+	pub, err := curve.NewPublicKey(recipientPub)
+	if err != nil {
+		return nil, err
+	}
+	ephemeral, err := curve.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	shared, err := ephemeral.ECDH(pub)
+	if err != nil {
+		return nil, err
+	}
+	ephemeralPub := ephemeral.PublicKey().Bytes()
+	gcm, err := newGCM(sealingKey(shared, ephemeralPub, recipientPub))
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	sealed := append(ephemeralPub, nonce...)
+	return gcm.Seal(sealed, nonce, plaintext, additionalData), nil
+}
+
+func (keys *KeyPair) Open(sealed []byte, additionalData []byte) ([]byte, error) {
+	/*
+		Decrypts a message produced by Seal with our public
+		key and the same additionalData. Returns ErrDecrypt
+		if it was sealed for someone else, or either was
+		tampered with on the way.
+	*/
+	curve := ecdh.X25519()
+	priv, err := curve.NewPrivateKey(keys.Private)
+	if err != nil {
+		return nil, err
+	}
+	keyLen := len(keys.Public)
+	if len(sealed) < keyLen {
+		return nil, ErrDecrypt
+	}
+	ephemeralPub := sealed[:keyLen]
+	pub, err := curve.NewPublicKey(ephemeralPub)
+	if err != nil {
+		return nil, ErrDecrypt
+	}
+	shared, err := priv.ECDH(pub)
+	if err != nil {
+		return nil, ErrDecrypt
+	}
+	gcm, err := newGCM(sealingKey(shared, ephemeralPub, keys.Public))
+	if err != nil {
+		return nil, err
+	}
+	rest := sealed[keyLen:]
+	if len(rest) < gcm.NonceSize() {
+		return nil, ErrDecrypt
+	}
+	plaintext, err := gcm.Open(nil, rest[:gcm.NonceSize()], rest[gcm.NonceSize():], additionalData)
+	if err != nil {
+		return nil, ErrDecrypt
+	}
+	return plaintext, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
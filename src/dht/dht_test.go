@@ -4,10 +4,20 @@ import "testing"
 import "runtime"
 import "fmt"
 import "time"
-import "math"
 import "strconv"
+import "encoding/gob"
 import "math/rand"
 import "os"
+import "errors"
+import "io/ioutil"
+import "bytes"
+import "path/filepath"
+import "sync"
+import "strings"
+import "encoding/json"
+import "crypto/ed25519"
+import "net"
+import "net/rpc"
 
 
 // Signal failures with the following:
@@ -22,7 +32,7 @@ func assertEqual(t *testing.T, out, ans interface{}) {
 	}
 }
 
-func checkLookup(t *testing.T, user1 User, user2 User) {
+func checkLookup(t *testing.T, user1 *User, user2 *User) {
 	resp := user1.Node.FindUser(user2.Name)
 	assertEqual(t, resp, user2.Node.IpAddr)
 } 
@@ -49,8 +59,42 @@ func sliceEqual(a, b [IDLen][]RoutingEntry) bool {
 	return true
 }
 
-func registerMany(num_users int) []User{
-	users := make([]User, num_users)
+// registers username, panicking if it fails
+func mustRegister(username string, ipAddr string, bootstrap string) *User {
+	user, err := RegisterAndLogin(username, ipAddr, bootstrap)
+	if err != nil {
+		panic(err)
+	}
+	return user
+}
+
+// logs username back in, panicking if it fails
+func mustLogin(username string, ipAddr string) *User {
+	user, err := Login(username, ipAddr)
+	if err != nil {
+		panic(err)
+	}
+	return user
+}
+
+// gives username a keypair and pins it on user, as if user had
+// looked up their record
+func introduce(user *User, username string) *KeyPair {
+	keys := GenerateKeyPair()
+	user.Node.mu.Lock()
+	user.Node.Owners[Sha1(username)] = keys.SignPublic
+	user.Node.mu.Unlock()
+	return keys
+}
+
+// signs msg with keys, as its sender would
+func signAs(keys *KeyPair, msg *SendMessageArgs) *SendMessageArgs {
+	msg.Signature = ed25519.Sign(keys.SignPrivate, msg.signedBytes())
+	return msg
+}
+
+func registerMany(num_users int) []*User{
+	users := make([]*User, num_users)
 
 	bootstrap := ""
 
@@ -58,23 +102,23 @@ func registerMany(num_users int) []User{
 		base := 8000
 		username := strconv.Itoa(i)
 		ipAddr := localIp + ":" + strconv.Itoa(i + base)
-		user := RegisterAndLogin(username, ipAddr, bootstrap)
+		user := mustRegister(username, ipAddr, bootstrap)
 		bootstrap = localIp + ":" + strconv.Itoa(i + base)
 		time.Sleep(time.Millisecond * 5)
-		users[i] = *user
+		users[i] = user
 	}
 
 	time.Sleep(time.Second)
 
 	for _, user := range(users) {
-		user.Node.AnnounceUser(user.Name, user.Node.IpAddr)
+		user.Node.AnnounceUser(user.Name, user.Node.IpAddr, user.Keys)
 	}
 	time.Sleep(time.Second)
 	return users
 
 }
 
-func killAll(users []User){
+func killAll(users []*User){
 	for _, user := range users {
 		user.Logoff()
 	}
@@ -82,24 +126,24 @@ func killAll(users []User){
 }
 
 
-func slowRegisterMany(n int, t int) []User{
-	users := make([]User, n)
+func slowRegisterMany(n int, t int) []*User{
+	users := make([]*User, n)
 
 	bootstrap := ""
 
 	for i :=0; i < n; i++{
 		username := strconv.Itoa(i)
 		ipAddr := localIp + ":" + strconv.Itoa(i + 8000)
-		user := RegisterAndLogin(username, ipAddr, bootstrap)
+		user := mustRegister(username, ipAddr, bootstrap)
 		bootstrap = localIp + ":" + strconv.Itoa(i + 8000)
 		time.Sleep(time.Millisecond * time.Duration(rand.Int() % (t*1000/n)))
-		users[i] = *user
+		users[i] = user
 	}
 
 	time.Sleep(time.Millisecond*200)
 
 	for _, user := range(users) {
-		user.Node.AnnounceUser(user.Name, user.Node.IpAddr)
+		user.Node.AnnounceUser(user.Name, user.Node.IpAddr, user.Keys)
 	}
 	time.Sleep(time.Millisecond*200)
 	return users
@@ -111,7 +155,7 @@ const logoffprob = 20
 const logonprob = 50
 const changeipprob = 30
 
-func randomOnAction(t *testing.T, idx int, on_users []User, off_users []DeadUser) ([]User, []DeadUser) {
+func randomOnAction(t *testing.T, idx int, on_users []*User, off_users []DeadUser) ([]*User, []DeadUser) {
 	val := rand.Int() % 100
 	user := on_users[idx]
 	if val < sendprob {
@@ -132,7 +176,7 @@ func randomOnAction(t *testing.T, idx int, on_users []User, off_users []DeadUser
 	return on_users, off_users
 }
 
-func randomOffAction(t *testing.T, idx int, on_users []User, off_users []DeadUser, ipCounter int) ([]User, []DeadUser, int) {
+func randomOffAction(t *testing.T, idx int, on_users []*User, off_users []DeadUser, ipCounter int) ([]*User, []DeadUser, int) {
 	val := rand.Int() % 100
 	if val < logonprob {
 		off_user := off_users[idx]
@@ -142,16 +186,36 @@ func randomOffAction(t *testing.T, idx int, on_users []User, off_users []DeadUse
 			int_ip := 8000 + ipCounter
 			ip = localIp + ":" + strconv.Itoa(int_ip)
 		}
-		newUser := Login(off_user.name,ip)
+		newUser := mustLogin(off_user.name,ip)
 		time.Sleep(time.Millisecond * 10)
-		newUser.Node.AnnounceUser(newUser.Name, ip)
+		newUser.Node.AnnounceUser(newUser.Name, ip, newUser.Keys)
 		time.Sleep(time.Millisecond * 10)
-		on_users = append(on_users, *newUser)
+		on_users = append(on_users, newUser)
 		off_users = append(off_users[:idx], off_users[idx+1:]...)
 	}
 	return on_users, off_users, ipCounter
 }
 
+// profiles are kept in memory, so tests don't touch the
+// user's data directory or see profiles left by earlier runs.
+// every node a test runs shares one host, so RPCs aren't limited
+// by source unless a test sets SourceLimit itself
+func TestMain(m *testing.M) {
+	DefaultStorage = NewMemStorage()
+	SourceLimit = RateLimit{}
+	os.Exit(m.Run())
+}
+
+// installs network as the DefaultTransport, returns a
+// func that puts the old one back
+func useMemNetwork(network *MemNetwork) func() {
+	old := DefaultTransport
+	DefaultTransport = network
+	return func() {
+		DefaultTransport = old
+	}
+}
+
 type DeadUser struct {
 	name string
 	ipAddr string
@@ -165,6 +229,7 @@ type DeadUser struct {
 func TestRealLife(t* testing.T) {
 	fmt.Println("Running TestRealLife")
 	defer fmt.Println("Passed!")
+	defer useMemNetwork(NewMemNetwork(1))()
 
 	rounds := 5
 	ipCounter := 30
@@ -197,14 +262,14 @@ func TestSerialization(t *testing.T) {
 	username2 := "Frans"
 	
 	// remove any serialized users
-	os.Remove(UsernameToPath(username1))
-	os.Remove(UsernameToPath(username2))
+	DefaultStorage.Remove(username1)
+	DefaultStorage.Remove(username2)
 
 	// user1 starts the Peerchat network, and
 	// user2 joins by bootstrapping
-	user1 := RegisterAndLogin(username1, localIp + port1, "")
+	user1 := mustRegister(username1, localIp + port1, "")
 	time.Sleep(time.Millisecond * 50)
-	user2 := RegisterAndLogin(username2, localIp + port2, localIp + port1)
+	user2 := mustRegister(username2, localIp + port2, localIp + port1)
 
 	time.Sleep(time.Millisecond * 50)
 
@@ -223,17 +288,21 @@ func TestSerialization(t *testing.T) {
 	user2.SendMessage(username1, msg2)
 	
 	time.Sleep(1 * time.Second)
+
+	// log off first, so nothing changes while we compare
+	user1.Logoff()
+	user2.Logoff()
 	
 	// remove any serialized users
-	os.Remove(UsernameToPath(username1))
-	os.Remove(UsernameToPath(username2))
+	DefaultStorage.Remove(username1)
+	DefaultStorage.Remove(username2)
 	
 	user1.Serialize()
 	user2.Serialize()
 	
-	success, one := Deserialize(user1.Name)
-	success2, two := Deserialize(user2.Name)
-	if success && success2 {
+	one, err := Deserialize(user1.Name)
+	two, err2 := Deserialize(user2.Name)
+	if err == nil && err2 == nil {
 		assertEqual(t, one.Name, user1.Name)
 		assertEqual(t, two.Name, user2.Name)
 		assertEqual(t, len(one.MessageHistory[user2.Name]), len(user1.MessageHistory[user2.Name]))
@@ -245,9 +314,6 @@ func TestSerialization(t *testing.T) {
 		assertEqual(t, sliceEqual(one.Node.RoutingTable, user1.Node.RoutingTable), true)
 		assertEqual(t, sliceEqual(two.Node.RoutingTable, user2.Node.RoutingTable), true)
 	}
-
-	user1.Logoff()
-	user2.Logoff()
 }
 
 /*
@@ -262,18 +328,69 @@ func TestCommonUnit(t *testing.T) {
 	if Sha1("fjkels") == Sha1("qwewqi") {
 		t.Fatalf("Sha1 collision")
 	}
-	//reference Sha1 computed at www.sha1-online.com and lowest 8 bytes converted to decimal
-	assertEqual(t, Sha1("Forrest"), ID(10556789446649181072))
-	assertEqual(t, Sha1("testing testing 123"), ID(16871972680281001427))
+	//reference Sha1 computed at www.sha1-online.com
+	assertEqual(t, Sha1("Forrest").String(), "cd63c45f5a071f8e1037361392814011c81df390")
+	assertEqual(t, Sha1("testing testing 123").String(), "89512ac8c5fa4e72773049beea2549c2dc3e8dd3")
+	assertEqual(t, Short(Sha1("Forrest")), "cd63")
+
+	//Xor and Less
+	a := ID{}
+	b := ID{}
+	b[IDLen/8 - 1] = 1
+	c := ID{}
+	for i := range c {
+		c[i] = 0xff
+	}
+	d := ID{}
+	d[IDLen/8 - 2] = 0x80 // 1 << 15
+	assertEqual(t, Xor(c, c), a)
+	assertEqual(t, Xor(a, b), b)
+	assertEqual(t, a.Less(b), true)
+	assertEqual(t, b.Less(a), false)
+	assertEqual(t, d.Less(c), true)
+	assertEqual(t, b.Less(b), false)
 
 	//find_n
-	a := ID(0)
-	b := ID(1)
-	c := ID(math.MaxUint64)
-	d := ID(1 << 15)
-	assertEqual(t, find_n(a, b), uint(63))
+	assertEqual(t, find_n(a, b), uint(IDLen - 1))
 	assertEqual(t, find_n(a, c), uint(0))
-	assertEqual(t, find_n(a, d), uint(48))
+	assertEqual(t, find_n(a, d), uint(IDLen - 16))
+	assertEqual(t, find_n(a, a), uint(IDLen - 1))
+}
+
+/*
+**  Make sure a user saved with the old 64 bit IDs is
+**  migrated to full width IDs by Deserialize
+*/
+func TestLegacyMigration(t *testing.T) {
+	fmt.Println("Running TestLegacyMigration")
+	defer fmt.Println("Passed!")
+
+	username := "Legacy"
+	myIp := localIp + ":7777"
+	peerIp := localIp + ":7778"
+	defer DefaultStorage.Remove(username)
+
+	old := legacyUser{Node: &legacyDhtNode{IpAddr: myIp, NodeId: 1234}, Name: username}
+	old.Node.RoutingTable[3] = []legacyRoutingEntry{legacyRoutingEntry{IpAddr: peerIp, NodeId: 5678}}
+	old.MessageHistory = map[string][]*SendMessageArgs{"Bob": []*SendMessageArgs{&SendMessageArgs{Content: "hi", ToUsername: username, FromUsername: "Bob", MessageIdentifier: 42}}}
+	old.ReceivedMessageIdentifiers = map[int64]bool{42: true}
+	old.Keys = GenerateKeyPair()
+
+	var buf bytes.Buffer
+	gob.NewEncoder(&buf).Encode(old)
+	DefaultStorage.Save(username, buf.Bytes())
+
+	user, err := Deserialize(username)
+	assertEqual(t, err, nil)
+	assertEqual(t, user.Name, username)
+	assertEqual(t, user.Node.NodeId, Sha1(myIp))
+	assertEqual(t, user.MessageHistory["Bob"][0].Content, "hi")
+	assertEqual(t, user.ReceivedMessageIdentifiers[42], true)
+	assertEqual(t, bytes.Equal(user.Keys.Private, old.Keys.Private), true)
+	assertEqual(t, bytes.Equal(user.Keys.SignPublic, old.Keys.SignPublic), true)
+	n := find_n(Sha1(peerIp), user.Node.NodeId)
+	assertEqual(t, len(user.Node.RoutingTable[n]), 1)
+	assertEqual(t, user.Node.RoutingTable[n][0].NodeId, Sha1(peerIp))
 }
 
 /*
@@ -328,14 +445,14 @@ func TestBasic(t *testing.T) {
 	username2 := "Frans"
 	
 	// remove any serialized users
-	os.Remove(UsernameToPath(username1))
-	os.Remove(UsernameToPath(username2))
+	DefaultStorage.Remove(username1)
+	DefaultStorage.Remove(username2)
 
 	// user1 starts the Peerchat network, and
 	// user2 joins by bootstrapping
-	user1 := RegisterAndLogin(username1, localIp + port1, "")
+	user1 := mustRegister(username1, localIp + port1, "")
 	time.Sleep(time.Millisecond * 50)
-	user2 := RegisterAndLogin(username2, localIp + port2, localIp + port1)
+	user2 := mustRegister(username2, localIp + port2, localIp + port1)
 
 	time.Sleep(time.Millisecond * 50)
 
@@ -359,8 +476,8 @@ func TestBasic(t *testing.T) {
 	assertEqual(t, user2.GetMessagesFrom(user1)[0].Content, msg1)
 	assertEqual(t, user1.GetMessagesFrom(user2)[1].Content, msg2)
 	
-	assertEqual(t, len(user2.MessageHistory[username1]), 2)
-	assertEqual(t, len(user1.MessageHistory[username2]), 2)
+	assertEqual(t, len(user2.AllMessagesFromUser(username1)), 2)
+	assertEqual(t, len(user1.AllMessagesFromUser(username2)), 2)
 	
 	// kill user nodes
 	user1.Logoff()
@@ -394,6 +511,7 @@ func TestManyMoreRegistrations(t *testing.T) {
 	//os.Create(filename)
 
 	fmt.Println("Running TestManyMoreRegistrations")
+	defer useMemNetwork(NewMemNetwork(1))()
 	users := registerMany(size)
 	defer killAll(users)
 	for i:=0; i<20; i++ {
@@ -404,14 +522,14 @@ func TestManyMoreRegistrations(t *testing.T) {
 	}
 	fmt.Println("Passed!")
 }
-func sendAndCheck(t *testing.T, sender User, receiver User) {
+func sendAndCheck(t *testing.T, sender *User, receiver *User) {
 	msg := "message " + strconv.Itoa(rand.Int() % 1000)
-	idx := len(receiver.MessageHistory[sender.Name])
+	idx := len(receiver.AllMessagesFromUser(sender.Name))
 	sender.SendMessage(receiver.Name, msg)
 	
 	for i:=0; i<100; i++{
-		if len(receiver.MessageHistory[sender.Name]) > idx {
-			assertEqual(t, receiver.MessageHistory[sender.Name][idx].Content, msg)
+		if messages := receiver.AllMessagesFromUser(sender.Name); len(messages) > idx {
+			assertEqual(t, messages[idx].Content, msg)
 			return
 		}
 		time.Sleep(time.Millisecond*50)
@@ -466,7 +584,7 @@ func TestSomeLogoffs(t* testing.T) {
 
 }
 
-func switchIp(users []User, startPort int) []User{
+func switchIp(users []*User, startPort int) []*User{
 	p := startPort
 	for i:=0;i<len(users);i++ {
 		user := users[i]
@@ -475,12 +593,12 @@ func switchIp(users []User, startPort int) []User{
 		time.Sleep(time.Second)
 		ipAddr := localIp + ":" + strconv.Itoa(p + 8000)
 		p++
-		newUser := Login(name, ipAddr)
-		users[i] = *newUser
+		newUser := mustLogin(name, ipAddr)
+		users[i] = newUser
 	}
 	time.Sleep(time.Second)
 	for _, user := range users {
-		user.Node.AnnounceUser(user.Name, user.Node.IpAddr)
+		user.Node.AnnounceUser(user.Name, user.Node.IpAddr, user.Keys)
 	}
 	return users
 }
@@ -498,17 +616,17 @@ func TestPersistance(t* testing.T) {
 	defer killAll(users)
 	users[1].Logoff()
 	time.Sleep(time.Millisecond * 50)
-	newUser := Login("1", localIp + ":8001")
+	newUser := mustLogin("1", localIp + ":8001")
 	time.Sleep(time.Millisecond * 50)
 	newUser.Logoff()
 	time.Sleep(time.Millisecond * 50)
-	newUser = Login("1", localIp + ":8001")
-	defer killAll([]User{*newUser})
+	newUser = mustLogin("1", localIp + ":8001")
+	defer killAll([]*User{newUser})
 	time.Sleep(time.Millisecond * 50)
-	checkLookup(t, *newUser, users[0])
-	checkLookup(t, *newUser, users[2])
-	sendAndCheck(t, *newUser, users[2])
-	sendAndCheck(t, users[2], *newUser)
+	checkLookup(t, newUser, users[0])
+	checkLookup(t, newUser, users[2])
+	sendAndCheck(t, newUser, users[2])
+	sendAndCheck(t, users[2], newUser)
 }
 
 /*
@@ -544,9 +662,9 @@ func TestOfflineChat(t* testing.T) {
 	users[0].Logoff()
 	users[1].SendMessage("0", "hello")
 	time.Sleep(time.Second)
-	newUser := Login("0", oldip)
+	newUser := mustLogin("0", oldip)
 	time.Sleep(time.Second)
-	assertEqual(t, newUser.MessageHistory["1"][0].Content, "hello")
+	assertEqual(t, newUser.AllMessagesFromUser("1")[0].Content, "hello")
 	newUser.Logoff()
 	time.Sleep(time.Second)
 }
@@ -570,18 +688,1714 @@ func TestDualOfflineChat(t* testing.T) {
 	time.Sleep(time.Millisecond*200)
 	user1.Logoff()
 	time.Sleep(time.Millisecond*200)
-	user0 = *Login("0", oldip)
+	user0 = mustLogin("0", oldip)
 	time.Sleep(time.Millisecond*200)
 	// assert that user0 can see message, even though 1 is offline!
-	assertEqual(t, user0.MessageHistory["1"][len(user0.MessageHistory["1"]) - 1].Content, "hello")
+	messages := user0.AllMessagesFromUser("1")
+	assertEqual(t, messages[len(messages) - 1].Content, "hello")
 	user0.SendMessage("1", "hi")
 	time.Sleep(time.Millisecond*200)
 	user0.Logoff()
 	time.Sleep(time.Millisecond*200)
 	ipAddr := localIp + ":" + strconv.Itoa(8100)
-	user1 = *Login("1", ipAddr)
+	user1 = mustLogin("1", ipAddr)
 	time.Sleep(time.Millisecond*500)
 	// assert that user1 can see message, even though 0 is offline! Note that user1 has changed ips
-	assertEqual(t, user1.MessageHistory["0"][len(user1.MessageHistory["0"]) - 1].Content, "hi")
+	messages = user1.AllMessagesFromUser("0")
+	assertEqual(t, messages[len(messages) - 1].Content, "hi")
 	user1.Logoff()
 } 
+
+/*
+**  RegisterAndLogin 10 users on a simulated network. Crash one and
+**  partition the rest, making sure users can only reach each other
+**  when the network allows it. Then add latency and packet loss and
+**  make sure messages still get through.
+*/
+func TestMemNetwork(t* testing.T) {
+	fmt.Println("Running TestMemNetwork")
+	defer fmt.Println("Passed!")
+
+	network := NewMemNetwork(1)
+	defer useMemNetwork(network)()
+
+	size := 10
+	users := registerMany(size)
+	defer killAll(users)
+
+	// a crashed node is offline until it restarts
+	network.Crash(users[0].Node.IpAddr)
+	assertEqual(t, users[1].CheckStatus(users[0].Node.IpAddr), Offline)
+	network.Restart(users[0].Node.IpAddr)
+	assertEqual(t, users[1].CheckStatus(users[0].Node.IpAddr), Online)
+
+	// nodes on opposite sides of a partition can't reach each other
+	left := []string{}
+	for _, user := range users[:size/2] {
+		left = append(left, user.Node.IpAddr)
+	}
+	network.Partition(left)
+	assertEqual(t, users[1].CheckStatus(users[2].Node.IpAddr), Online)
+	assertEqual(t, users[1].CheckStatus(users[size-1].Node.IpAddr), Offline)
+	assertEqual(t, users[size-1].CheckStatus(users[size-2].Node.IpAddr), Online)
+	network.Heal()
+	assertEqual(t, users[1].CheckStatus(users[size-1].Node.IpAddr), Online)
+
+	// messages still arrive over a slow, lossy network
+	network.SetConditions(time.Millisecond, 5 * time.Millisecond, 0.2)
+	for i := 0; i < size/2; i++ {
+		sendAndCheck(t, users[i], users[size-1-i])
+	}
+}
+
+/*
+**  Unit tests for the sealing helpers in crypto.go
+*/
+func TestCryptoUnit(t *testing.T) {
+	alice := GenerateKeyPair()
+	eve := GenerateKeyPair()
+
+	sealed, err := Seal(alice.Public, []byte("meet at noon"), []byte("from bob"))
+	assertEqual(t, err, nil)
+	plaintext, err := alice.Open(sealed, []byte("from bob"))
+	assertEqual(t, err, nil)
+	assertEqual(t, string(plaintext), "meet at noon")
+
+	// only alice can open it, only with the same headers, and
+	// tampering is caught
+	_, err = eve.Open(sealed, []byte("from bob"))
+	assertEqual(t, err, ErrDecrypt)
+	_, err = alice.Open(sealed, []byte("from eve"))
+	assertEqual(t, err, ErrDecrypt)
+	sealed[len(sealed) - 1] ^= 1
+	_, err = alice.Open(sealed, []byte("from bob"))
+	assertEqual(t, err, ErrDecrypt)
+	_, err = alice.Open([]byte("short"), nil)
+	assertEqual(t, err, ErrDecrypt)
+}
+
+/*
+**  RegisterAndLogin 10 users. Have one go offline and get sent a
+**  message, making sure the relays holding it only see ciphertext
+**  and that the recipient can read it when they come back. Then
+**  make sure a message that can't be decrypted gets flagged.
+*/
+func TestEncryptedOfflineChat(t* testing.T) {
+	fmt.Println("Running TestEncryptedOfflineChat")
+	defer fmt.Println("Passed!")
+	defer useMemNetwork(NewMemNetwork(1))()
+
+	size := 10
+	users := registerMany(size)
+	defer killAll(users)
+	oldip := users[0].Node.IpAddr
+	users[0].Logoff()
+	users[1].SendMessage("0", "hello")
+	time.Sleep(time.Second)
+
+	relayed := 0
+	for _, relay := range users[2:] {
+		for _, msg := range relay.pendingCopies("0") {
+			relayed++
+			assertEqual(t, msg.Content, "")
+			_, err := relay.Keys.Open(msg.Sealed, msg.headerBytes())
+			assertEqual(t, err, ErrDecrypt)
+		}
+	}
+	if relayed == 0 {
+		t.Fatalf("message was not relayed")
+	}
+
+	newUser := mustLogin("0", oldip)
+	defer newUser.Logoff()
+	time.Sleep(time.Second)
+	assertEqual(t, newUser.AllMessagesFromUser("1")[0].Content, "hello")
+	assertEqual(t, newUser.AllMessagesFromUser("1")[0].DecryptFailed, false)
+
+	// sealed for someone else, so we can't open it
+	args := &SendMessageArgs{ToUsername: "0", FromUsername: "2", MessageIdentifier: nrand()}
+	args.Sealed, _ = Seal(users[1].Keys.Public, []byte("not for you"), args.headerBytes())
+	args.Signature = ed25519.Sign(users[2].Keys.SignPrivate, args.signedBytes())
+	assertEqual(t, newUser.SendMessageHandler(args, &SendMessageReply{}), nil)
+	msgs := newUser.AllMessagesFromUser("2")
+	assertEqual(t, msgs[len(msgs) - 1].DecryptFailed, true)
+	assertEqual(t, msgs[len(msgs) - 1].Content, "")
+
+	// a relay can't change who a message is from, or what
+	// kind it is, without the recipient noticing
+	wire, _ := users[3].sealMessage(SendMessageArgs{Content: "from 3", ToUsername: "0", FromUsername: "3", MessageIdentifier: nrand(), Kind: TextKind}, newUser.Keys.Public)
+	forged := wire
+	forged.FromUsername = "2"
+	assertEqual(t, errors.Is(newUser.SendMessageHandler(&forged, &SendMessageReply{}), ErrBadMessage), true)
+	forged = wire
+	forged.Kind = DeleteKind
+	assertEqual(t, errors.Is(newUser.SendMessageHandler(&forged, &SendMessageReply{}), ErrBadMessage), true)
+	forged = wire
+	forged.Signature = nil
+	assertEqual(t, errors.Is(newUser.SendMessageHandler(&forged, &SendMessageReply{}), ErrBadMessage), true)
+	assertEqual(t, len(newUser.AllMessagesFromUser("3")), 0)
+
+	// the handler opens what it is given in place, so keep
+	// wire sealed for the forgery below
+	delivered := wire
+	assertEqual(t, newUser.SendMessageHandler(&delivered, &SendMessageReply{}), nil)
+	assertEqual(t, newUser.AllMessagesFromUser("3")[0].Content, "from 3")
+
+	// nor can another user pass 3's content off as theirs,
+	// since the headers are sealed in with it
+	forged = wire
+	forged.FromUsername, forged.MessageIdentifier = "2", nrand()
+	forged.Signature = ed25519.Sign(users[2].Keys.SignPrivate, forged.signedBytes())
+	assertEqual(t, newUser.SendMessageHandler(&forged, &SendMessageReply{}), nil)
+	msgs = newUser.AllMessagesFromUser("2")
+	assertEqual(t, msgs[len(msgs) - 1].DecryptFailed, true)
+}
+
+/*
+**  Unit tests for signed username records
+*/
+func TestUserRecordUnit(t *testing.T) {
+	owner := GenerateKeyPair()
+	impostor := GenerateKeyPair()
+	node := MakeNode("Alice", localIp + ":7000")
+	id := Sha1("Alice")
+
+	record := MakeUserRecord("Alice", localIp + ":7001", owner)
+	assertEqual(t, record.Verify(), true)
+	assertEqual(t, node.checkRecord(id, &record), nil)
+	assertEqual(t, node.checkRecord(Sha1("Bob"), &record), ErrBadSignature)
+
+	// tampering with a signed field breaks the signature
+	tampered := record
+	tampered.IpAddr = localIp + ":6666"
+	assertEqual(t, tampered.Verify(), false)
+	assertEqual(t, node.checkRecord(id, &tampered), ErrBadSignature)
+
+	// first record binds the username, newer ones replace it
+	reply := &StoreUserReply{}
+	assertEqual(t, node.StoreUserHandler(&StoreUserArgs{Record: record}, reply), nil)
+	newer := MakeUserRecord("Alice", localIp + ":7002", owner)
+	assertEqual(t, node.StoreUserHandler(&StoreUserArgs{Record: newer}, reply), nil)
+	assertEqual(t, node.Records[id].IpAddr, localIp + ":7002")
+	assertEqual(t, node.StoreUserHandler(&StoreUserArgs{Record: record}, reply), ErrStaleRecord)
+
+	// someone else can't take the username over
+	hijack := MakeUserRecord("Alice", localIp + ":6666", impostor)
+	assertEqual(t, node.StoreUserHandler(&StoreUserArgs{Record: hijack}, reply), ErrUsernameTaken)
+	assertEqual(t, node.Records[id].IpAddr, localIp + ":7002")
+}
+
+/*
+**  RegisterAndLogin 10 users. Have an impostor announce one of their
+**  usernames with a different key and make sure everyone still finds
+**  the real user, that the impostor is told its record was refused,
+**  and that registering a taken username fails.
+*/
+func TestImpersonation(t* testing.T) {
+	fmt.Println("Running TestImpersonation")
+	defer fmt.Println("Passed!")
+	defer useMemNetwork(NewMemNetwork(1))()
+
+	size := 10
+	users := registerMany(size)
+	defer killAll(users)
+
+	impostorIp := localIp + ":9999"
+	impostor := MakeUser("impostor", impostorIp)
+	assertEqual(t, impostor.setupUser(), nil)
+	defer impostor.Logoff()
+	impostor.CheckStatus(users[0].Node.IpAddr)
+	assertEqual(t, impostor.Node.AnnounceUser("1", impostorIp, impostor.Keys), ErrUsernameTaken)
+	time.Sleep(time.Millisecond * 100)
+
+	for _, user := range users {
+		checkLookup(t, user, users[1])
+	}
+	if _, err := RegisterAndLogin("1", localIp + ":9998", users[0].Node.IpAddr); err != ErrUsernameTaken {
+		t.Fatalf("registering a username that was already taken returned %v", err)
+	}
+}
+
+// waits up to 5 seconds for the message to peer with
+// messageIdentifier to reach status
+func waitForStatus(t *testing.T, user *User, peer string, messageIdentifier int64, status string) {
+	for i := 0; i < 100; i++ {
+		if user.MessageStatus(peer, messageIdentifier) == status {
+			return
+		}
+		time.Sleep(time.Millisecond * 50)
+	}
+	t.Fatalf("wanted status %v, got %v", status, user.MessageStatus(peer, messageIdentifier))
+}
+
+/*
+**  RegisterAndLogin 10 users. Make sure a message sent directly is
+**  marked delivered and then read, and that one sent while the
+**  recipient is offline is marked relayed, then delivered once they
+**  log back in and ack it.
+*/
+func TestDeliveryStatus(t* testing.T) {
+	fmt.Println("Running TestDeliveryStatus")
+	defer fmt.Println("Passed!")
+	defer useMemNetwork(NewMemNetwork(1))()
+
+	size := 10
+	users := registerMany(size)
+	defer killAll(users)
+	sender := users[1]
+
+	sender.SendMessage("0", "are you there?")
+	direct := sender.AllMessagesFromUser("0")[0]
+	waitForStatus(t, sender, "0", direct.MessageIdentifier, Delivered)
+	users[0].MarkRead("1")
+	waitForStatus(t, sender, "0", direct.MessageIdentifier, Read)
+
+	oldip := users[0].Node.IpAddr
+	users[0].Logoff()
+	sender.SendMessage("0", "guess not")
+	relayed := sender.AllMessagesFromUser("0")[1]
+	waitForStatus(t, sender, "0", relayed.MessageIdentifier, Relayed)
+
+	newUser := mustLogin("0", oldip)
+	defer newUser.Logoff()
+	waitForStatus(t, sender, "0", relayed.MessageIdentifier, Delivered)
+	assertEqual(t, len(newUser.AllMessagesFromUser("1")), 2)
+}
+
+// waits up to 5 seconds for user to have count messages in room
+func waitForRoomMessages(t *testing.T, user *User, room string, count int) {
+	for i := 0; i < 100; i++ {
+		if len(user.RoomMessages(room)) >= count {
+			return
+		}
+		time.Sleep(time.Millisecond * 50)
+	}
+	t.Fatalf("%s wanted %v messages in %s, got %v", user.Name, count, room, len(user.RoomMessages(room)))
+}
+
+/*
+**  RegisterAndLogin 10 users. One creates a room and invites two
+**  others, and messages to the room reach both. Then one member goes
+**  offline and comes back on a new IP, and should still get the
+**  messages sent while they were away. Invites from anyone but the
+**  owner and messages from non-members are ignored, and a member
+**  who is removed drops the room.
+*/
+func TestRooms(t* testing.T) {
+	fmt.Println("Running TestRooms")
+	defer fmt.Println("Passed!")
+	defer useMemNetwork(NewMemNetwork(1))()
+
+	size := 10
+	users := registerMany(size)
+	defer killAll(users)
+	owner := users[1]
+
+	assertEqual(t, owner.CreateRoom("team"), nil)
+	assertEqual(t, users[4].CreateRoom("team"), ErrRoomTaken)
+	assertEqual(t, owner.InviteToRoom("team", "2"), nil)
+	assertEqual(t, owner.InviteToRoom("team", "3"), nil)
+	assertEqual(t, owner.InviteToRoom("lobby", "3"), ErrNoSuchRoom)
+	// 2's invite may be looked up before 3 was added
+	for i := 0; i < 100; i++ {
+		if team, _ := users[2].Room("team"); team.IsMember("3") {
+			break
+		}
+		time.Sleep(time.Millisecond * 50)
+		users[2].RefreshRoom("team")
+	}
+	team, _ := users[2].Room("team")
+	assertEqual(t, team.IsMember("3"), true)
+	assertEqual(t, users[2].InviteToRoom("team", "5"), ErrNotRoomOwner)
+
+	assertEqual(t, owner.SendRoomMessage("team", "standup in 5"), nil)
+	waitForRoomMessages(t, users[2], "team", 1)
+	waitForRoomMessages(t, users[3], "team", 1)
+	assertEqual(t, users[3].RoomMessages("team")[0].Content, "standup in 5")
+	assertEqual(t, len(users[4].RoomMessages("team")), 0)
+
+	users[3].Logoff()
+	users[2].SendRoomMessage("team", "where is 3?")
+	time.Sleep(time.Millisecond * 500)
+	rejoined := mustLogin("3", localIp + ":" + strconv.Itoa(8000 + size + 1))
+	defer rejoined.Logoff()
+	waitForRoomMessages(t, rejoined, "team", 2)
+	waitForRoomMessages(t, owner, "team", 2)
+	assertEqual(t, rejoined.RoomMessages("team")[1].Content, "where is 3?")
+
+	// only the owner's invites count, and only members are heard
+	invite := SendMessageArgs{ToUsername: "5", FromUsername: "2", MessageIdentifier: nrand(), Kind: InviteKind, Room: "team"}
+	assertEqual(t, users[5].SendMessageHandler(signAs(users[2].Keys, &invite), &SendMessageReply{}), nil)
+	assertEqual(t, users[4].CreateRoom("lobby"), nil)
+	for _, room := range []string{"team", "lobby"} {
+		intrusion := SendMessageArgs{Content: "let me in", ToUsername: "2", FromUsername: "4", MessageIdentifier: nrand(), Room: room}
+		assertEqual(t, users[2].SendMessageHandler(signAs(users[4].Keys, &intrusion), &SendMessageReply{}), nil)
+	}
+	time.Sleep(time.Millisecond * 500)
+	_, joined := users[5].Room("team")
+	assertEqual(t, joined, false)
+	_, joined = users[2].Room("lobby")
+	assertEqual(t, joined, false)
+	assertEqual(t, len(users[2].RoomMessages("team")), 2)
+	assertEqual(t, len(users[2].RoomMessages("lobby")), 0)
+
+	// a member who was removed drops the room
+	owner.Node.AnnounceRoom(MakeRoomRecord("team", "1", []string{"1", "3"}, owner.Keys))
+	users[2].RefreshRoom("team")
+	_, joined = users[2].Room("team")
+	assertEqual(t, joined, false)
+}
+
+func TestRecordExpiry(t* testing.T) {
+	fmt.Println("Running TestRecordExpiry")
+	defer fmt.Println("Passed!")
+	defer useMemNetwork(NewMemNetwork(1))()
+
+	ttl, republish, replicate := RecordTTL, RepublishEvery, ReplicateEvery
+	RecordTTL, RepublishEvery, ReplicateEvery = time.Second * 2, time.Millisecond * 300, time.Millisecond * 500
+	defer func() { RecordTTL, RepublishEvery, ReplicateEvery = ttl, republish, replicate }()
+
+	size := 10
+	users := registerMany(size)
+	defer killAll(users)
+
+	// online users keep republishing, so they outlive the TTL
+	time.Sleep(RecordTTL * 2)
+	assertEqual(t, users[5].Node.FindUser("3"), users[3].Node.IpAddr)
+
+	users[3].Logoff()
+	time.Sleep(RecordTTL + ReplicateEvery * 2)
+	for i, user := range users {
+		if i == 3 {
+			continue
+		}
+		user.Node.mu.Lock()
+		_, exists := user.Node.heldRecord(Sha1("3"))
+		user.Node.mu.Unlock()
+		if exists {
+			t.Fatalf("user %d still serves the record of a user offline past the TTL", i)
+		}
+	}
+	assertEqual(t, users[5].Node.FindUser("3"), "")
+	assertEqual(t, users[5].Node.FindUser("4"), users[4].Node.IpAddr)
+
+	// the username still belongs to 3's key
+	if _, err := RegisterAndLogin("3", localIp + ":9997", users[0].Node.IpAddr); err != ErrUsernameTaken {
+		t.Fatalf("registering the username of a user whose record expired returned %v", err)
+	}
+}
+
+/*
+**  Fill one bucket of a lone node past K, then run maintenance
+**  until the LRS entry, which can't be pinged, is evicted and
+**  replaced by the newest node from the replacement cache, and
+**  that a bucket never grows past K doing so.
+*/
+func TestRoutingMaintenance(t *testing.T) {
+	fmt.Println("Running TestRoutingMaintenance")
+	defer fmt.Println("Passed!")
+
+	node := MakeNode("lonely", "mem:1")
+	node.SetTransport(NewMemNetwork(1))
+	for _, n := range []uint{0, 1, 7, 8, 100, IDLen - 1} {
+		assertEqual(t, find_n(randomIdInBucket(node.NodeId, n), node.NodeId), n)
+	}
+
+	entries := make([]RoutingEntry, K + 2)
+	for i, _ := range entries {
+		entries[i] = RoutingEntry{IpAddr: "mem:" + strconv.Itoa(i + 2), NodeId: randomIdInBucket(node.NodeId, 0)}
+		node.updateRoutingTable(entries[i])
+	}
+	assertEqual(t, len(node.RoutingTable[0]), K)
+	assertEqual(t, len(node.Replacements[0]), 2)
+	assertEqual(t, node.RoutingTable[0][0], entries[0])
+
+	for i := 0; i < MaxPingFailures - 1; i++ {
+		node.Maintain()
+	}
+	assertEqual(t, node.RoutingTable[0][0], entries[0])
+	node.Maintain()
+	assertEqual(t, len(node.RoutingTable[0]), K)
+	assertEqual(t, node.RoutingTable[0][0], entries[1])
+	assertEqual(t, node.RoutingTable[0][K - 1], entries[K + 1])
+	assertEqual(t, len(node.Replacements[0]), 1)
+
+	// evicting an entry that is already gone doesn't overfill
+	// the bucket
+	node.mu.Lock()
+	node.evict(0, entries[0])
+	node.mu.Unlock()
+	assertEqual(t, len(node.RoutingTable[0]), K)
+	assertEqual(t, len(node.Replacements[0]), 1)
+}
+
+/*
+**  Make sure Login and RegisterAndLogin report why they failed:
+**  a taken address, an offline bootstrap, a missing profile and
+**  a corrupt one. Failed attempts shouldn't hold on to the address.
+*/
+func TestLoginErrors(t *testing.T) {
+	fmt.Println("Running TestLoginErrors")
+	defer fmt.Println("Passed!")
+	defer useMemNetwork(NewMemNetwork(1))()
+
+	for _, username := range []string{"Errors1", "Errors2", "Nobody", "Corrupt"} {
+		DefaultStorage.Remove(username)
+		defer DefaultStorage.Remove(username)
+	}
+
+	first, err := RegisterAndLogin("Errors1", "mem:1", "")
+	assertEqual(t, err, nil)
+	defer first.Logoff()
+
+	_, err = RegisterAndLogin("Errors2", "mem:1", "")
+	assertEqual(t, errors.Is(err, ErrAddressInUse), true)
+	_, err = RegisterAndLogin("Errors2", "mem:2", "mem:3")
+	assertEqual(t, errors.Is(err, ErrBootstrapUnreachable), true)
+	second, err := RegisterAndLogin("Errors2", "mem:2", "mem:1")
+	assertEqual(t, err, nil)
+	defer second.Logoff()
+
+	_, err = Login("Nobody", "mem:4")
+	assertEqual(t, err, ErrNoProfile)
+	DefaultStorage.Save("Corrupt", []byte("not a profile"))
+	_, err = Login("Corrupt", "mem:4")
+	assertEqual(t, errors.Is(err, ErrCorruptProfile), true)
+}
+
+/*
+**  Make sure FileStorage keeps every username in its own file
+**  inside Dir, that saving replaces a profile without leaving
+**  temporary files behind, and that a profile loaded from it
+**  is saved back to it.
+*/
+func TestFileStorage(t *testing.T) {
+	fmt.Println("Running TestFileStorage")
+	defer fmt.Println("Passed!")
+
+	dir, err := ioutil.TempDir("", "peerchat")
+	if err != nil {
+		t.Fatalf("could not create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	storage := NewFileStorage(filepath.Join(dir, "profiles"))
+
+	_, err = storage.Load("Alice")
+	assertEqual(t, err, ErrNoProfile)
+	assertEqual(t, storage.Exists("Alice"), false)
+
+	usernames := []string{"Alice", "../Alice", "a/b", "a%2Fb", "Al ice", ".gob"}
+	for i, username := range usernames {
+		assertEqual(t, storage.Save(username, []byte("first")), nil)
+		assertEqual(t, storage.Save(username, []byte(strconv.Itoa(i))), nil)
+		assertEqual(t, filepath.Dir(storage.Path(username)), storage.Dir)
+	}
+	for i, username := range usernames {
+		data, err := storage.Load(username)
+		assertEqual(t, err, nil)
+		assertEqual(t, string(data), strconv.Itoa(i))
+	}
+	files, _ := ioutil.ReadDir(storage.Dir)
+	assertEqual(t, len(files), len(usernames))
+
+	assertEqual(t, storage.Remove("Alice"), nil)
+	assertEqual(t, storage.Exists("Alice"), false)
+	assertEqual(t, storage.Exists("../Alice"), true)
+	assertEqual(t, storage.Remove("Alice"), nil)
+
+	journal, err := storage.LoadJournal("Bob")
+	assertEqual(t, err, nil)
+	assertEqual(t, len(journal), 0)
+	storage.Append("Bob", []byte("one"))
+	storage.Append("Bob", []byte("two"))
+	journal, _ = storage.LoadJournal("Bob")
+	assertEqual(t, string(journal), "onetwo")
+	assertEqual(t, storage.ResetJournal("Bob"), nil)
+	journal, _ = storage.LoadJournal("Bob")
+	assertEqual(t, len(journal), 0)
+
+	// profiles load from the storage they were saved in, and
+	// keep saving there
+	user := MakeUser("Heidi", localIp + ":7200")
+	user.SetStorage(storage)
+	assertEqual(t, user.Serialize(), nil)
+	assertEqual(t, DefaultStorage.Exists("Heidi"), false)
+	restored, err := LoadProfileFrom(storage, "Heidi", "")
+	assertEqual(t, err, nil)
+	assertEqual(t, restored.GetStorage(), Storage(storage))
+	_, err = LoadProfile("Heidi", "")
+	assertEqual(t, errors.Is(err, ErrNoProfile), true)
+}
+
+// counts the snapshots saved for each user
+type countingStorage struct {
+	Storage
+	mu sync.Mutex
+	saves map[string]int
+}
+
+func (s *countingStorage) Save(username string, data []byte) error {
+	s.mu.Lock()
+	s.saves[username]++
+	s.mu.Unlock()
+	return s.Storage.Save(username, data)
+}
+
+func (s *countingStorage) savesOf(username string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.saves[username]
+}
+
+/*
+**  Make sure receiving messages appends to the journal instead
+**  of saving a snapshot each time, and that a user who crashes
+**  before taking a snapshot gets its messages back from the
+**  journal, even if the last entry was only half written.
+*/
+func TestJournal(t *testing.T) {
+	fmt.Println("Running TestJournal")
+	defer fmt.Println("Passed!")
+	defer useMemNetwork(NewMemNetwork(1))()
+	storage := &countingStorage{Storage: NewMemStorage(), saves: make(map[string]int)}
+	oldStorage := DefaultStorage
+	DefaultStorage = storage
+	defer func() { DefaultStorage = oldStorage }()
+
+	entries := []journalEntry{journalEntry{Seq: 1, Op: journalSeen, Ref: 7}, journalEntry{Seq: 2, Op: journalHistory, Key: "Bob", Message: &SendMessageArgs{Content: "hi"}}}
+	data, err := encodeJournal(entries, nil)
+	assertEqual(t, err, nil)
+	decoded, complete := decodeJournal(data, nil)
+	assertEqual(t, complete, true)
+	assertEqual(t, len(decoded), 2)
+	assertEqual(t, decoded[1].Message.Content, "hi")
+	decoded, complete = decodeJournal(data[:len(data) - 1], nil)
+	assertEqual(t, complete, false)
+	assertEqual(t, len(decoded), 1)
+	data[len(data) - 1] ^= 0xff
+	decoded, complete = decodeJournal(data, nil)
+	assertEqual(t, complete, false)
+	assertEqual(t, len(decoded), 1)
+
+	alice := mustRegister("JournalAlice", "mem:1", "")
+	defer alice.Logoff()
+	bob := mustRegister("JournalBob", "mem:2", "mem:1")
+	time.Sleep(100 * time.Millisecond)
+	saves := storage.savesOf(bob.Name)
+	n := 20
+	for i := 0; i < n; i++ {
+		sendAndCheck(t, alice, bob)
+	}
+	if storage.savesOf(bob.Name) - saves >= n {
+		t.Fatalf("%d messages took %d snapshots", n, storage.savesOf(bob.Name) - saves)
+	}
+
+	// crash without a snapshot, and leave a torn entry behind
+	bob.shutdown()
+	storage.Append(bob.Name, []byte{0, 0, 1, 0, 1, 2})
+	bob = mustLogin(bob.Name, "mem:3")
+	defer bob.Logoff()
+	assertEqual(t, len(bob.AllMessagesFromUser(alice.Name)), n)
+
+	// the torn entry is gone, so new messages survive a crash too
+	sendAndCheck(t, alice, bob)
+	bob.shutdown()
+	bob = mustLogin(bob.Name, "mem:4")
+	defer bob.Logoff()
+	assertEqual(t, len(bob.AllMessagesFromUser(alice.Name)), n + 1)
+}
+
+/*
+**  Make sure profiles saved at every version we know load, that
+**  Serialize writes the current version, and that profiles from
+**  a later version or that aren't profiles at all are refused.
+*/
+func TestProfileVersions(t *testing.T) {
+	fmt.Println("Running TestProfileVersions")
+	defer fmt.Println("Passed!")
+	defer DefaultStorage.Remove("Fixture")
+
+	fixtures := map[string]string{
+		"testdata/profile-v1.gob": "",
+		"testdata/profile-v2.gob": "",
+		"testdata/profile-v3.gob": "",
+		"testdata/profile-v3-encrypted.gob": "correct horse",
+		"testdata/profile-v4.gob": "",
+	}
+	for fixture, passphrase := range fixtures {
+		data, err := ioutil.ReadFile(fixture)
+		assertEqual(t, err, nil)
+		DefaultStorage.Save("Fixture", data)
+		user, err := deserialize(DefaultStorage, "Fixture", passphrase)
+		assertEqual(t, err, nil)
+		assertEqual(t, user.Name, "Fixture")
+		assertEqual(t, user.Node.IpAddr, "127.0.0.1:7100")
+		assertEqual(t, user.Node.NodeId, Sha1("127.0.0.1:7100"))
+		assertEqual(t, user.MessageHistory["Bob"][0].Content, "hello from the past")
+		assertEqual(t, user.ReceivedMessageIdentifiers[42], true)
+		assertEqual(t, user.Rooms["book-club"].IsMember("Fixture"), true)
+	}
+
+	user := MakeUser("Fixture", "127.0.0.1:7100")
+	assertEqual(t, user.Serialize(), nil)
+	saved, _ := DefaultStorage.Load("Fixture")
+	assertEqual(t, openProfile(saved).Version, ProfileVersion)
+
+	var newer bytes.Buffer
+	gob.NewEncoder(&newer).Encode(&profileEnvelope{Magic: profileMagic, Version: ProfileVersion + 1, Data: []byte("from the future")})
+	DefaultStorage.Save("Fixture", newer.Bytes())
+	_, err := Deserialize("Fixture")
+	assertEqual(t, errors.Is(err, ErrProfileTooNew), true)
+
+	DefaultStorage.Save("Fixture", []byte("not a profile"))
+	_, err = Deserialize("Fixture")
+	assertEqual(t, errors.Is(err, ErrCorruptProfile), true)
+}
+
+/*
+**  Make sure a profile registered with a passphrase, and the
+**  journal next to it, don't contain messages in the clear, that
+**  it only opens with the right passphrase, and that changing
+**  or removing the passphrase keeps the history.
+*/
+func TestPassphrase(t *testing.T) {
+	fmt.Println("Running TestPassphrase")
+	defer fmt.Println("Passed!")
+	defer useMemNetwork(NewMemNetwork(1))()
+	oldIterations := PassphraseIterations
+	PassphraseIterations = 1000
+	defer func() { PassphraseIterations = oldIterations }()
+	defer DefaultStorage.Remove("SecretAlice")
+	defer DefaultStorage.Remove("SecretBob")
+
+	alice := mustRegister("SecretAlice", "mem:1", "")
+	defer alice.Logoff()
+	bob, err := RegisterWithPassphrase("SecretBob", "mem:2", "mem:1", "hunter2")
+	assertEqual(t, err, nil)
+	sendAndCheck(t, alice, bob)
+	alice.SendMessage(bob.Name, "the secret plans")
+	for i := 0; i < 100 && len(bob.AllMessagesFromUser(alice.Name)) < 2; i++ {
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	// crash, so the plans are only in the journal
+	bob.shutdown()
+	snapshot, _ := DefaultStorage.Load(bob.Name)
+	journal, _ := DefaultStorage.LoadJournal(bob.Name)
+	assertEqual(t, len(journal) > 0, true)
+	assertEqual(t, bytes.Contains(snapshot, []byte("the secret plans")), false)
+	assertEqual(t, bytes.Contains(journal, []byte("the secret plans")), false)
+
+	_, err = LoginWithPassphrase(bob.Name, "mem:3", "")
+	assertEqual(t, err, ErrPassphraseRequired)
+	_, err = LoginWithPassphrase(bob.Name, "mem:3", "hunter3")
+	assertEqual(t, err, ErrWrongPassphrase)
+	bob, err = LoginWithPassphrase(bob.Name, "mem:3", "hunter2")
+	assertEqual(t, err, nil)
+	assertEqual(t, len(bob.AllMessagesFromUser(alice.Name)), 2)
+	assertEqual(t, bob.AllMessagesFromUser(alice.Name)[1].Content, "the secret plans")
+
+	assertEqual(t, bob.ChangePassphrase("hunter3", "swordfish"), ErrWrongPassphrase)
+	assertEqual(t, bob.ChangePassphrase("hunter2", "swordfish"), nil)
+	bob.shutdown()
+	_, err = LoginWithPassphrase(bob.Name, "mem:4", "hunter2")
+	assertEqual(t, err, ErrWrongPassphrase)
+	bob, err = LoginWithPassphrase(bob.Name, "mem:4", "swordfish")
+	assertEqual(t, err, nil)
+	assertEqual(t, len(bob.AllMessagesFromUser(alice.Name)), 2)
+
+	assertEqual(t, bob.ChangePassphrase("swordfish", ""), nil)
+	assertEqual(t, bob.Logoff(), nil)
+	bob = mustLogin(bob.Name, "mem:5")
+	defer bob.Logoff()
+	assertEqual(t, len(bob.AllMessagesFromUser(alice.Name)), 2)
+}
+
+/*
+**  Make sure conversations export in Timestamp order in every
+**  format, and that importing a JSON export merges it into a
+**  profile without duplicating messages it already has.
+*/
+func TestExportImport(t *testing.T) {
+	fmt.Println("Running TestExportImport")
+	defer fmt.Println("Passed!")
+	defer DefaultStorage.Remove("Exporter")
+
+	user := MakeUser("Exporter", "mem:1")
+	user.MessageHistory["Bob"] = []*SendMessageArgs{
+		&SendMessageArgs{Content: "second", Timestamp: 200, FromUsername: "Bob", ToUsername: "Exporter", MessageIdentifier: 2},
+		&SendMessageArgs{Content: "first", Timestamp: 100, FromUsername: "Exporter", ToUsername: "Bob", MessageIdentifier: 1, Status: Read},
+	}
+	user.MessageHistory["Carol"] = []*SendMessageArgs{
+		&SendMessageArgs{Content: "From the start\nof time", Timestamp: 300, FromUsername: "Carol", ToUsername: "Exporter", MessageIdentifier: 3},
+	}
+
+	var out bytes.Buffer
+	assertEqual(t, user.ExportConversations(&out, ExportJSON), nil)
+	var export Export
+	assertEqual(t, json.Unmarshal(out.Bytes(), &export), nil)
+	assertEqual(t, export.Username, "Exporter")
+	assertEqual(t, len(export.Conversations), 2)
+	assertEqual(t, export.Conversations["Bob"][0].MessageIdentifier, int64(1))
+	assertEqual(t, export.Conversations["Bob"][1].Content, "second")
+	assertEqual(t, export.Conversations["Bob"][0].Status, Read)
+	jsonExport := out.String()
+
+	out.Reset()
+	assertEqual(t, user.ExportConversations(&out, ExportText, "Bob"), nil)
+	assertEqual(t, strings.Contains(out.String(), "[1970-01-01T00:01:40Z] <1> Exporter: first\n[1970-01-01T00:03:20Z] <2> Bob: second"), true)
+	assertEqual(t, strings.Contains(out.String(), "Carol"), false)
+
+	out.Reset()
+	assertEqual(t, user.ExportConversations(&out, ExportMbox, "Carol"), nil)
+	assertEqual(t, strings.Contains(out.String(), "\nMessage-ID: <3@peerchat>\n"), true)
+	assertEqual(t, strings.Contains(out.String(), "\n>From the start\nof time\n"), true)
+	assertEqual(t, errors.Is(user.ExportConversations(&out, "pdf"), ErrUnknownFormat), true)
+
+	// a copy of the profile that only has the second message
+	other := MakeUser("Exporter", "mem:1")
+	other.MessageHistory["Bob"] = []*SendMessageArgs{&SendMessageArgs{Content: "second", Timestamp: 200, FromUsername: "Bob", ToUsername: "Exporter", MessageIdentifier: 2}}
+	added, err := other.ImportConversations(strings.NewReader(jsonExport))
+	assertEqual(t, err, nil)
+	assertEqual(t, added, 2)
+	added, err = other.ImportConversations(strings.NewReader(jsonExport))
+	assertEqual(t, err, nil)
+	assertEqual(t, added, 0)
+	bob := other.AllMessagesFromUser("Bob")
+	assertEqual(t, len(bob), 2)
+	assertEqual(t, bob[0].Content, "first")
+	assertEqual(t, other.ReceivedMessageIdentifiers[3], true)
+
+	saved, err := Deserialize("Exporter")
+	assertEqual(t, err, nil)
+	assertEqual(t, len(saved.MessageHistory["Carol"]), 1)
+
+	stranger := MakeUser("Stranger", "mem:2")
+	_, err = stranger.ImportConversations(strings.NewReader(jsonExport))
+	assertEqual(t, errors.Is(err, ErrWrongExportUser), true)
+}
+
+/*
+** Search
+*/
+func TestSearch(t *testing.T) {
+	fmt.Println("Running TestSearch")
+	defer fmt.Println("Passed!")
+	defer DefaultStorage.Remove("Searcher")
+
+	day := func(date string) int64 {
+		when, _ := time.ParseInLocation("2006-01-02", date, time.Local)
+		return when.Unix() + 3600
+	}
+	search := func(user *User, text string) string {
+		query, err := ParseSearchQuery(text)
+		assertEqual(t, err, nil)
+		contents := make([]string, 0)
+		for _, msg := range user.Search(query) {
+			contents = append(contents, msg.Content)
+		}
+		return strings.Join(contents, " | ")
+	}
+
+	user := MakeUser("Searcher", "mem:1")
+	user.MessageHistory["Alice"] = []*SendMessageArgs{
+		&SendMessageArgs{Content: "Deploy the release notes today", Timestamp: day("2024-03-02"), FromUsername: "Alice", ToUsername: "Searcher", MessageIdentifier: 1},
+		&SendMessageArgs{Content: "notes on the release, then deploy", Timestamp: day("2024-03-01"), FromUsername: "Searcher", ToUsername: "Alice", MessageIdentifier: 2},
+	}
+	user.MessageHistory["Bob"] = []*SendMessageArgs{
+		&SendMessageArgs{Content: "Did the deploy work?", Timestamp: day("2024-04-01"), FromUsername: "Bob", ToUsername: "Searcher", MessageIdentifier: 3},
+	}
+	user.rebuildIndex()
+
+	assertEqual(t, search(user, "DEPLOY"), "notes on the release, then deploy | Deploy the release notes today | Did the deploy work?")
+	assertEqual(t, search(user, "release deploy"), "notes on the release, then deploy | Deploy the release notes today")
+	assertEqual(t, search(user, `"release notes"`), "Deploy the release notes today")
+	assertEqual(t, search(user, "deploy from:Searcher"), "notes on the release, then deploy")
+	assertEqual(t, search(user, "with:Bob"), "Did the deploy work?")
+	assertEqual(t, search(user, "deploy after:2024-03-02 before:2024-04-01"), "Deploy the release notes today")
+	assertEqual(t, search(user, "nothing"), "")
+
+	_, err := ParseSearchQuery(`"release notes`)
+	assertEqual(t, errors.Is(err, ErrBadQuery), true)
+	_, err = ParseSearchQuery("after:yesterday")
+	assertEqual(t, errors.Is(err, ErrBadQuery), true)
+
+	// messages we send are indexed as they are added, and the
+	// index is saved with the profile
+	user.SendMessage("Carol", "lunch tomorrow?")
+	assertEqual(t, search(user, "lunch"), "lunch tomorrow?")
+	assertEqual(t, user.Serialize(), nil)
+	saved, err := Deserialize("Searcher")
+	assertEqual(t, err, nil)
+	assertEqual(t, saved.Index.Peers[3], "Bob")
+	assertEqual(t, search(saved, "lunch with:Carol"), "lunch tomorrow?")
+}
+
+// waits up to 5 seconds for user to have count messages with peer
+func waitForMessages(t *testing.T, user *User, peer string, count int) {
+	for i := 0; i < 100; i++ {
+		if len(user.AllMessagesFromUser(peer)) >= count {
+			return
+		}
+		time.Sleep(time.Millisecond * 50)
+	}
+	t.Fatalf("%s wanted %v messages from %s, got %v", user.Name, count, peer, len(user.AllMessagesFromUser(peer)))
+}
+
+// the contents of messages, in order
+func contents(messages []*SendMessageArgs) string {
+	texts := make([]string, 0, len(messages))
+	for _, msg := range messages {
+		texts = append(texts, msg.Content)
+	}
+	return strings.Join(texts, " | ")
+}
+
+/*
+**  Two users whose clocks are an hour apart talk. Replies sort after
+**  what they answer no matter whose clock is behind, messages sent
+**  in the same second keep the order they were sent in, and both
+**  users see the conversation in the same order.
+*/
+func TestClocks(t *testing.T) {
+	fmt.Println("Running TestClocks")
+	defer fmt.Println("Passed!")
+	defer useMemNetwork(NewMemNetwork(1))()
+
+	users := registerMany(3)
+	defer killAll(users)
+	ahead, behind := users[1], users[2]
+	ahead.wallTime = func() time.Time { return time.Now().Add(time.Hour) }
+	behind.wallTime = func() time.Time { return time.Now().Add(-time.Hour) }
+
+	ahead.SendMessage("2", "are you there?")
+	waitForMessages(t, behind, "1", 1)
+	behind.SendMessage("1", "yes")
+	behind.SendMessage("1", "what's up")
+	behind.SendMessage("1", "hello?")
+	waitForMessages(t, ahead, "2", 4)
+	ahead.SendMessage("2", "sorry, was away")
+	waitForMessages(t, behind, "1", 5)
+
+	want := "are you there? | yes | what's up | hello? | sorry, was away"
+	assertEqual(t, contents(ahead.AllMessagesFromUser("2")), want)
+	assertEqual(t, contents(behind.AllMessagesFromUser("1")), want)
+	// by Timestamp the replies would come an hour before the question
+	reply := behind.AllMessagesFromUser("1")[1]
+	assertEqual(t, reply.Timestamp < behind.AllMessagesFromUser("1")[0].Timestamp, true)
+
+	// only what came after the last message we were shown is new
+	areNew, _ := behind.AreNewMessagesFrom("1")
+	assertEqual(t, areNew, true)
+	areNew, _ = behind.AreNewMessagesFrom("1")
+	assertEqual(t, areNew, false)
+	ahead.SendMessage("2", "one more thing")
+	waitForMessages(t, behind, "1", 6)
+	areNew, newMessages := behind.AreNewMessagesFrom("1")
+	assertEqual(t, areNew, true)
+	assertEqual(t, len(newMessages), 1)
+	assertEqual(t, newMessages[0].Content, "one more thing")
+
+	// messages at the same clock value are ordered the same way
+	// everywhere
+	tied := []*SendMessageArgs{
+		&SendMessageArgs{Content: "c", Clock: 5, FromUsername: "b", MessageIdentifier: 1},
+		&SendMessageArgs{Content: "b", Clock: 5, FromUsername: "a", MessageIdentifier: 2},
+		&SendMessageArgs{Content: "a", Clock: 5, FromUsername: "a", MessageIdentifier: 1},
+		&SendMessageArgs{Content: "first", Clock: 4, FromUsername: "z", MessageIdentifier: 9},
+	}
+	sortMessages(tied)
+	assertEqual(t, contents(tied), "first | a | b | c")
+
+	// clocks survive a restart, and profiles from before clocks
+	// get their last seen Timestamps converted
+	assertEqual(t, behind.Serialize(), nil)
+	saved, err := Deserialize("2")
+	assertEqual(t, err, nil)
+	assertEqual(t, contents(saved.AllMessagesFromUser("1")), want + " | one more thing")
+
+	old := MakeUser("Clockless", "mem:9")
+	defer DefaultStorage.Remove("Clockless")
+	old.LastSeenMap["Bob"] = 100
+	data, _ := encodeUser(old)
+	var envelope bytes.Buffer
+	gob.NewEncoder(&envelope).Encode(&profileEnvelope{Magic: profileMagic, Version: encryptedVersion, Data: data})
+	DefaultStorage.Save("Clockless", envelope.Bytes())
+	migrated, err := Deserialize("Clockless")
+	assertEqual(t, err, nil)
+	assertEqual(t, migrated.LastSeenMap["Bob"], wallClock(time.Unix(100, 0)))
+}
+
+// waits up to 5 seconds for check to pass on the message in
+// user's conversation with peer
+func waitForMessage(t *testing.T, user *User, peer string, messageIdentifier int64, check func(msg *SendMessageArgs) bool) {
+	for i := 0; i < 100; i++ {
+		for _, msg := range user.AllMessagesFromUser(peer) {
+			if msg.MessageIdentifier == messageIdentifier && check(msg) {
+				return
+			}
+		}
+		time.Sleep(time.Millisecond * 50)
+	}
+	t.Fatalf("%s never saw the change to message %v from %s", user.Name, messageIdentifier, peer)
+}
+
+/*
+**  Edits, deletions and reactions reach the other side and are
+**  applied to both copies of the message. Applying one twice does
+**  nothing, one that overtakes its message waits for it, and they
+**  survive a restart through the journal.
+*/
+func TestChanges(t *testing.T) {
+	fmt.Println("Running TestChanges")
+	defer fmt.Println("Passed!")
+	defer useMemNetwork(NewMemNetwork(1))()
+	defer func(limit int) { OrphanLimit = limit }(OrphanLimit)
+	OrphanLimit = 3
+
+	users := registerMany(3)
+	defer killAll(users)
+	alice, bob := users[1], users[2]
+
+	alice.SendMessage("2", "lunch at noon?")
+	alice.SendMessage("2", "oops, wrong chat")
+	waitForMessages(t, bob, "1", 2)
+	sent := alice.AllMessagesFromUser("2")
+	lunch, oops := sent[0].MessageIdentifier, sent[1].MessageIdentifier
+
+	assertEqual(t, alice.EditMessage("2", lunch, "lunch at one?"), nil)
+	assertEqual(t, alice.DeleteMessage("2", oops), nil)
+	assertEqual(t, bob.React("1", lunch, "👍"), nil)
+	assertEqual(t, alice.React("2", lunch, "👍"), nil)
+	assertEqual(t, errors.Is(bob.EditMessage("1", lunch, "mine now"), ErrNotYourMessage), true)
+	assertEqual(t, errors.Is(alice.EditMessage("2", oops, "back"), ErrNoSuchMessage), true)
+	assertEqual(t, errors.Is(alice.React("2", 12345, "👍"), ErrNoSuchMessage), true)
+
+	for _, side := range []struct{ user *User; peer string }{{alice, "2"}, {bob, "1"}} {
+		waitForMessage(t, side.user, side.peer, lunch, func(msg *SendMessageArgs) bool {
+			return msg.Edited && msg.Content == "lunch at one?" && len(msg.Reactions["👍"]) == 2
+		})
+		waitForMessage(t, side.user, side.peer, oops, func(msg *SendMessageArgs) bool {
+			return msg.Deleted && msg.Content == ""
+		})
+	}
+	query, _ := ParseSearchQuery("one")
+	assertEqual(t, len(bob.Search(query)), 1)
+	query, _ = ParseSearchQuery("oops")
+	assertEqual(t, len(bob.Search(query)), 0)
+
+	// the same changes delivered again by a relay, and an older
+	// edit arriving late, change nothing
+	carol := MakeUser("Carol", "mem:9")
+	defer DefaultStorage.Remove("Carol")
+	assertEqual(t, carol.Serialize(), nil)
+	dave, mallory := introduce(carol, "Dave"), introduce(carol, "Mallory")
+	original := signAs(dave, &SendMessageArgs{Content: "hi", Clock: 10, ToUsername: "Carol", FromUsername: "Dave", MessageIdentifier: 100})
+	react := signAs(dave, &SendMessageArgs{Content: "🎉", Clock: 11, ToUsername: "Carol", FromUsername: "Dave", MessageIdentifier: 101, Kind: ReactKind, Ref: 100})
+	edit := signAs(dave, &SendMessageArgs{Content: "hello", Clock: 13, ToUsername: "Carol", FromUsername: "Dave", MessageIdentifier: 102, Kind: EditKind, Ref: 100})
+	stale := signAs(dave, &SendMessageArgs{Content: "hey", Clock: 12, ToUsername: "Carol", FromUsername: "Dave", MessageIdentifier: 103, Kind: EditKind, Ref: 100})
+	forged := signAs(mallory, &SendMessageArgs{Content: "👎", Clock: 14, ToUsername: "Carol", FromUsername: "Mallory", MessageIdentifier: 104, Kind: ReactKind, Ref: 100})
+
+	// the changes overtake the message they are about, and
+	// someone else claims to have reacted to it
+	for _, msg := range []*SendMessageArgs{react, edit, forged, react, stale, original, original} {
+		msgCopy := *msg
+		carol.SendMessageHandler(&msgCopy, &SendMessageReply{})
+	}
+	got := carol.AllMessagesFromUser("Dave")
+	assertEqual(t, len(got), 1)
+	assertEqual(t, got[0].Content, "hello")
+	assertEqual(t, got[0].Edited, true)
+	assertEqual(t, len(got[0].Reactions["🎉"]), 1)
+	assertEqual(t, len(got[0].Reactions), 1)
+	assertEqual(t, len(carol.OrphanChanges), 0)
+
+	// the journal alone brings them back
+	restored, err := LoadProfile("Carol", "")
+	assertEqual(t, err, nil)
+	got = restored.AllMessagesFromUser("Dave")
+	assertEqual(t, got[0].Content, "hello")
+	assertEqual(t, got[0].Reactions["🎉"][0], "Dave")
+
+	// a relay can't make up changes in dave's name, even
+	// knowing which message to change
+	fake := signAs(mallory, &SendMessageArgs{Clock: 20, ToUsername: "Carol", FromUsername: "Dave", MessageIdentifier: 105, Kind: DeleteKind, Ref: 100})
+	assertEqual(t, errors.Is(carol.SendMessageHandler(fake, &SendMessageReply{}), ErrBadMessage), true)
+	fake = &SendMessageArgs{Clock: 21, ToUsername: "Carol", FromUsername: "Dave", MessageIdentifier: 106, Kind: DeleteKind, Ref: 100}
+	carol.mu.Lock()
+	carol.receiveChange(fake)
+	carol.mu.Unlock()
+	got = carol.AllMessagesFromUser("Dave")
+	assertEqual(t, got[0].Deleted, false)
+	assertEqual(t, got[0].Content, "hello")
+
+	// and only OrphanLimit changes from anyone wait for their message
+	for id := int64(107); id < 112; id++ {
+		orphan := signAs(dave, &SendMessageArgs{Content: "🎉", Clock: id, ToUsername: "Carol", FromUsername: "Dave", MessageIdentifier: id, Kind: ReactKind, Ref: id + 100})
+		assertEqual(t, carol.SendMessageHandler(orphan, &SendMessageReply{}), nil)
+	}
+	assertEqual(t, len(carol.OrphanChanges), 3)
+}
+
+/*
+**  Files up to InlineFileLimit arrive with their offer, even through
+**  a relay, bigger ones are fetched in chunks, and ones past
+**  AutoAcceptLimit wait to be accepted. Transfers carry on after
+**  either side goes offline and comes back.
+*/
+func TestFiles(t *testing.T) {
+	fmt.Println("Running TestFiles")
+	defer fmt.Println("Passed!")
+	defer useMemNetwork(NewMemNetwork(1))()
+
+	defer func(dir string, chunk int, inline int64, auto int64) {
+		DownloadDir, FileChunkSize, InlineFileLimit, AutoAcceptLimit = dir, chunk, inline, auto
+	}(DownloadDir, FileChunkSize, InlineFileLimit, AutoAcceptLimit)
+	DownloadDir = t.TempDir()
+	FileChunkSize, InlineFileLimit, AutoAcceptLimit = 1000, 2000, 8000
+
+	outbox := t.TempDir()
+	makeFile := func(name string, size int) (string, []byte) {
+		data := make([]byte, size)
+		rand.Read(data)
+		path := filepath.Join(outbox, name)
+		assertEqual(t, ioutil.WriteFile(path, data, 0600), nil)
+		return path, data
+	}
+	waitForFile := func(user *User, peer string, id int64, state string) *Attachment {
+		waitForMessage(t, user, peer, id, func(msg *SendMessageArgs) bool {
+			return msg.Attachment != nil && msg.Attachment.State == state
+		})
+		for _, msg := range user.AllMessagesFromUser(peer) {
+			if msg.MessageIdentifier == id {
+				return msg.Attachment
+			}
+		}
+		return nil
+	}
+	lastId := func(user *User, peer string) int64 {
+		messages := user.AllMessagesFromUser(peer)
+		return messages[len(messages) - 1].MessageIdentifier
+	}
+
+	users := registerMany(3)
+	defer killAll(users)
+	alice, bob := users[1], users[2]
+
+	small, smallData := makeFile("small.txt", 1500)
+	assertEqual(t, alice.SendFile("2", small), nil)
+	got := waitForFile(bob, "1", lastId(alice, "2"), FileComplete)
+	saved, _ := ioutil.ReadFile(got.Path)
+	assertEqual(t, bytes.Equal(saved, smallData), true)
+	assertEqual(t, got.Path, filepath.Join(DownloadDir, "1", "small.txt"))
+	assertEqual(t, got.Data == nil, true)
+
+	// relays only see how big a file is
+	hidden := SendMessageArgs{Content: "secret.txt", ToUsername: "2", FromUsername: "1", MessageIdentifier: nrand(), Kind: FileKind, Attachment: &Attachment{Size: 1500, ChunkSize: 1000, Hash: []byte("whole"), ChunkHashes: [][]byte{[]byte("first"), []byte("second")}}}
+	wire, sealed := alice.sealMessage(hidden, bob.Keys.Public)
+	assertEqual(t, sealed, true)
+	assertEqual(t, wire.Attachment.Hash == nil && wire.Attachment.ChunkHashes == nil && wire.Attachment.Data == nil, true)
+	assertEqual(t, wire.Attachment.Size, int64(1500))
+	bob.openMessage(&wire)
+	assertEqual(t, wire.DecryptFailed, false)
+	assertEqual(t, string(wire.Attachment.Hash), "whole")
+	assertEqual(t, string(bytes.Join(wire.Attachment.ChunkHashes, []byte(","))), "first,second")
+
+	// even when the offer has no text of its own
+	hidden.Content = ""
+	wire, sealed = alice.sealMessage(hidden, bob.Keys.Public)
+	assertEqual(t, sealed, true)
+	assertEqual(t, wire.Attachment.Hash == nil && wire.Attachment.ChunkHashes == nil && wire.Attachment.Data == nil, true)
+	bob.openMessage(&wire)
+	assertEqual(t, wire.DecryptFailed, false)
+	assertEqual(t, string(wire.Attachment.Hash), "whole")
+
+	// a second file with the same name doesn't overwrite the first
+	medium, mediumData := makeFile("small.txt", 5500)
+	assertEqual(t, alice.SendFile("2", medium), nil)
+	got = waitForFile(bob, "1", lastId(alice, "2"), FileComplete)
+	saved, _ = ioutil.ReadFile(got.Path)
+	assertEqual(t, bytes.Equal(saved, mediumData), true)
+	assertEqual(t, got.Path, filepath.Join(DownloadDir, "1", "small (1).txt"))
+	progress := 0
+	for len(bob.GetNotificationsChannel()) > 0 {
+		msg := <-bob.GetNotificationsChannel()
+		if msg.Attachment != nil && msg.Attachment.State == FileDownloading && msg.Attachment.Received > 0 {
+			progress++
+		}
+	}
+	assertEqual(t, progress >= 5, true)
+
+	// too big to take without asking, and the sender goes away
+	// before it is accepted
+	big, bigData := makeFile("big.bin", 9500)
+	assertEqual(t, alice.SendFile("2", big), nil)
+	bigId := lastId(alice, "2")
+	waitForFile(bob, "1", bigId, FileOffered)
+	assertEqual(t, errors.Is(bob.AcceptFile("1", 12345), ErrNoSuchTransfer), true)
+	aliceIp := alice.Node.IpAddr
+	alice.Logoff()
+	assertEqual(t, bob.AcceptFile("1", bigId), nil)
+	time.Sleep(time.Second)
+	got = waitForFile(bob, "1", bigId, FileDownloading)
+	assertEqual(t, got.Received, int64(0))
+
+	// the recipient goes away too and both come back
+	bobIp := bob.Node.IpAddr
+	bob.Logoff()
+	alice = mustLogin("1", aliceIp)
+	defer alice.Logoff()
+	bob = mustLogin("2", bobIp)
+	defer bob.Logoff()
+	got = waitForFile(bob, "1", bigId, FileComplete)
+	saved, _ = ioutil.ReadFile(got.Path)
+	assertEqual(t, bytes.Equal(saved, bigData), true)
+
+	// small files are relayed to recipients who are offline
+	bob.Logoff()
+	late, lateData := makeFile("late.txt", 100)
+	assertEqual(t, alice.SendFile("2", late), nil)
+	lateId := lastId(alice, "2")
+	waitForStatus(t, alice, "2", lateId, Relayed)
+	os.Remove(late)
+	bob = mustLogin("2", bobIp)
+	defer bob.Logoff()
+	got = waitForFile(bob, "1", lateId, FileComplete)
+	saved, _ = ioutil.ReadFile(got.Path)
+	assertEqual(t, bytes.Equal(saved, lateData), true)
+
+	assertEqual(t, errors.Is(alice.SendFile("2", outbox), ErrNotAFile), true)
+}
+
+// waits up to 5 seconds for user to see peer's presence pass check
+func waitForPresence(t *testing.T, user *User, peer string, check func(presence PresenceRecord) bool) {
+	for i := 0; i < 100; i++ {
+		if check(user.Presences()[peer]) {
+			return
+		}
+		time.Sleep(time.Millisecond * 50)
+	}
+	t.Fatalf("%s never saw the change to %s's presence, has %+v", user.Name, peer, user.Presences()[peer])
+}
+
+/*
+**  Watchers hear about changes to someone's presence as soon as
+**  they are made, and when they log off. Someone who disappears
+**  without logging off is shown as Offline the next time their
+**  watchers renew, and records that aren't signed by their owner
+**  are ignored.
+*/
+func TestPresence(t *testing.T) {
+	fmt.Println("Running TestPresence")
+	defer fmt.Println("Passed!")
+	defer useMemNetwork(NewMemNetwork(1))()
+
+	// renewals only happen when the test asks for them
+	defer func(every time.Duration) { PresenceEvery = every }(PresenceEvery)
+	PresenceEvery = time.Minute
+
+	users := registerMany(3)
+	defer killAll(users)
+	alice, bob := users[1], users[2]
+
+	alice.Watch("2")
+	waitForPresence(t, alice, "2", func(presence PresenceRecord) bool {
+		return presence.State == Online
+	})
+	assertEqual(t, bob.SetPresence(Away, "at lunch"), nil)
+	waitForPresence(t, alice, "2", func(presence PresenceRecord) bool {
+		return presence.State == Away && presence.Text == "at lunch"
+	})
+	assertEqual(t, errors.Is(bob.SetPresence("Asleep", ""), ErrBadPresence), true)
+	assertEqual(t, len(alice.GetPresenceChannel()), 2)
+
+	// only bob can speak for bob, and nobody else is watched
+	forged := MakePresenceRecord("2", Busy, "ignore me", alice.Keys)
+	assertEqual(t, alice.PresenceHandler(&forged, &PresenceReply{}), nil)
+	other := MakePresenceRecord("0", Busy, "", users[0].Keys)
+	assertEqual(t, alice.PresenceHandler(&other, &PresenceReply{}), nil)
+	assertEqual(t, alice.Presences()["2"].State, Away)
+	_, watched := alice.Presences()["0"]
+	assertEqual(t, watched, false)
+
+	// only 0 can subscribe 0, and only at 0's own address
+	subscribe := func(keys *KeyPair, ipAddr string) error {
+		args := SubscribePresenceArgs{Username: "0", IpAddr: ipAddr, Seq: time.Now().UnixNano()}
+		args.Signature = ed25519.Sign(keys.SignPrivate, args.signedBytes())
+		return bob.SubscribePresenceHandler(&args, &SubscribePresenceReply{})
+	}
+	subscribed := func() bool {
+		bob.mu.Lock()
+		defer bob.mu.Unlock()
+		_, exists := bob.subscribers["0"]
+		return exists
+	}
+	assertEqual(t, subscribe(alice.Keys, users[0].Node.IpAddr), ErrBadSignature)
+	assertEqual(t, subscribe(users[0].Keys, alice.Node.IpAddr), ErrBadSignature)
+	assertEqual(t, subscribed(), false)
+	assertEqual(t, subscribe(users[0].Keys, users[0].Node.IpAddr), nil)
+	assertEqual(t, subscribed(), true)
+
+	// logging off is pushed, coming back is found on renewal
+	// and the status was kept
+	bobIp := bob.Node.IpAddr
+	assertEqual(t, bob.Logoff(), nil)
+	waitForPresence(t, alice, "2", func(presence PresenceRecord) bool {
+		return presence.State == Offline
+	})
+	bob = mustLogin("2", bobIp)
+	defer bob.Logoff()
+	alice.subscribe("2")
+	assertEqual(t, alice.Presences()["2"].State, Away)
+	assertEqual(t, alice.Presences()["2"].Text, "at lunch")
+
+	// disappearing without a word is found on renewal
+	bob.shutdown()
+	alice.subscribe("2")
+	gone := alice.Presences()["2"]
+	assertEqual(t, gone.State, Offline)
+	assertEqual(t, gone.LastSeen >= time.Now().Add(-time.Minute).Unix(), true)
+}
+
+/*
+**  Signals reach an online peer straight away and go nowhere
+**  else: they aren't relayed to a peer who is offline, kept in
+**  anyone's history or remembered as seen. Forged, stale and
+**  misaddressed signals are dropped.
+*/
+func TestSignals(t *testing.T) {
+	fmt.Println("Running TestSignals")
+	defer fmt.Println("Passed!")
+	defer useMemNetwork(NewMemNetwork(1))()
+
+	users := registerMany(3)
+	defer killAll(users)
+	alice, bob := users[1], users[2]
+
+	assertEqual(t, alice.SendSignal("2", TypingSignal), nil)
+	assertEqual(t, alice.SendSignal("2", StoppedTypingSignal), nil)
+	signals := bob.GetSignalsChannel()
+	for _, kind := range []string{TypingSignal, StoppedTypingSignal} {
+		select {
+		case signal := <-signals:
+			assertEqual(t, signal.FromUsername, "1")
+			assertEqual(t, signal.Kind, kind)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("bob never got the %s signal", kind)
+		}
+	}
+	assertEqual(t, errors.Is(alice.SendSignal("Nobody", TypingSignal), ErrUnknownUser), true)
+
+	// only alice can sign for alice, and old or someone else's
+	// signals are ignored
+	forged := SignalArgs{FromUsername: "1", ToUsername: "2", Kind: TypingSignal, Seq: time.Now().UnixNano()}
+	forged.Signature = ed25519.Sign(bob.Keys.SignPrivate, forged.signedBytes())
+	stale := SignalArgs{FromUsername: "1", ToUsername: "2", Kind: TypingSignal, Seq: time.Now().Add(-2 * TypingFor).UnixNano()}
+	stale.Signature = ed25519.Sign(alice.Keys.SignPrivate, stale.signedBytes())
+	misaddressed := SignalArgs{FromUsername: "1", ToUsername: "0", Kind: TypingSignal, Seq: time.Now().UnixNano()}
+	misaddressed.Signature = ed25519.Sign(alice.Keys.SignPrivate, misaddressed.signedBytes())
+	for _, signal := range []SignalArgs{forged, stale, misaddressed} {
+		assertEqual(t, bob.SignalHandler(&signal, &SignalReply{}), nil)
+	}
+	assertEqual(t, len(signals), 0)
+
+	// nothing is left behind for a peer who is offline
+	bob.Logoff()
+	assertEqual(t, errors.Is(alice.SendSignal("2", TypingSignal), ErrNotOnline), true)
+	assertEqual(t, len(alice.PendingMessages["2"]), 0)
+	for _, user := range users {
+		assertEqual(t, len(user.ReceivedMessageIdentifiers), 0)
+		assertEqual(t, len(user.AllMessagesFromUser("1")) + len(user.AllMessagesFromUser("2")), 0)
+	}
+}
+
+/*
+**  Contacts keep what we set on them and where we last reached
+**  them across a restart, are listed pinned first and completed
+**  from either name, and are only verified by the fingerprint of
+**  their own key.
+*/
+func TestContacts(t *testing.T) {
+	fmt.Println("Running TestContacts")
+	defer fmt.Println("Passed!")
+	defer useMemNetwork(NewMemNetwork(1))()
+
+	users := registerMany(3)
+	defer killAll(users)
+	alice, bob := users[1], users[2]
+	names := func(contacts []Contact) string {
+		shown := make([]string, len(contacts))
+		for i, contact := range contacts {
+			shown[i] = contact.DisplayName()
+		}
+		return strings.Join(shown, ",")
+	}
+
+	alice.AddContact("2", "Bobby")
+	alice.AddContact("0", "")
+	alice.AddContact("2", "")
+	assertEqual(t, names(alice.ContactList()), "0,Bobby")
+	assertEqual(t, alice.PinContact("2", true), nil)
+	assertEqual(t, alice.SetNotes("2", "met at the conference"), nil)
+	assertEqual(t, names(alice.ContactList()), "Bobby,0")
+	bobby, _ := alice.Contact("2")
+	assertEqual(t, bobby.IpAddr, bob.Node.IpAddr)
+
+	assertEqual(t, strings.Join(alice.CompleteContact("bob"), ","), "2")
+	assertEqual(t, strings.Join(alice.CompleteContact("2"), ","), "2")
+	assertEqual(t, strings.Join(alice.CompleteContact(""), ","), "2,0")
+	assertEqual(t, len(alice.CompleteContact("carol")), 0)
+
+	assertEqual(t, errors.Is(alice.VerifyContact("2", alice.Fingerprint()), ErrFingerprintMismatch), true)
+	assertEqual(t, errors.Is(alice.VerifyContact("3", bob.Fingerprint()), ErrNoSuchContact), true)
+	assertEqual(t, alice.VerifyContact("2", strings.ToUpper(strings.ReplaceAll(bob.Fingerprint(), " ", ""))), nil)
+	bobby, _ = alice.Contact("2")
+	assertEqual(t, bobby.Verified, bob.Fingerprint())
+
+	assertEqual(t, errors.Is(alice.RemoveContact("3"), ErrNoSuchContact), true)
+	assertEqual(t, alice.RemoveContact("0"), nil)
+	assertEqual(t, errors.Is(alice.SetNickname("0", "Zed"), ErrNoSuchContact), true)
+
+	// all of it survives logging off
+	assertEqual(t, alice.Logoff(), nil)
+	restored, err := LoadProfile("1", "")
+	assertEqual(t, err, nil)
+	assertEqual(t, names(restored.ContactList()), "Bobby")
+	bobby, _ = restored.Contact("2")
+	assertEqual(t, bobby.Notes, "met at the conference")
+	assertEqual(t, bobby.Pinned, true)
+	assertEqual(t, bobby.Verified, bob.Fingerprint())
+	assertEqual(t, bobby.IpAddr, bob.Node.IpAddr)
+}
+
+/*
+**  A peer holding a connection to us open doesn't stop us
+**  logging off, and nothing is started once we have.
+*/
+func TestLogoffOpenConnection(t *testing.T) {
+	fmt.Println("Running TestLogoffOpenConnection")
+	defer fmt.Println("Passed!")
+	network := NewMemNetwork(1)
+	defer useMemNetwork(network)()
+
+	users := registerMany(2)
+	defer killAll(users)
+
+	conn, err := network.Dial("mem:66", users[1].Node.IpAddr)
+	assertEqual(t, err, nil)
+	client := rpc.NewClient(conn)
+	defer client.Close()
+	assertEqual(t, client.Call("DhtNode.PingHandler", &PingArgs{}, &PingReply{}), nil)
+	loggedOff := make(chan error, 1)
+	go func() { loggedOff <- users[1].Logoff() }()
+	select {
+	case err := <-loggedOff:
+		assertEqual(t, err, nil)
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Logoff waited for a connection a peer held open")
+	}
+
+	// handlers still running can't start anything new
+	ran := false
+	users[1].spawn(func() { ran = true })
+	users[1].shutdown()
+	assertEqual(t, ran, false)
+}
+
+/*
+**  Blocked users are dropped without being told, and everyone
+**  else is held to SenderLimit, SourceLimit and RelayQuota. Each
+**  RPC counts against SourceLimit, and each signed message
+**  against SenderLimit for its real sender.
+*/
+func TestLimits(t *testing.T) {
+	fmt.Println("Running TestLimits")
+	defer fmt.Println("Passed!")
+	network := NewMemNetwork(1)
+	defer useMemNetwork(network)()
+
+	users := registerMany(3)
+	defer killAll(users)
+	alice, bob := users[1], users[2]
+
+	bob.Block("1")
+	assertEqual(t, strings.Join(bob.BlockList(), ","), "1")
+	alice.SendMessage("2", "let me in")
+	sent := alice.AllMessagesFromUser("2")
+	waitForStatus(t, alice, "2", sent[0].MessageIdentifier, Delivered)
+	assertEqual(t, alice.SendSignal("2", TypingSignal), nil)
+	assertEqual(t, len(bob.AllMessagesFromUser("1")), 0)
+	assertEqual(t, len(bob.GetSignalsChannel()), 0)
+	bob.Unblock("1")
+	assertEqual(t, bob.IsBlocked("1"), false)
+	alice.SendMessage("2", "thanks")
+	waitForMessages(t, bob, "1", 1)
+
+	defer func(sender RateLimit, source RateLimit, quota int) {
+		SenderLimit, SourceLimit, RelayQuota = sender, source, quota
+	}(SenderLimit, SourceLimit, RelayQuota)
+	SenderLimit = RateLimit{PerSecond: 1, Burst: 3}
+	SourceLimit = RateLimit{PerSecond: 1, Burst: 2}
+	RelayQuota = 2
+
+	// a flood from one sender doesn't hold up anyone else
+	carol := MakeUser("Carol", "mem:9")
+	defer DefaultStorage.Remove("Carol")
+	keys := make(map[string]*KeyPair)
+	for _, username := range []string{"Mallory", "Dave", "Frank", "Grace"} {
+		keys[username] = introduce(carol, username)
+	}
+	send := func(from string, to string, id int64) error {
+		args := SendMessageArgs{Content: "spam", ToUsername: to, FromUsername: from, MessageIdentifier: id}
+		return carol.SendMessageHandler(signAs(keys[from], &args), &SendMessageReply{})
+	}
+	for id := int64(1); id <= 3; id++ {
+		assertEqual(t, send("Mallory", "Carol", id), nil)
+	}
+	assertEqual(t, errors.Is(send("Mallory", "Carol", 4), ErrRateLimited), true)
+	assertEqual(t, send("Dave", "Carol", 5), nil)
+
+	// copies of a message we already have aren't charged
+	for i := 0; i < 5; i++ {
+		assertEqual(t, send("Mallory", "Carol", 1), nil)
+	}
+
+	// we hold RelayQuota messages for a recipient, and take the
+	// ones we hold again. mail we only relay isn't charged to
+	// its sender
+	assertEqual(t, send("Mallory", "Erin", 6), nil)
+	assertEqual(t, send("Frank", "Erin", 7), nil)
+	assertEqual(t, errors.Is(send("Grace", "Erin", 8), ErrRelayQuota), true)
+	assertEqual(t, send("Frank", "Erin", 7), nil)
+	assertEqual(t, send("Grace", "Ivan", 9), nil)
+
+	// RPCs are limited by host, this machine's included
+	remote := func(addr string) net.Addr {
+		tcp, _ := net.ResolveTCPAddr("tcp", addr)
+		return tcp
+	}
+	assertEqual(t, carol.allowSource(remote("10.0.0.1:5000")), true)
+	assertEqual(t, carol.allowSource(remote("10.0.0.1:5001")), true)
+	assertEqual(t, carol.allowSource(remote("10.0.0.1:5002")), false)
+	assertEqual(t, carol.allowSource(remote("10.0.0.2:5000")), true)
+	assertEqual(t, carol.allowSource(remote("127.0.0.1:5000")), true)
+	assertEqual(t, carol.allowSource(remote("127.0.0.1:5001")), true)
+	assertEqual(t, carol.allowSource(remote("127.0.0.1:5002")), false)
+
+	// and refused before any RPC is served
+	signal := SignalArgs{ToUsername: "Nobody", Seq: time.Now().UnixNano()}
+	for i := 0; i < 2; i++ {
+		assertEqual(t, network.Call("10.0.0.66:1", bob.Node.IpAddr, "User.SignalHandler", &signal, &SignalReply{}), true)
+	}
+	assertEqual(t, network.Call("10.0.0.66:1", bob.Node.IpAddr, "User.SignalHandler", &signal, &SignalReply{}), false)
+	assertEqual(t, network.Call("10.0.0.67:1", bob.Node.IpAddr, "User.SignalHandler", &signal, &SignalReply{}), true)
+
+	// holding a connection open doesn't get round the limit
+	conn, err := network.Dial("10.0.0.68:1", bob.Node.IpAddr)
+	assertEqual(t, err, nil)
+	client := rpc.NewClient(conn)
+	defer client.Close()
+	for i := 0; i < 2; i++ {
+		assertEqual(t, client.Call("User.SignalHandler", &signal, &SignalReply{}), nil)
+	}
+	if client.Call("User.SignalHandler", &signal, &SignalReply{}) == nil {
+		t.Fatalf("a held connection was served past SourceLimit")
+	}
+
+	// a forged message is refused without charging who it claims to be from
+	forged := SendMessageArgs{Content: "spam", ToUsername: "Carol", FromUsername: "Dave", MessageIdentifier: 10}
+	for i := 0; i < 5; i++ {
+		assertEqual(t, errors.Is(carol.SendMessageHandler(signAs(keys["Mallory"], &forged), &SendMessageReply{}), ErrBadMessage), true)
+	}
+	assertEqual(t, send("Dave", "Carol", 11), nil)
+}
+
+/*
+**  Messages left for a user who is offline are collected when
+**  they log back in, and only by them. Relays drop what they have
+**  held past RelayTTL, hold no more than MailboxSize in all, and
+**  back off from recipients they can't reach.
+*/
+func TestMailbox(t *testing.T) {
+	fmt.Println("Running TestMailbox")
+	defer fmt.Println("Passed!")
+	defer useMemNetwork(NewMemNetwork(1))()
+
+	defer func(ttl time.Duration, size int, min time.Duration, max time.Duration) {
+		RelayTTL, MailboxSize, MailRetryMin, MailRetryMax = ttl, size, min, max
+	}(RelayTTL, MailboxSize, MailRetryMin, MailRetryMax)
+	// nobody tries a recipient twice while the test runs, so
+	// mail left for bob comes to him from the pull
+	RelayTTL, MailboxSize, MailRetryMin, MailRetryMax = time.Hour, 3, 20 * time.Second, time.Minute
+
+	users := registerMany(4)
+	defer killAll(users)
+	alice, bob := users[1], users[2]
+
+	bobIp := bob.Node.IpAddr
+	bob.Logoff()
+	alice.SendMessage("2", "while you were out")
+	sent := alice.AllMessagesFromUser("2")
+	waitForStatus(t, alice, "2", sent[0].MessageIdentifier, Relayed)
+	bob = mustLogin("2", bobIp)
+	defer bob.Logoff()
+	waitForMessages(t, bob, "1", 1)
+	assertEqual(t, bob.AllMessagesFromUser("1")[0].Content, "while you were out")
+	waitForStatus(t, alice, "2", sent[0].MessageIdentifier, Delivered)
+
+	// carol holds mail for erin, who can be looked up but
+	// isn't online
+	carol := MakeUser("Carol", "mem:9")
+	defer DefaultStorage.Remove("Carol")
+	assertEqual(t, carol.Serialize(), nil)
+	erin := GenerateKeyPair()
+	carol.Node.Records[Sha1("Erin")] = MakeUserRecord("Erin", "mem:10", erin)
+	dave := introduce(carol, "Dave")
+	relay := func(from string, to string, id int64) error {
+		args := SendMessageArgs{Sealed: []byte("sealed"), ToUsername: to, FromUsername: from, MessageIdentifier: id}
+		return carol.SendMessageHandler(signAs(dave, &args), &SendMessageReply{})
+	}
+	assertEqual(t, relay("Dave", "Erin", 1), nil)
+	assertEqual(t, relay("Dave", "Erin", 2), nil)
+	carol.SendMessage("Erin", "mine")
+
+	// only erin can collect it, and it is sealed for her
+	pull := PullMailArgs{Username: "Erin", Seq: time.Now().UnixNano()}
+	pull.Signature = ed25519.Sign(carol.Keys.SignPrivate, pull.signedBytes())
+	assertEqual(t, errors.Is(carol.PullMailHandler(&pull, &PullMailReply{}), ErrBadSignature), true)
+	pull = PullMailArgs{Username: "Erin", Seq: time.Now().Add(-2 * time.Minute).UnixNano()}
+	pull.Signature = ed25519.Sign(erin.SignPrivate, pull.signedBytes())
+	assertEqual(t, errors.Is(carol.PullMailHandler(&pull, &PullMailReply{}), ErrBadSignature), true)
+	pull = PullMailArgs{Username: "Erin", Seq: time.Now().UnixNano()}
+	pull.Signature = ed25519.Sign(erin.SignPrivate, pull.signedBytes())
+	var mail PullMailReply
+	assertEqual(t, carol.PullMailHandler(&pull, &mail), nil)
+	assertEqual(t, len(mail.Messages), 3)
+	mine := mail.Messages[2]
+	assertEqual(t, mine.Content, "")
+	opened, err := erin.Open(mine.Sealed, mine.headerBytes())
+	assertEqual(t, err, nil)
+	assertEqual(t, string(opened), "mine")
+
+	// backing off doubles up to MailRetryMax, hearing from them
+	// resets it
+	delays := make([]string, 0)
+	assertEqual(t, carol.mailDue("Erin"), true)
+	for i := 0; i < 4; i++ {
+		carol.backOff("Erin")
+		delays = append(delays, carol.retries["Erin"].delay.String())
+	}
+	assertEqual(t, strings.Join(delays, ","), "20s,40s,1m0s,1m0s")
+	assertEqual(t, carol.mailDue("Erin"), false)
+	carol.mu.Lock()
+	carol.resetRetry("Erin")
+	carol.mu.Unlock()
+	assertEqual(t, carol.mailDue("Erin"), true)
+
+	// old relayed messages are dropped, our own are kept
+	carol.mu.Lock()
+	carol.PendingMessages["Erin"][0].HeldSince = time.Now().Add(-2 * time.Hour).Unix()
+	carol.mu.Unlock()
+	assertEqual(t, carol.mailDue("Erin"), true)
+	restored, err := LoadProfile("Carol", "")
+	assertEqual(t, err, nil)
+	for _, user := range []*User{carol, restored} {
+		held := user.pendingCopies("Erin")
+		assertEqual(t, len(held), 2)
+		assertEqual(t, held[0].MessageIdentifier, int64(2))
+		assertEqual(t, held[1].Content, "mine")
+	}
+
+	// and there is only so much room for everyone together
+	assertEqual(t, relay("Dave", "Frank", 3), nil)
+	assertEqual(t, relay("Dave", "Grace", 4), nil)
+	assertEqual(t, errors.Is(relay("Dave", "Heidi", 5), ErrRelayQuota), true)
+}
+
+/*
+**  The sender backs off from recipients it can't reach with some
+**  jitter, leaves each message with the nodes closest to them only
+**  once, comes back as soon as they do, and sends what it has
+**  queued in batches.
+*/
+func TestScheduler(t *testing.T) {
+	fmt.Println("Running TestScheduler")
+	defer fmt.Println("Passed!")
+	defer useMemNetwork(NewMemNetwork(1))()
+
+	defer func(size int, quota int, min time.Duration, max time.Duration) {
+		SendBatchSize, RelayQuota, MailRetryMin, MailRetryMax = size, quota, min, max
+	}(SendBatchSize, RelayQuota, MailRetryMin, MailRetryMax)
+
+	// a batch is taken message by message
+	RelayQuota = 1
+	carol := MakeUser("Carol", "mem:9")
+	dave := introduce(carol, "Dave")
+	batch := SendMessagesArgs{Messages: []SendMessageArgs{
+		*signAs(dave, &SendMessageArgs{Sealed: []byte("sealed"), ToUsername: "Erin", FromUsername: "Dave", MessageIdentifier: 1}),
+		*signAs(dave, &SendMessageArgs{Sealed: []byte("sealed"), ToUsername: "Erin", FromUsername: "Dave", MessageIdentifier: 2}),
+		*signAs(dave, &SendMessageArgs{Sealed: []byte("sealed"), ToUsername: "Frank", FromUsername: "Dave", MessageIdentifier: 3}),
+	}}
+	var taken SendMessagesReply
+	assertEqual(t, carol.SendMessagesHandler(&batch, &taken), nil)
+	assertEqual(t, strings.Join(taken.Statuses, ","), Relayed + ",," + Relayed)
+
+	// retries land in the second half of the delay
+	MailRetryMin, MailRetryMax = 20 * time.Second, time.Minute
+	for i := 0; i < 10; i++ {
+		carol.backOff("Erin")
+		carol.mu.Lock()
+		r := carol.retries["Erin"]
+		wait := time.Until(r.next)
+		if wait < r.delay / 2 - time.Second || wait > r.delay {
+			t.Fatalf("retry in %v after a delay of %v", wait, r.delay)
+		}
+		carol.mu.Unlock()
+	}
+	metrics := carol.QueueMetrics()
+	assertEqual(t, len(metrics.Queues), 2)
+	assertEqual(t, metrics.Queues[0].Username, "Erin")
+	assertEqual(t, metrics.Queues[0].Relaying, 1)
+	assertEqual(t, metrics.Queues[0].Attempts, 10)
+	assertEqual(t, metrics.Queues[1].Attempts, 0)
+	assertEqual(t, metrics.Failures, int64(10))
+
+	// nobody retries while the test runs, everything that
+	// happens is woken up
+	SendBatchSize, RelayQuota = 2, 500
+	users := registerMany(4)
+	defer killAll(users)
+	alice, bob := users[1], users[2]
+
+	bobIp := bob.Node.IpAddr
+	bob.Logoff()
+	for i := 0; i < 5; i++ {
+		alice.SendMessage("2", fmt.Sprintf("message %d", i))
+	}
+	sent := alice.AllMessagesFromUser("2")
+	for _, msg := range sent {
+		waitForStatus(t, alice, "2", msg.MessageIdentifier, Relayed)
+	}
+	metrics = alice.QueueMetrics()
+	assertEqual(t, len(metrics.Queues), 1)
+	assertEqual(t, metrics.Queues[0].Pending, 5)
+	assertEqual(t, metrics.Delivered, int64(0))
+	if metrics.Forwarded < 5 || metrics.Forwarded > int64(5 * (len(users) - 1)) {
+		t.Fatalf("%d copies forwarded for 5 messages", metrics.Forwarded)
+	}
+
+	// bob's acks bring alice back to him straight away, and
+	// her 5 messages go in batches of 2
+	bob = mustLogin("2", bobIp)
+	defer bob.Logoff()
+	waitForMessages(t, bob, "1", 5)
+	for _, msg := range sent {
+		waitForStatus(t, alice, "2", msg.MessageIdentifier, Delivered)
+	}
+	for i := 0; i < 100 && len(alice.QueueMetrics().Queues) > 0; i++ {
+		time.Sleep(50 * time.Millisecond)
+	}
+	metrics = alice.QueueMetrics()
+	assertEqual(t, len(metrics.Queues), 0)
+	assertEqual(t, metrics.Delivered, int64(5))
+}
@@ -1,7 +1,10 @@
 package dht
 
 import "math"
-import "github.com/pmylund/sortutil"
+import "bytes"
+import "time"
+import "sync"
+import "sort"
 import "net/rpc"
 import "encoding/gob"
 
@@ -12,15 +15,41 @@ const StartTag = "START"
 const Temp = "Temp"
 
 type DhtNode struct {
+	mu sync.Mutex // guards the routing table and every map below, never held across an RPC
 	IpAddr string
 	NodeId ID // sha1(ip)
 	RoutingTable [IDLen][]RoutingEntry // map from NodeId to IP- a IDLen X K matrix
-	Kv map[ID]string // map from username to IP
+	Replacements [IDLen][]RoutingEntry // per bucket, nodes seen while it was full, LRS to MRS
+	Records map[ID]UserRecord // map from username to its signed record
+	Rooms map[ID]RoomRecord // map from room name to its signed membership
+	Owners map[ID][]byte // map from username or room to the signing key it was first seen with
+	transport Transport // how RPCs reach other nodes, DefaultTransport if nil
+	lastLookup [IDLen]time.Time // per bucket, when we last did a lookup in its range
+	failures map[RoutingEntry]int // pings in a row each entry has failed
+}
+
+func (node *DhtNode) SetTransport(transport Transport) {
+	node.transport = transport
+}
+
+func (node *DhtNode) GetTransport() Transport {
+	if node.transport == nil {
+		return DefaultTransport
+	}
+	return node.transport
+}
+
+// sends an RPC from this node through its transport,
+// returns true if the server responded
+func (node *DhtNode) call(srv string, rpcname string, args interface{}, reply interface{}) bool {
+	return node.GetTransport().Call(node.IpAddr, srv, rpcname, args, reply)
 }
 
 //this gets called when another node is contacting this node through any API method!
 func (node *DhtNode) updateRoutingTable(entry RoutingEntry) {
 	Print(DHTHelperTag, "Node %v calling updateRoutingTable for node: %v, ip: %s", Short(node.NodeId), Short(entry.NodeId), entry.IpAddr)
+	node.mu.Lock()
+	defer node.mu.Unlock()
 	// ordering of K bucket is from LRS to MRS
 	n := find_n(entry.NodeId, node.NodeId) // n is the bucket index- index of first bit that doesn't match
 	bucket := node.RoutingTable[n]
@@ -36,20 +65,115 @@ func (node *DhtNode) updateRoutingTable(entry RoutingEntry) {
 	if len(bucket) < K { // bucket is not full
 		bucket = append(bucket, entry)
 	} else { // bucket is full
-		// ping the front of list (LRS)
-		if ! node.Ping(bucket[0]){
-			bucket[0] = entry //if does not respond, replace
-		}
-		bucket = moveToEnd(bucket, 0)	// move to end
+		// keep it in the replacement cache. the maintenance
+		// loop pings the LRS entry, and swaps in the newest
+		// replacement if it stops responding
+		node.addReplacement(n, entry)
 	}
 	node.RoutingTable[n] = bucket
 	Print(DHTHelperTag, "Node %v done updateRoutingTable Routing table is: %v", Short(node.NodeId), node.RoutingTable)
 }
 
+// must be called with node.mu held
+func (node *DhtNode) addReplacement(n uint, entry RoutingEntry) {
+	cache := node.Replacements[n]
+	for idx, r_entry := range cache {
+		if r_entry == entry {
+			node.Replacements[n] = moveToEnd(cache, idx)
+			return
+		}
+	}
+	cache = append(cache, entry)
+	if len(cache) > ReplacementCacheSize {
+		cache = cache[len(cache) - ReplacementCacheSize:]
+	}
+	node.Replacements[n] = cache
+}
+
+func (node *DhtNode) evict(n uint, entry RoutingEntry) {
+	/*
+		Removes an unresponsive entry from bucket n, and
+		fills its place with the most recently seen node
+		from the bucket's replacement cache. Must be called
+		with node.mu held.
+	*/
+	Print(DHTHelperTag, "Node %v evicting %v, ip: %s", Short(node.NodeId), Short(entry.NodeId), entry.IpAddr)
+	delete(node.failures, entry)
+	bucket := node.RoutingTable[n]
+	for idx, r_entry := range bucket {
+		if r_entry == entry {
+			bucket = append(bucket[:idx], bucket[idx + 1:]...)
+			break
+		}
+	}
+	// entry may have been dropped already, and a full
+	// bucket has no place to fill
+	if cache := node.Replacements[n]; len(cache) > 0 && len(bucket) < K {
+		bucket = append(bucket, cache[len(cache) - 1])
+		node.Replacements[n] = cache[:len(cache) - 1]
+	}
+	node.RoutingTable[n] = bucket
+}
+
+func (node *DhtNode) Maintain() {
+	/*
+		Keeps the routing table healthy without relying on
+		chat traffic. Called every MaintainEvery:
+		1) buckets nobody has looked up in for RefreshEvery
+		   are refreshed with a lookup on a random ID in
+		   their range
+		2) the LRS entry of each bucket is pinged, and
+		   evicted once it has failed MaxPingFailures
+		   pings in a row
+	*/
+	stale := make([]uint, 0)
+	lrs := make(map[uint]RoutingEntry)
+	node.mu.Lock()
+	for n, bucket := range node.RoutingTable {
+		if len(bucket) == 0 && len(node.Replacements[n]) == 0 {
+			continue
+		}
+		if time.Since(node.lastLookup[n]) >= RefreshEvery {
+			stale = append(stale, uint(n))
+		}
+		if len(bucket) > 0 {
+			lrs[uint(n)] = bucket[0]
+		}
+	}
+	node.mu.Unlock()
+
+	for _, n := range stale {
+		Print(DHTHelperTag, "Node %v refreshing bucket %d", Short(node.NodeId), n)
+		node.FindNearestNodes(randomIdInBucket(node.NodeId, n))
+		node.mu.Lock()
+		node.lastLookup[n] = time.Now()
+		node.mu.Unlock()
+	}
+	for n, entry := range lrs {
+		alive := node.Ping(entry)
+		node.mu.Lock()
+		if node.failures == nil {
+			node.failures = make(map[RoutingEntry]int)
+		}
+		if alive {
+			delete(node.failures, entry)
+		} else {
+			node.failures[entry]++
+			Print(DHTHelperTag, "Node %v could not ping %v (%d times)", Short(node.NodeId), Short(entry.NodeId), node.failures[entry])
+			if node.failures[entry] >= MaxPingFailures {
+				node.evict(n, entry)
+			}
+		}
+		node.mu.Unlock()
+	}
+}
+
 // get the alpha closest nodes to node ID in order to find user/node
 // returns a slice of RoutingEntriesDist sorted in increasing order of dist from 
 func (node *DhtNode) getClosest(target_result_len int, targetNodeId ID) []RoutingEntryDist{
 	Print(DHTHelperTag, "Node %v calling getClosest to get %d closest to %v", Short(node.NodeId), target_result_len, Short(targetNodeId))
+	node.mu.Lock()
+	defer node.mu.Unlock()
 	empty := true
 	for _, bucket := range node.RoutingTable {
 		if len(bucket) > 0{
@@ -71,8 +195,8 @@ func (node *DhtNode) getClosest(target_result_len int, targetNodeId ID) []Routin
 			if len(res) < target_result_len {
 				res = append(res, RoutingEntryDist{RoutingEntry: value, Distance: xor})
 			} else { //bucket is full	
-				sortutil.AscByField(res, "Distance")
-				if xor < res[len(res) - 1].Distance{
+				sort.Sort(ByDistance(res))
+				if xor.Less(res[len(res) - 1].Distance){
 					res[len(res) - 1] = RoutingEntryDist{RoutingEntry: value, Distance: xor}
 				}
 			}
@@ -91,34 +215,299 @@ func (node *DhtNode) getClosest(target_result_len int, targetNodeId ID) []Routin
 			bucket_idx--
 		}
 	}
-	sortutil.AscByField(res, "Distance")
+	sort.Sort(ByDistance(res))
 	return res
 }
 
+// checks that record is a valid record for the username with
+// ID id: it must be signed by the key the username was first
+// seen with, and not older than the record we already hold.
+// must be called with node.mu held
+func (node *DhtNode) checkRecord(id ID, record *UserRecord) error {
+	if Sha1(record.Username) != id || !record.Verify() {
+		return ErrBadSignature
+	}
+	if isExpired(record.Seq) {
+		return ErrExpiredRecord
+	}
+	if owner, exists := node.Owners[id]; exists && !bytes.Equal(owner, record.SigningKey) {
+		return ErrUsernameTaken
+	}
+	if held, exists := node.Records[id]; exists && record.Seq < held.Seq {
+		return ErrStaleRecord
+	}
+	return nil
+}
+
+// pins the username to the record's signing key the first time
+// we see it (trust-on-first-use). must be called with node.mu held
+func (node *DhtNode) pinOwner(id ID, record *UserRecord) {
+	if _, exists := node.Owners[id]; !exists {
+		node.Owners[id] = record.SigningKey
+	}
+}
+
 // StoreUser RPC handler
-//this just stores the user in your kv
+//this stores the user in your kv, if the record checks out
 func (node *DhtNode) StoreUserHandler(args *StoreUserArgs, reply *StoreUserReply) error {
-	Print(HandlerTag, "Node %v StoreUserHandler called by %v. kv[%v]=%v", Short(node.NodeId), Short(args.QueryingNodeId), Short(args.AnnouncedUserId), args.QueryingIpAddr)
+	id := Sha1(args.Record.Username)
+	Print(HandlerTag, "Node %v StoreUserHandler called by %v. kv[%v]=%v", Short(node.NodeId), Short(args.QueryingNodeId), Short(id), args.Record.IpAddr)
 	node.updateRoutingTable(RoutingEntry{NodeId: args.QueryingNodeId, IpAddr: args.QueryingIpAddr})
-	node.Kv[args.AnnouncedUserId] = args.AnnouncedIpAddr
+	reply.QueriedNodeId = node.NodeId
+	node.mu.Lock()
+	defer node.mu.Unlock()
+	if err := node.checkRecord(id, &args.Record); err != nil {
+		Print(HandlerTag, "Node %v rejecting record for %v: %v", Short(node.NodeId), args.Record.Username, err)
+		return err
+	}
+	node.pinOwner(id, &args.Record)
+	node.Records[id] = args.Record
 	return nil
 }
 
+// FindOwner RPC handler
+// returns the key the target username or room is pinned to.
+// unlike records, pins never expire
+func (node *DhtNode) FindOwnerHandler(args *FindOwnerArgs, reply *FindOwnerReply) error {
+	Print(HandlerTag, "Node %v FindOwnerHandler called by %v, TargetId: %v", Short(node.NodeId), Short(args.QueryingNodeId), Short(args.TargetId))
+	node.updateRoutingTable(RoutingEntry{NodeId: args.QueryingNodeId, IpAddr: args.QueryingIpAddr})
+	reply.QueriedNodeId = node.NodeId
+	node.mu.Lock()
+	defer node.mu.Unlock()
+	reply.SigningKey = node.Owners[args.TargetId]
+	return nil
+}
+
+// asks the node at ipAddr which key id is pinned to. returns
+// nil if it has none or can't be reached
+func (node *DhtNode) ownerAt(ipAddr string, id ID) []byte {
+	args := &FindOwnerArgs{QueryingNodeId: node.NodeId, QueryingIpAddr: node.IpAddr, TargetId: id}
+	var reply FindOwnerReply
+	if !node.call(ipAddr, "DhtNode.FindOwnerHandler", args, &reply) {
+		return nil
+	}
+	return reply.SigningKey
+}
+
 // called by User
-// tells the entire network: I'm a node and I'm online
-func (node *DhtNode) AnnounceUser(username string, ipAddr string) {
+// returns true if we or any of the K nodes closest to username
+// have it pinned to a key other than signingKey. this still
+// finds a username whose owner has been away for longer than
+// RecordTTL, which LookupRecord doesn't
+func (node *DhtNode) OwnedByOther(username string, signingKey []byte) bool {
+	id := Sha1(username)
+	node.mu.Lock()
+	owner, exists := node.Owners[id]
+	node.mu.Unlock()
+	if exists && !bytes.Equal(owner, signingKey) {
+		return true
+	}
+	for _, entryDist := range node.FindNearestNodes(id) {
+		if entryDist.RoutingEntry.NodeId == node.NodeId {
+			continue
+		}
+		if owner := node.ownerAt(entryDist.RoutingEntry.IpAddr, id); owner != nil && !bytes.Equal(owner, signingKey) {
+			return true
+		}
+	}
+	return false
+}
+
+// called by User
+// tells the entire network: I'm a node and I'm online,
+// and here is the public key to seal my messages with.
+// the announcement is signed with keys, which own username.
+// returns ErrUsernameTaken if we or any node we stored it
+// with has username pinned to another key
+func (node *DhtNode) AnnounceUser(username string, ipAddr string, keys *KeyPair) error {
 	//put myself in routing table
-	node.Kv[Sha1(username)] = ipAddr
+	id := Sha1(username)
+	record := MakeUserRecord(username, ipAddr, keys)
+	node.mu.Lock()
+	if err := node.checkRecord(id, &record); err == ErrUsernameTaken {
+		node.mu.Unlock()
+		return err
+	}
+	node.pinOwner(id, &record)
+	node.Records[id] = record
+	node.mu.Unlock()
 
 	Print(ApiTag, "Node %v calling AnnounceUser, username: %v, ipAddr: %v", Short(node.NodeId), username, ipAddr)
 	// does lookup(node.NodeId) in order to populate other node's routing table with my info
 	node.FindNearestNodes(node.NodeId)
 	// does lookup(hash(username)) to find K closest nodes to username then calls StoreUserHandler RPC on each node	
-	kClosestEntryDists := node.FindNearestNodes(Sha1(username))
-	args := &StoreUserArgs{QueryingNodeId: node.NodeId, QueryingIpAddr: ipAddr, AnnouncedUserId: Sha1(username), AnnouncedIpAddr: ipAddr}
+	kClosestEntryDists := node.FindNearestNodes(id)
+	args := &StoreUserArgs{QueryingNodeId: node.NodeId, QueryingIpAddr: ipAddr, Record: record}
+	var rejected error
+	for _, entryDist := range kClosestEntryDists{
+		var reply StoreUserReply
+		if node.call(entryDist.RoutingEntry.IpAddr, "DhtNode.StoreUserHandler", args, &reply) {
+			continue
+		}
+		// a refused call doesn't say why, so ask whether
+		// the node holds username for someone else
+		if owner := node.ownerAt(entryDist.RoutingEntry.IpAddr, id); owner != nil && !bytes.Equal(owner, keys.SignPublic) {
+			Print(ApiTag, "Node %v: %v refused our record for %v, it is pinned to another key", Short(node.NodeId), Short(entryDist.RoutingEntry.NodeId), username)
+			rejected = ErrUsernameTaken
+		}
+	}
+	return rejected
+}
+
+// checks that room is a valid record for the room with ID id,
+// the same way checkRecord does for usernames. must be called
+// with node.mu held
+func (node *DhtNode) checkRoom(id ID, room *RoomRecord) error {
+	if RoomId(room.Name) != id || !room.Verify() {
+		return ErrBadSignature
+	}
+	if isExpired(room.Seq) {
+		return ErrExpiredRecord
+	}
+	if owner, exists := node.Owners[id]; exists && !bytes.Equal(owner, room.OwnerKey) {
+		return ErrRoomTaken
+	}
+	if held, exists := node.Rooms[id]; exists && room.Seq < held.Seq {
+		return ErrStaleRecord
+	}
+	return nil
+}
+
+// StoreRoom RPC handler
+func (node *DhtNode) StoreRoomHandler(args *StoreRoomArgs, reply *StoreUserReply) error {
+	id := RoomId(args.Room.Name)
+	Print(HandlerTag, "Node %v StoreRoomHandler called by %v. rooms[%v]=%v", Short(node.NodeId), Short(args.QueryingNodeId), Short(id), args.Room.Members)
+	node.updateRoutingTable(RoutingEntry{NodeId: args.QueryingNodeId, IpAddr: args.QueryingIpAddr})
+	reply.QueriedNodeId = node.NodeId
+	node.mu.Lock()
+	defer node.mu.Unlock()
+	if err := node.checkRoom(id, &args.Room); err != nil {
+		Print(HandlerTag, "Node %v rejecting room %v: %v", Short(node.NodeId), args.Room.Name, err)
+		return err
+	}
+	if _, exists := node.Owners[id]; !exists {
+		node.Owners[id] = args.Room.OwnerKey
+	}
+	node.Rooms[id] = args.Room
+	return nil
+}
+
+// stores room on the K nodes closest to its ID
+func (node *DhtNode) AnnounceRoom(room RoomRecord) {
+	id := RoomId(room.Name)
+	Print(ApiTag, "Node %v calling AnnounceRoom, room: %v, members: %v", Short(node.NodeId), room.Name, room.Members)
+	kClosestEntryDists := node.FindNearestNodes(id)
+	args := &StoreRoomArgs{QueryingNodeId: node.NodeId, QueryingIpAddr: node.IpAddr, Room: room}
 	for _, entryDist := range kClosestEntryDists{
-		var reply PingReply
-		call(entryDist.RoutingEntry.IpAddr, "DhtNode.StoreUserHandler", args, &reply)
+		var reply StoreUserReply
+		node.call(entryDist.RoutingEntry.IpAddr, "DhtNode.StoreRoomHandler", args, &reply)
+	}
+}
+
+// FindRoom RPC handler
+func (node *DhtNode) FindRoomHandler(args *FindIdArgs, reply *FindIdReply) error {
+	Print(HandlerTag, "Node %v FindRoomHandler called by %v, TargetId: %v", Short(node.NodeId), Short(args.QueryingNodeId), Short(args.TargetId))
+	reply.QueriedNodeId = node.NodeId
+	reply.QueriedIpAddr = node.IpAddr
+	node.updateRoutingTable(RoutingEntry{NodeId: args.QueryingNodeId, IpAddr: args.QueryingIpAddr})
+	node.mu.Lock()
+	room, exists := node.heldRoom(args.TargetId)
+	node.mu.Unlock()
+	if exists {
+		reply.TargetRoom = &room
+	} else {
+		reply.TryNodes = node.getClosest(K, args.TargetId)
+	}
+	return nil
+}
+
+// returns the verified membership of room name, or nil if it
+// can't be found
+func (node *DhtNode) LookupRoom(name string) *RoomRecord {
+	Print(ApiTag, "Node %v calling FindRoom on %v", Short(node.NodeId), name)
+	id := RoomId(name)
+	node.mu.Lock()
+	local, haveLocal := node.heldRoom(id)
+	node.mu.Unlock()
+	_, found := node.idLookup(id, "Room")
+	if found == nil || (haveLocal && local.Seq > found.TargetRoom.Seq) {
+		if haveLocal {
+			return &local
+		}
+		return nil
+	}
+	node.mu.Lock()
+	if _, exists := node.Owners[id]; !exists {
+		node.Owners[id] = found.TargetRoom.OwnerKey
+	}
+	node.mu.Unlock()
+	return found.TargetRoom
+}
+
+// returns the record we hold for id, if it hasn't expired.
+// must be called with node.mu held
+func (node *DhtNode) heldRecord(id ID) (UserRecord, bool) {
+	record, exists := node.Records[id]
+	if exists && isExpired(record.Seq) {
+		Print(DHTHelperTag, "Node %v dropping expired record for %v", Short(node.NodeId), record.Username)
+		delete(node.Records, id)
+		return record, false
+	}
+	return record, exists
+}
+
+// returns the room we hold for id, if it hasn't expired.
+// must be called with node.mu held
+func (node *DhtNode) heldRoom(id ID) (RoomRecord, bool) {
+	room, exists := node.Rooms[id]
+	if exists && isExpired(room.Seq) {
+		Print(DHTHelperTag, "Node %v dropping expired room %v", Short(node.NodeId), room.Name)
+		delete(node.Rooms, id)
+		return room, false
+	}
+	return room, exists
+}
+
+// drops every record and room that has outlived RecordTTL
+func (node *DhtNode) ExpireRecords() {
+	node.mu.Lock()
+	defer node.mu.Unlock()
+	for id, _ := range node.Records {
+		node.heldRecord(id)
+	}
+	for id, _ := range node.Rooms {
+		node.heldRoom(id)
+	}
+}
+
+// stores every record and room we hold on the K nodes closest
+// to it, so they survive the nodes that were holding them
+// going away. Called every ReplicateEvery.
+func (node *DhtNode) Replicate() {
+	node.ExpireRecords()
+	node.mu.Lock()
+	records := make([]UserRecord, 0, len(node.Records))
+	for _, record := range node.Records {
+		records = append(records, record)
+	}
+	rooms := make([]RoomRecord, 0, len(node.Rooms))
+	for _, room := range node.Rooms {
+		rooms = append(rooms, room)
+	}
+	node.mu.Unlock()
+
+	for _, record := range records {
+		Print(DHTHelperTag, "Node %v replicating record for %v", Short(node.NodeId), record.Username)
+		args := &StoreUserArgs{QueryingNodeId: node.NodeId, QueryingIpAddr: node.IpAddr, Record: record}
+		for _, entryDist := range node.FindNearestNodes(Sha1(record.Username)) {
+			if entryDist.RoutingEntry.NodeId != node.NodeId {
+				var reply StoreUserReply
+				node.call(entryDist.RoutingEntry.IpAddr, "DhtNode.StoreUserHandler", args, &reply)
+			}
+		}
+	}
+	for _, room := range rooms {
+		node.AnnounceRoom(room)
 	}
 }
 
@@ -137,13 +526,15 @@ func (node *DhtNode) FindNodeHandler(args *FindIdArgs, reply *FindIdReply) error
 // FindUser RPC handlers
 //checks if user is in, if not, return false
 func (node *DhtNode) FindUserHandler(args *FindIdArgs, reply *FindIdReply) error {
-	Print(HandlerTag, "Node %v FindUserHandler called by %v, TargetId: %v. My kv is %v", Short(node.NodeId), Short(args.QueryingNodeId), Short(args.TargetId), node.Kv)
+	node.mu.Lock()
+	Print(HandlerTag, "Node %v FindUserHandler called by %v, TargetId: %v. My kv is %v", Short(node.NodeId), Short(args.QueryingNodeId), Short(args.TargetId), node.Records)
+	record, exists := node.heldRecord(args.TargetId)
+	node.mu.Unlock()
 	reply.QueriedNodeId = node.NodeId
 	reply.QueriedIpAddr = node.IpAddr
 	node.updateRoutingTable(RoutingEntry{NodeId: args.QueryingNodeId, IpAddr: args.QueryingIpAddr})
-	ipAddr, exists := node.Kv[args.TargetId]
 	if exists {
-		reply.TargetIpAddr = ipAddr
+		reply.TargetRecord = &record
 		Print(HandlerTag, "Node %v FindUserHandler (finished) called by %v, TargetId: %v. Target user is in my map! returning user", Short(node.NodeId), Short(args.QueryingNodeId), args.TargetId)
 	} else{
 		reply.TryNodes = node.getClosest(K, args.TargetId)
@@ -153,21 +544,24 @@ func (node *DhtNode) FindUserHandler(args *FindIdArgs, reply *FindIdReply) error
 }
 
 // helper function called by both FindUser and AnnounceUser
-// if targetType is "User" and found, returns an empty slice and ipAddress of target Username
-// else returns a k-length slice of RoutingEntriesDist sorted in increasing order of dist from, and empty string
-func (node *DhtNode) idLookup(targetId ID, targetType string) ([]RoutingEntryDist, string) {
+// if targetType is "User" and found, returns an empty slice and the reply holding the target's record
+// else returns a k-length slice of RoutingEntriesDist sorted in increasing order of dist from, and nil
+func (node *DhtNode) idLookup(targetId ID, targetType string) ([]RoutingEntryDist, *FindIdReply) {
 	Print(DHTHelperTag, "Node %v calling idLookup, targetId: %v, targetType: %v", Short(node.NodeId), Short(targetId), targetType)
 	// get the closest nodes to the desired node ID
 	// then add to a stack. we'll 
+	node.mu.Lock()
+	node.lastLookup[find_n(targetId, node.NodeId)] = time.Now()
+	node.mu.Unlock()
 	closestNodes := node.getClosest(Alpha, targetId)
 	if len(closestNodes) == 0 {
 		Print(ApiTag, "Node %v found 0 closest nodes- empty routing table!", Short(node.NodeId))
-		return []RoutingEntryDist{}, ""
+		return []RoutingEntryDist{}, nil
 	}
 	triedNodes := make(map[ID]bool)
 	triedNodes[node.NodeId] = true
 	closestNodes= append(closestNodes, RoutingEntryDist{Distance: Xor(node.NodeId, targetId), RoutingEntry: RoutingEntry{NodeId: node.NodeId, IpAddr: node.IpAddr}})
-	sortutil.AscByField(closestNodes, "Distance")
+	sort.Sort(ByDistance(closestNodes))
 	closestNodes = removeDuplicates(closestNodes)
 	// send the initial min(Alpha, # of closest Node)
 	// messages in flight to start the process
@@ -187,7 +581,7 @@ func (node *DhtNode) idLookup(targetId ID, targetType string) ([]RoutingEntryDis
 	for {
 		reply := <-replyChannel
 		sent--
-		if reply.QueriedNodeId == 0{
+		if reply.QueriedNodeId == (ID{}) {
 			Print(DHTHelperTag, "Node %v received dropped DhtNode.Find%sHandler packet", Short(node.NodeId), targetType)
 			//try to send to another- if still no more, then continue
 			for i := sent; i < Alpha; i++ {
@@ -203,35 +597,66 @@ func (node *DhtNode) idLookup(targetId ID, targetType string) ([]RoutingEntryDis
 				}
 			}
 			if sent == 0 {
-				return closestNodes, ""
+				return closestNodes, nil
 			}
 			continue
 		}
-		Print(DHTHelperTag, "Node %v received Find%v response from %v. Response is %v, %v", Short(node.NodeId), targetType, Short(reply.QueriedNodeId), reply.TryNodes, reply.TargetIpAddr)
+		Print(DHTHelperTag, "Node %v received Find%v response from %v. Response is %v, %v", Short(node.NodeId), targetType, Short(reply.QueriedNodeId), reply.TryNodes, reply.TargetRecord)
 		//update our routing table with queriedNodeId
 		node.updateRoutingTable(RoutingEntry{NodeId: reply.QueriedNodeId, IpAddr: reply.QueriedIpAddr})
 
+		// don't believe records that aren't signed by the username's owner
+		node.mu.Lock()
+		if reply.TargetRecord != nil {
+			if err := node.checkRecord(targetId, reply.TargetRecord); err != nil {
+				Print(DHTHelperTag, "Node %v ignoring record for %v from %v: %v", Short(node.NodeId), Short(targetId), Short(reply.QueriedNodeId), err)
+				reply.TargetRecord = nil
+			}
+		}
+
+		if reply.TargetRoom != nil {
+			if err := node.checkRoom(targetId, reply.TargetRoom); err != nil {
+				Print(DHTHelperTag, "Node %v ignoring room %v from %v: %v", Short(node.NodeId), Short(targetId), Short(reply.QueriedNodeId), err)
+				reply.TargetRoom = nil
+			}
+		}
+		node.mu.Unlock()
+
+		//if we are looking for a room break early if found
+		if targetType == "Room" && reply.TargetRoom != nil {
+			//send room to closest node that did not return value
+			for _, entryDist := range closestNodes{
+				if triedNodes[entryDist.RoutingEntry.NodeId] && entryDist.RoutingEntry.NodeId != reply.QueriedNodeId{
+					args := &StoreRoomArgs{QueryingNodeId: node.NodeId, QueryingIpAddr: node.IpAddr, Room: *reply.TargetRoom}
+					var reply2 StoreUserReply
+					node.call(entryDist.RoutingEntry.IpAddr, "DhtNode.StoreRoomHandler", args, &reply2)
+					break //only cache once!
+				}
+			}
+			return []RoutingEntryDist{} , reply
+		}
+
 		//if we are looking for a user's ip address break early if found
-		if targetType == "User" && reply.TargetIpAddr != "" {
+		if targetType == "User" && reply.TargetRecord != nil {
 			//send user to closest node that did not return value
 			for _, entryDist := range closestNodes{
 				if triedNodes[entryDist.RoutingEntry.NodeId] && entryDist.RoutingEntry.NodeId != reply.QueriedNodeId{
-					args := &StoreUserArgs{QueryingNodeId: node.NodeId, QueryingIpAddr: node.IpAddr, AnnouncedUserId: targetId, AnnouncedIpAddr: reply.TargetIpAddr}
+					args := &StoreUserArgs{QueryingNodeId: node.NodeId, QueryingIpAddr: node.IpAddr, Record: *reply.TargetRecord}
 					var reply2 StoreUserReply
-					call(entryDist.RoutingEntry.IpAddr, "DhtNode.StoreUserHandler", args, &reply2)
+					node.call(entryDist.RoutingEntry.IpAddr, "DhtNode.StoreUserHandler", args, &reply2)
 					break //only cache once!
 				}
 			}
-			return []RoutingEntryDist{} , reply.TargetIpAddr
+			return []RoutingEntryDist{} , reply
 		}
 		// process the reply, see if we are done
 		// if we need to break because of stop cond: send done channel
 		combined := append(closestNodes, reply.TryNodes...)
 		combined = removeDuplicates(combined)
-		sortutil.AscByField(combined, "Distance")
+		sort.Sort(ByDistance(combined))
 		combined = combined[: int(math.Min(float64(K), float64(len(combined))))]
 		
-		sortutil.AscByField(combined, "Distance")
+		sort.Sort(ByDistance(combined))
 		done := true
 		for _, entryDist := range combined {
 			_, already_tried := triedNodes[entryDist.RoutingEntry.NodeId]
@@ -242,7 +667,7 @@ func (node *DhtNode) idLookup(targetId ID, targetType string) ([]RoutingEntryDis
 
 		if isEqual(combined, closestNodes) && done { //closest Nodes have not changed
 			Print(DHTHelperTag, "Node %v is exiting ID lookup because it's closest nodes have not changed! %v", Short(node.NodeId), closestNodes)
-			return closestNodes, ""
+			return closestNodes, nil
 		}
 		closestNodes = combined
 		// then check to see if we are still under
@@ -260,6 +685,9 @@ func (node *DhtNode) idLookup(targetId ID, targetType string) ([]RoutingEntryDis
 				}
 			}
 		}
+		if sent == 0 { // nothing in flight and no one left to ask
+			return closestNodes, nil
+		}
 	}	
 }
 
@@ -272,8 +700,13 @@ func (node *DhtNode) sendFindIdQuery(entry RoutingEntry, replyChannel chan *Find
 	
 	args := &FindIdArgs{QueryingNodeId: node.NodeId, QueryingIpAddr: node.IpAddr, TargetId: targetId}
 	var reply FindIdReply
-	call(entry.IpAddr, "DhtNode.Find" + targetType + "Handler", args, &reply) //if failed, reply will be empty!
-	
+	if ! node.call(entry.IpAddr, "DhtNode.Find" + targetType + "Handler", args, &reply) {
+		// a call that timed out may still be decoding into
+		// reply, so hand back an empty one instead
+		replyChannel <- &FindIdReply{}
+		return
+	}
+
 	// add reference to reply onto the channel
 	replyChannel <- &reply
 }
@@ -281,16 +714,49 @@ func (node *DhtNode) sendFindIdQuery(entry RoutingEntry, replyChannel chan *Find
 // FindUser RPC API
 // returns IP of username or "" if can't find IP of username
 func (node *DhtNode) FindUser(username string) string {
+	ipAddr, _ := node.LookupUser(username)
+	return ipAddr
+}
+
+// returns IP and public key of username, or "" and nil if
+// username can't be found
+func (node *DhtNode) LookupUser(username string) (string, []byte) {
+	record := node.LookupRecord(username)
+	if record == nil {
+		return "", nil
+	}
+	return record.IpAddr, record.PublicKey
+}
+
+// returns the verified record for username, or nil if it
+// can't be found
+func (node *DhtNode) LookupRecord(username string) *UserRecord {
 	Print(ApiTag, "Node %v calling FindUser on %v", Short(node.NodeId), username)
 	targetId := Sha1(username)
 	//check if have locally
-	ipAddr, exists := node.Kv[targetId]
+	node.mu.Lock()
+	record, exists := node.heldRecord(targetId)
+	node.mu.Unlock()
 	if exists {
-		return ipAddr
-	} 
+		return &record
+	}
 	//do a idLookup to get K closest to username- query them in order of ascending distance until finds username
-	_, ipAddr = node.idLookup(targetId, "User")	
-	return ipAddr
+	_, found := node.idLookup(targetId, "User")
+	if found == nil {
+		return nil
+	}
+	node.mu.Lock()
+	node.pinOwner(targetId, found.TargetRecord)
+	node.mu.Unlock()
+	return found.TargetRecord
+}
+
+// drops our copy of username's record, so the next lookup
+// asks the network for a fresh one
+func (node *DhtNode) forgetRecord(username string) {
+	node.mu.Lock()
+	defer node.mu.Unlock()
+	delete(node.Records, Sha1(username))
 }
 
 //called by user to find NearestNodes to ID
@@ -317,7 +783,7 @@ func (node *DhtNode) Ping(routingEntry RoutingEntry) bool{
 	}
 	args := &PingArgs{QueryingNodeId: node.NodeId, QueryingIpAddr: node.IpAddr}
 	var reply PingReply
-	ok := call(routingEntry.IpAddr, "DhtNode.PingHandler", args, &reply)
+	ok := node.call(routingEntry.IpAddr, "DhtNode.PingHandler", args, &reply)
 	if ok && (reply.QueriedNodeId == routingEntry.NodeId){
 		node.updateRoutingTable(routingEntry) // this is needed for bootstrap
 		return true
@@ -329,6 +795,8 @@ func (node *DhtNode) MakeEmptyRoutingTable() {
 	/*
 		Creates an empty routing table
 	*/
+	node.mu.Lock()
+	defer node.mu.Unlock()
 	var routingTable [IDLen][]RoutingEntry
 	for i, _ := range routingTable {
 		routingTable[i] = make([]RoutingEntry, 0)
@@ -342,6 +810,7 @@ func (node *DhtNode) SetupNode() *rpc.Server{
 	gob.Register(SendMessageReply{})
 	gob.Register(StoreUserArgs{})
 	gob.Register(StoreUserReply{})
+	gob.Register(StoreRoomArgs{})
 	gob.Register(FindIdArgs{})
 	gob.Register(FindIdReply{})
 	gob.Register(PingArgs{})
@@ -362,8 +831,10 @@ func MakeNode(username string, myIpAddr string) *DhtNode{
 	/*
 		Creates a DHTNode with a given username, ip address, and routing table. 
 	*/
-	node := &DhtNode{IpAddr: myIpAddr, NodeId: Sha1(myIpAddr)}
-	node.Kv = make(map[ID]string)
+	node := &DhtNode{IpAddr: myIpAddr, NodeId: Sha1(myIpAddr), transport: DefaultTransport}
+	node.Records = make(map[ID]UserRecord)
+	node.Rooms = make(map[ID]RoomRecord)
+	node.Owners = make(map[ID][]byte)
 	node.MakeEmptyRoutingTable()
 	
 	Print(StartTag, "DHT Node created for username=%s with ip=%s, moving to gob setup...", username, myIpAddr)	
@@ -0,0 +1,207 @@
+package dht
+
+import "encoding/json"
+import "errors"
+import "fmt"
+import "io"
+import "sort"
+import "strings"
+import "time"
+
+const ExportTag = "EXPORT"
+
+// formats ExportConversations can write
+const (
+	ExportJSON = "json" // an Export, the only format ImportConversations reads
+	ExportText = "text" // a transcript for people to read
+	ExportMbox = "mbox" // one mail per message, for mail tools
+)
+
+var ErrUnknownFormat = errors.New("dht: unknown export format")
+var ErrWrongExportUser = errors.New("dht: export belongs to another user")
+
+// what an ExportJSON export holds: every message in the
+// conversations that were exported, keyed on the other user in
+// them and in clock order
+type Export struct {
+	Username string `json:"username"`
+	Conversations map[string][]ExportedMessage `json:"conversations"`
+}
+
+type ExportedMessage struct {
+	MessageIdentifier int64 `json:"id"`
+	Timestamp int64 `json:"timestamp"`
+	Clock int64 `json:"clock,omitempty"`
+	From string `json:"from"`
+	To string `json:"to"`
+	Content string `json:"content"`
+	Status string `json:"status,omitempty"`
+	Edited bool `json:"edited,omitempty"`
+	Deleted bool `json:"deleted,omitempty"`
+	Reactions map[string][]string `json:"reactions,omitempty"`
+}
+
+// returns the messages in each of peers' conversations with us,
+// or all of them if peers is empty, in clock order
+func (user *User) exportConversations(peers []string) Export {
+	user.mu.Lock()
+	defer user.mu.Unlock()
+	if len(peers) == 0 {
+		for peer, _ := range user.MessageHistory {
+			peers = append(peers, peer)
+		}
+	}
+	export := Export{Username: user.Name, Conversations: make(map[string][]ExportedMessage)}
+	for _, peer := range peers {
+		history := copyMessages(user.MessageHistory[peer])
+		sortMessages(history)
+		messages := make([]ExportedMessage, 0, len(history))
+		for _, msg := range history {
+			messages = append(messages, ExportedMessage{MessageIdentifier: msg.MessageIdentifier, Timestamp: msg.Timestamp, Clock: msg.Clock, From: msg.FromUsername, To: msg.ToUsername, Content: msg.Content, Status: msg.Status, Edited: msg.Edited, Deleted: msg.Deleted, Reactions: msg.Reactions})
+		}
+		export.Conversations[peer] = messages
+	}
+	return export
+}
+
+func (user *User) ExportConversations(w io.Writer, format string, peers ...string) error {
+	/*
+		Writes our conversations with peers, or all of
+		them if no peers are given, to w in format, one of
+		ExportJSON, ExportText or ExportMbox. Messages are
+		in clock order and carry their
+		MessageIdentifier, so an ExportJSON export can be
+		merged back in with ImportConversations.
+	*/
+	export := user.exportConversations(peers)
+	Print(ExportTag, "%s exporting %d conversations as %s", user.Name, len(export.Conversations), format)
+	switch format {
+	case ExportJSON:
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(&export)
+	case ExportText:
+		return writeTranscript(w, export)
+	case ExportMbox:
+		return writeMbox(w, export)
+	}
+	return fmt.Errorf("%w: %q", ErrUnknownFormat, format)
+}
+
+// returns the peers in export in a stable order
+func exportedPeers(export Export) []string {
+	peers := make([]string, 0, len(export.Conversations))
+	for peer, _ := range export.Conversations {
+		peers = append(peers, peer)
+	}
+	sort.Strings(peers)
+	return peers
+}
+
+func writeTranscript(w io.Writer, export Export) error {
+	for _, peer := range exportedPeers(export) {
+		if _, err := fmt.Fprintf(w, "== Conversation between %s and %s ==\n", export.Username, peer); err != nil {
+			return err
+		}
+		for _, msg := range export.Conversations[peer] {
+			stamp := time.Unix(msg.Timestamp, 0).UTC().Format(time.RFC3339)
+			content := msg.Content
+			if msg.Deleted {
+				content = "[deleted]"
+			} else if msg.Edited {
+				content += " (edited)"
+			}
+			if _, err := fmt.Fprintf(w, "[%s] <%d> %s: %s\n", stamp, msg.MessageIdentifier, msg.From, content); err != nil {
+				return err
+			}
+		}
+		if _, err := fmt.Fprintln(w); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func writeMbox(w io.Writer, export Export) error {
+	/*
+		Writes one mail per message in the mboxrd layout:
+		each starts with a "From " line, and lines of the
+		body that start with any number of '>' followed by
+		"From " get one more '>' so they can't be mistaken
+		for the start of the next mail.
+	*/
+	for _, peer := range exportedPeers(export) {
+		for _, msg := range export.Conversations[peer] {
+			sent := time.Unix(msg.Timestamp, 0).UTC()
+			header := fmt.Sprintf("From %s %s\nFrom: %s\nTo: %s\nDate: %s\nMessage-ID: <%d@peerchat>\n", msg.From, sent.Format(time.ANSIC), msg.From, msg.To, sent.Format(time.RFC1123Z), msg.MessageIdentifier)
+			if msg.Status != "" {
+				header += fmt.Sprintf("X-Peerchat-Status: %s\n", msg.Status)
+			}
+			if _, err := io.WriteString(w, header + "\n"); err != nil {
+				return err
+			}
+			for _, line := range strings.Split(msg.Content, "\n") {
+				if strings.HasPrefix(strings.TrimLeft(line, ">"), "From ") {
+					line = ">" + line
+				}
+				if _, err := io.WriteString(w, line + "\n"); err != nil {
+					return err
+				}
+			}
+			if _, err := io.WriteString(w, "\n"); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (user *User) ImportConversations(r io.Reader) (int, error) {
+	/*
+		Merges an ExportJSON export of our conversations
+		into our history, skipping messages we already have
+		by MessageIdentifier, and saves a snapshot. Returns
+		how many messages were added, and
+		ErrWrongExportUser if the export is someone else's.
+	*/
+	var export Export
+	if err := json.NewDecoder(r).Decode(&export); err != nil {
+		return 0, err
+	}
+	if export.Username != user.Name {
+		return 0, fmt.Errorf("%w: %s", ErrWrongExportUser, export.Username)
+	}
+
+	added := 0
+	user.mu.Lock()
+	for peer, messages := range export.Conversations {
+		history := user.MessageHistory[peer]
+		known := make(map[int64]bool, len(history))
+		for _, msg := range history {
+			known[msg.MessageIdentifier] = true
+		}
+		for _, msg := range messages {
+			if known[msg.MessageIdentifier] {
+				continue
+			}
+			known[msg.MessageIdentifier] = true
+			imported := &SendMessageArgs{Content: msg.Content, Timestamp: msg.Timestamp, Clock: msg.Clock, ToUsername: msg.To, FromUsername: msg.From, MessageIdentifier: msg.MessageIdentifier, Status: msg.Status, Edited: msg.Edited, Deleted: msg.Deleted, Reactions: msg.Reactions}
+			history = append(history, imported)
+			user.observeClock(peer, imported)
+			user.indexMessage(peer, imported)
+			// so the same message relayed to us later isn't added twice
+			if msg.From != user.Name {
+				user.ReceivedMessageIdentifiers[msg.MessageIdentifier] = true
+			}
+			added++
+		}
+		sortMessages(history)
+		user.MessageHistory[peer] = history
+	}
+	user.mu.Unlock()
+	Print(ExportTag, "%s imported %d messages", user.Name, added)
+
+	// the journal can't describe reordering a history, so take
+	// a snapshot instead
+	return added, user.Serialize()
+}
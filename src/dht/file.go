@@ -0,0 +1,397 @@
+package dht
+
+import "bytes"
+import "crypto/sha256"
+import "encoding/gob"
+import "errors"
+import "fmt"
+import "io"
+import "os"
+import "path/filepath"
+import "strings"
+import "time"
+
+const FileTag = "FILE"
+
+// files are fetched this many bytes at a time. variables so
+// tests can make them small
+var FileChunkSize = 256 * 1024
+
+// files up to this size travel inside their offer, so they can
+// be relayed while the recipient is offline
+var InlineFileLimit int64 = 64 * 1024
+
+// files bigger than this wait for the recipient to AcceptFile
+var AutoAcceptLimit int64 = 16 * 1024 * 1024
+
+// where files we receive are saved, in a directory per sender
+var DownloadDir = filepath.Join(DataDir(), "downloads")
+
+var ErrNotAFile = errors.New("dht: not a regular file")
+var ErrNoSuchTransfer = errors.New("dht: no such file transfer")
+
+// returns the SHA-256 of each chunkSize piece of the file at path,
+// and of the whole file
+func hashChunks(path string, chunkSize int) ([]byte, [][]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+	whole := sha256.New()
+	chunkHashes := make([][]byte, 0)
+	chunk := make([]byte, chunkSize)
+	for {
+		n, err := io.ReadFull(f, chunk)
+		if n > 0 {
+			sum := sha256.Sum256(chunk[:n])
+			chunkHashes = append(chunkHashes, sum[:])
+			whole.Write(chunk[:n])
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		} else if err != nil {
+			return nil, nil, err
+		}
+	}
+	return whole.Sum(nil), chunkHashes, nil
+}
+
+func (user *User) SendFile(username string, path string) error {
+	/*
+		Offers the file at path to username. Small files
+		are sent whole through the sender queue, like a
+		message. For bigger ones only their hashes are sent,
+		and username fetches the file from us while we are
+		both online, so it has to stay at path until then.
+	*/
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if !info.Mode().IsRegular() {
+		return fmt.Errorf("%w: %s", ErrNotAFile, path)
+	}
+
+	attachment := &Attachment{Size: info.Size(), ChunkSize: FileChunkSize}
+	if info.Size() <= InlineFileLimit {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		sum := sha256.Sum256(data)
+		attachment.Size, attachment.Hash, attachment.Data = int64(len(data)), sum[:], data
+	} else if attachment.Hash, attachment.ChunkHashes, err = hashChunks(path, FileChunkSize); err != nil {
+		return err
+	}
+
+	Print(FileTag, "%s offering %s (%d bytes) to %s", user.Name, path, attachment.Size, username)
+	user.mu.Lock()
+	offer := &SendMessageArgs{Content: filepath.Base(path), Timestamp: user.now().Unix(), Clock: user.tick(username), ToUsername: username, FromUsername: user.Name, MessageIdentifier: nrand(), Kind: FileKind, Status: Queued, Attachment: attachment}
+	// our own copy remembers where the file is instead of holding it
+	kept := copyMessage(offer)
+	kept.Attachment.Data = nil
+	kept.Attachment.Path = path
+	user.enqueue(username, offer)
+	user.MessageHistory[username] = append(user.MessageHistory[username], kept)
+	user.indexMessage(username, kept)
+	user.journal(journalEntry{Op: journalPending, Key: username, Message: offer})
+	user.journal(journalEntry{Op: journalHistory, Key: username, Message: kept})
+	user.mu.Unlock()
+	user.flushJournal()
+	return nil
+}
+
+// the parts of an Attachment that only its recipient can see
+type attachmentSecrets struct {
+	Hash []byte
+	ChunkHashes [][]byte
+	Data []byte
+}
+
+// returns the copy of attachment that travels, with its hashes
+// and data sealed for publicKey and bound to additionalData
+func sealAttachment(attachment *Attachment, publicKey []byte, additionalData []byte) (*Attachment, error) {
+	var buf bytes.Buffer
+	secrets := attachmentSecrets{Hash: attachment.Hash, ChunkHashes: attachment.ChunkHashes, Data: attachment.Data}
+	if err := gob.NewEncoder(&buf).Encode(secrets); err != nil {
+		return nil, err
+	}
+	sealed, err := Seal(publicKey, buf.Bytes(), additionalData)
+	if err != nil {
+		return nil, err
+	}
+	return &Attachment{Size: attachment.Size, ChunkSize: attachment.ChunkSize, Sealed: sealed}, nil
+}
+
+// puts back in place what sealAttachment sealed
+func (keys *KeyPair) openAttachment(attachment *Attachment, additionalData []byte) error {
+	plaintext, err := keys.Open(attachment.Sealed, additionalData)
+	if err != nil {
+		return err
+	}
+	var secrets attachmentSecrets
+	if err := gob.NewDecoder(bytes.NewReader(plaintext)).Decode(&secrets); err != nil {
+		return fmt.Errorf("%w: %v", ErrDecrypt, err)
+	}
+	attachment.Hash, attachment.ChunkHashes, attachment.Data = secrets.Hash, secrets.ChunkHashes, secrets.Data
+	attachment.Sealed = nil
+	return nil
+}
+
+// reports whether an attachment describes a file we can fetch
+func (attachment *Attachment) valid() bool {
+	if attachment.Size < 0 || attachment.ChunkSize <= 0 || len(attachment.Hash) != sha256.Size {
+		return false
+	}
+	if len(attachment.ChunkHashes) == 0 {
+		return int64(len(attachment.Data)) == attachment.Size
+	}
+	chunks := (attachment.Size + int64(attachment.ChunkSize) - 1) / int64(attachment.ChunkSize)
+	return attachment.Data == nil && int64(len(attachment.ChunkHashes)) == chunks
+}
+
+// called by SendMessageHandler with user.mu held, before the
+// offer is added to our history
+func (user *User) receiveFile(offer *SendMessageArgs) {
+	if offer.Attachment == nil {
+		offer.Attachment = &Attachment{}
+	}
+	attachment := offer.Attachment
+	// these are ours to keep, whatever the sender says
+	attachment.Path, attachment.Received = "", 0
+	if offer.DecryptFailed || !attachment.valid() {
+		attachment.State = FileFailed
+	} else if attachment.Size <= AutoAcceptLimit {
+		attachment.State = FileDownloading
+	} else {
+		attachment.State = FileOffered
+	}
+	Print(FileTag, "%s was offered %s (%d bytes) by %s, it is %s", user.Name, offer.Content, attachment.Size, offer.FromUsername, attachment.State)
+}
+
+// starts fetching a file from peer that was too big to fetch
+// without asking
+func (user *User) AcceptFile(peer string, messageIdentifier int64) error {
+	user.mu.Lock()
+	msg := user.findMessage(peer, messageIdentifier)
+	if msg == nil || msg.FromUsername != peer || msg.Attachment == nil || msg.Attachment.State != FileOffered {
+		user.mu.Unlock()
+		return fmt.Errorf("%w: %v from %s", ErrNoSuchTransfer, messageIdentifier, peer)
+	}
+	msg.Attachment.State = FileDownloading
+	user.journal(journalEntry{Op: journalTransfer, Key: peer, Ref: messageIdentifier, Message: msg})
+	user.notify(msg)
+	user.mu.Unlock()
+	user.flushJournal()
+	return nil
+}
+
+// binds a sealed chunk to the file and place it was fetched for
+func (args *FetchChunkArgs) headerBytes() []byte {
+	return signedFields([][]byte{[]byte(args.Username), []byte(fmt.Sprint(args.Index))}, args.MessageIdentifier)
+}
+
+func (user *User) FetchChunkHandler(args *FetchChunkArgs, reply *FetchChunkReply) error {
+	/*
+		Reads chunk Index of a file we offered to
+		args.Username and seals it for them, so it doesn't
+		matter who asks for it.
+	*/
+	user.mu.Lock()
+	msg := user.findMessage(args.Username, args.MessageIdentifier)
+	if msg == nil || msg.FromUsername != user.Name || msg.Attachment == nil || msg.Attachment.Path == "" {
+		user.mu.Unlock()
+		return ErrNoSuchTransfer
+	}
+	attachment := *msg.Attachment
+	user.mu.Unlock()
+	if args.Index < 0 || args.Index >= len(attachment.ChunkHashes) {
+		return ErrNoSuchTransfer
+	}
+
+	_, publicKey := user.Node.LookupUser(args.Username)
+	if len(publicKey) == 0 {
+		return fmt.Errorf("no public key for %s", args.Username)
+	}
+	f, err := os.Open(attachment.Path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	chunk := make([]byte, attachment.ChunkSize)
+	n, err := f.ReadAt(chunk, int64(args.Index) * int64(attachment.ChunkSize))
+	if err != nil && err != io.EOF {
+		return err
+	}
+	reply.Sealed, err = Seal(publicKey, chunk[:n], args.headerBytes())
+	return err
+}
+
+func (user *User) startDownloader() {
+	/*
+		Saves the files we are receiving, fetching the
+		chunks of big ones from their senders. Progress is
+		saved after every chunk, so a transfer picks up
+		where it left off after either of us goes offline.
+	*/
+	for user.sleep(250 * time.Millisecond) {
+		for _, offer := range user.downloads() {
+			user.download(offer)
+		}
+	}
+}
+
+// returns copies of the offers of the files we are downloading
+func (user *User) downloads() []*SendMessageArgs {
+	user.mu.Lock()
+	defer user.mu.Unlock()
+	offers := make([]*SendMessageArgs, 0)
+	for peer, messages := range user.MessageHistory {
+		for _, msg := range messages {
+			if msg.FromUsername == peer && msg.Attachment != nil && msg.Attachment.State == FileDownloading && !msg.Deleted {
+				offers = append(offers, copyMessage(msg))
+			}
+		}
+	}
+	return offers
+}
+
+// records how far we have got with offer, and lets the UI know
+func (user *User) updateTransfer(offer *SendMessageArgs) {
+	user.mu.Lock()
+	if msg := user.findMessage(offer.FromUsername, offer.MessageIdentifier); msg != nil {
+		attachmentCopy := *offer.Attachment
+		msg.Attachment = &attachmentCopy
+		user.journal(journalEntry{Op: journalTransfer, Key: offer.FromUsername, Ref: offer.MessageIdentifier, Message: msg})
+		user.notify(msg)
+	}
+	user.mu.Unlock()
+	user.flushJournal()
+}
+
+// returns a path in DownloadDir to save a file peer sent us as
+// name, which must not be allowed to point anywhere else
+func downloadPath(peer string, name string) (string, error) {
+	dir := filepath.Join(DownloadDir, escapeUsername(peer))
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", err
+	}
+	base := filepath.Base(strings.ReplaceAll(name, "\\", "/"))
+	if base == "." || base == ".." || base == "/" {
+		base = "file"
+	}
+	ext := filepath.Ext(base)
+	candidate := base
+	for i := 1; ; i++ {
+		_, err := os.Stat(filepath.Join(dir, candidate))
+		_, partialErr := os.Stat(filepath.Join(dir, candidate) + ".part")
+		if os.IsNotExist(err) && os.IsNotExist(partialErr) {
+			return filepath.Join(dir, candidate), nil
+		}
+		candidate = fmt.Sprintf("%s (%d)%s", strings.TrimSuffix(base, ext), i, ext)
+	}
+}
+
+func (user *User) download(offer *SendMessageArgs) {
+	/*
+		Saves as much of the file offered by offer as we can
+		get right now into Path.part, and renames it to Path
+		once it is whole and matches its Hash. Returns early,
+		to be called again later, if the sender is offline.
+	*/
+	peer, attachment := offer.FromUsername, offer.Attachment
+	if attachment.Path == "" {
+		path, err := downloadPath(peer, offer.Content)
+		if err != nil {
+			Print(FileTag, "%s has nowhere to save %s: %v", user.Name, offer.Content, err)
+			return
+		}
+		attachment.Path = path
+		user.updateTransfer(offer)
+	}
+	partial := attachment.Path + ".part"
+	f, err := os.OpenFile(partial, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		Print(FileTag, "%s could not open %s: %v", user.Name, partial, err)
+		return
+	}
+	defer f.Close()
+
+	fail := func(reason string) {
+		Print(FileTag, "%s giving up on %s from %s: %s", user.Name, offer.Content, peer, reason)
+		os.Remove(partial)
+		attachment.State = FileFailed
+		user.updateTransfer(offer)
+	}
+
+	if len(attachment.ChunkHashes) == 0 {
+		if _, err := f.WriteAt(attachment.Data, 0); err != nil {
+			Print(FileTag, "%s could not write %s: %v", user.Name, partial, err)
+			return
+		}
+		attachment.Data = nil
+		attachment.Received = attachment.Size
+	} else {
+		ip, _ := user.Node.LookupUser(peer)
+		if ip == "" {
+			return
+		}
+		chunkSize := int64(attachment.ChunkSize)
+		for index := attachment.Received / chunkSize; index < int64(len(attachment.ChunkHashes)); index++ {
+			if user.isDead() {
+				return
+			}
+			args := FetchChunkArgs{Username: user.Name, MessageIdentifier: offer.MessageIdentifier, Index: int(index)}
+			var reply FetchChunkReply
+			if ! user.Node.call(ip, "User.FetchChunkHandler", &args, &reply) {
+				return
+			}
+			chunk, err := user.Keys.Open(reply.Sealed, args.headerBytes())
+			if err != nil {
+				fail(fmt.Sprintf("chunk %d could not be decrypted", index))
+				return
+			}
+			sum := sha256.Sum256(chunk)
+			if !bytes.Equal(sum[:], attachment.ChunkHashes[index]) {
+				fail(fmt.Sprintf("chunk %d doesn't match its hash", index))
+				return
+			}
+			if _, err := f.WriteAt(chunk, index * chunkSize); err != nil {
+				Print(FileTag, "%s could not write %s: %v", user.Name, partial, err)
+				return
+			}
+			attachment.Received = index * chunkSize + int64(len(chunk))
+			user.updateTransfer(offer)
+		}
+	}
+
+	// a crash can leave more than we were sent in the file
+	if err := f.Truncate(attachment.Size); err != nil {
+		Print(FileTag, "%s could not write %s: %v", user.Name, partial, err)
+		return
+	}
+	whole := sha256.New()
+	if _, err := io.Copy(whole, io.NewSectionReader(f, 0, attachment.Size)); err != nil {
+		Print(FileTag, "%s could not read back %s: %v", user.Name, partial, err)
+		return
+	}
+	if !bytes.Equal(whole.Sum(nil), attachment.Hash) {
+		fail("the file doesn't match its hash")
+		return
+	}
+	if err := f.Sync(); err != nil {
+		return
+	}
+	if err := os.Rename(partial, attachment.Path); err != nil {
+		Print(FileTag, "%s could not save %s: %v", user.Name, attachment.Path, err)
+		return
+	}
+	Print(FileTag, "%s saved %s from %s at %s", user.Name, offer.Content, peer, attachment.Path)
+	attachment.State = FileComplete
+	user.updateTransfer(offer)
+}
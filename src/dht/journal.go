@@ -0,0 +1,225 @@
+package dht
+
+import "bytes"
+import "encoding/binary"
+import "encoding/gob"
+import "hash/crc32"
+
+const JournalTag = "JOURNAL"
+
+// once this many entries have been written since the last
+// snapshot, the journal is compacted into a new one. a variable
+// so tests can shorten it
+var CompactAfter = 1000
+
+// the changes to a user that are written to its journal
+const (
+	journalSeen = iota + 1 // Ref was received
+	journalHistory // Message was added to MessageHistory[Key]
+	journalRoomHistory // Message was added to RoomHistory[Key]
+	journalPending // Message was queued in PendingMessages[Key]
+	journalDropPending // Ref was removed from PendingMessages[Key]
+	journalStatus // message Ref in MessageHistory[Key] moved to Status
+	journalRoom // we learned we are in room Key
+	journalChange // the edit, deletion or reaction Message was made to a message in MessageHistory[Key]
+	journalTransfer // the file offered by message Ref in MessageHistory[Key] got to Message.Attachment
+	journalLeftRoom // we were removed from room Key
+)
+
+// one change to a user since its last snapshot. Seq counts up
+// from the snapshot's JournalSeq, so entries a snapshot already
+// includes are skipped when the journal is replayed
+type journalEntry struct {
+	Seq int64
+	Op int
+	Key string
+	Ref int64
+	Status string
+	Message *SendMessageArgs
+	Room RoomRecord
+}
+
+// journal records are laid out as:
+//	payload length | CRC-32 of payload | gob encoded journalEntry
+// with the payload sealed by the user's passphrase key if they
+// have one
+const journalHeaderLen = 8
+
+func encodeJournal(entries []journalEntry, key *passphraseKey) ([]byte, error) {
+	var buf bytes.Buffer
+	for i := range entries {
+		var encoded bytes.Buffer
+		if err := gob.NewEncoder(&encoded).Encode(&entries[i]); err != nil {
+			return nil, err
+		}
+		payload := encoded.Bytes()
+		if key != nil {
+			var err error
+			if payload, err = key.seal(payload); err != nil {
+				return nil, err
+			}
+		}
+		header := make([]byte, 0, journalHeaderLen)
+		header = binary.BigEndian.AppendUint32(header, uint32(len(payload)))
+		header = binary.BigEndian.AppendUint32(header, crc32.ChecksumIEEE(payload))
+		buf.Write(header)
+		buf.Write(payload)
+	}
+	return buf.Bytes(), nil
+}
+
+func decodeJournal(data []byte, key *passphraseKey) ([]journalEntry, bool) {
+	/*
+		Decodes the records in data, in order. A crash part
+		way through an append leaves a short or garbled record
+		at the end, so decoding stops at the first record that
+		is cut off, fails its checksum or can't be opened with
+		key, and returns false along with every entry before it.
+	*/
+	entries := make([]journalEntry, 0)
+	for len(data) > 0 {
+		if len(data) < journalHeaderLen {
+			return entries, false
+		}
+		length := binary.BigEndian.Uint32(data[0:4])
+		checksum := binary.BigEndian.Uint32(data[4:8])
+		data = data[journalHeaderLen:]
+		if uint64(len(data)) < uint64(length) || crc32.ChecksumIEEE(data[:length]) != checksum {
+			return entries, false
+		}
+		payload := data[:length]
+		if key != nil {
+			var err error
+			if payload, err = key.open(payload); err != nil {
+				return entries, false
+			}
+		}
+		var entry journalEntry
+		if err := gob.NewDecoder(bytes.NewReader(payload)).Decode(&entry); err != nil {
+			return entries, false
+		}
+		entries = append(entries, entry)
+		data = data[length:]
+	}
+	return entries, true
+}
+
+// queues entry to be written by the next flushJournal. must be
+// called with user.mu held, right after the change it describes
+func (user *User) journal(entry journalEntry) {
+	if entry.Message != nil {
+		// the message can change before it is written
+		entry.Message = copyMessage(entry.Message)
+	}
+	user.JournalSeq++
+	entry.Seq = user.JournalSeq
+	user.unjournaled = append(user.unjournaled, entry)
+}
+
+func (user *User) flushJournal() {
+	/*
+		Appends the entries queued since the last flush to
+		our journal, then compacts it into a snapshot if it
+		has grown past CompactAfter entries. Writing takes
+		time proportional to the new entries, not to our
+		whole history.
+	*/
+	user.journalMu.Lock()
+	user.mu.Lock()
+	entries := user.unjournaled
+	user.unjournaled = nil
+	user.mu.Unlock()
+
+	if len(entries) == 0 {
+		user.journalMu.Unlock()
+		return
+	}
+	data, err := encodeJournal(entries, user.profileKey)
+	if err == nil {
+		err = user.GetStorage().Append(user.Name, data)
+	}
+	if err != nil {
+		// try again with the next flush
+		Print(JournalTag, "%s could not write %d journal entries: %v", user.Name, len(entries), err)
+		user.mu.Lock()
+		user.unjournaled = append(entries, user.unjournaled...)
+		user.mu.Unlock()
+		user.journalMu.Unlock()
+		return
+	}
+	user.journaled += len(entries)
+	compact := user.journaled >= CompactAfter
+	user.journalMu.Unlock()
+
+	if compact {
+		Print(JournalTag, "%s compacting its journal", user.Name)
+		user.persist()
+	}
+}
+
+func (user *User) replayJournal() {
+	/*
+		Called when a user is loaded, with the snapshot
+		already decoded. Applies the journal entries written
+		after the snapshot was taken, so changes since then
+		survive a crash.
+	*/
+	data, err := user.GetStorage().LoadJournal(user.Name)
+	if err != nil {
+		Print(JournalTag, "%s could not read its journal: %v", user.Name, err)
+		return
+	}
+	entries, complete := decodeJournal(data, user.profileKey)
+	if !complete {
+		Print(JournalTag, "%s journal ends with a damaged entry, replaying the %d before it", user.Name, len(entries))
+	}
+	user.mu.Lock()
+	defer user.mu.Unlock()
+	for i := range entries {
+		if entries[i].Seq <= user.JournalSeq {
+			continue
+		}
+		user.applyJournalEntry(&entries[i])
+		user.JournalSeq = entries[i].Seq
+	}
+}
+
+// must be called with user.mu held
+func (user *User) applyJournalEntry(entry *journalEntry) {
+	switch entry.Op {
+	case journalSeen:
+		user.ReceivedMessageIdentifiers[entry.Ref] = true
+	case journalHistory:
+		user.MessageHistory[entry.Key] = append(user.MessageHistory[entry.Key], entry.Message)
+		user.observeClock(entry.Key, entry.Message)
+		user.indexMessage(entry.Key, entry.Message)
+		user.applyOrphans(entry.Key, entry.Message)
+	case journalRoomHistory:
+		user.RoomHistory[entry.Key] = append(user.RoomHistory[entry.Key], entry.Message)
+		user.observeClock(roomClock(entry.Key), entry.Message)
+	case journalPending:
+		if !user.isPending(entry.Key, entry.Message.MessageIdentifier) {
+			user.PendingMessages[entry.Key] = append(user.PendingMessages[entry.Key], entry.Message)
+		}
+	case journalDropPending:
+		user.dropPending(entry.Key, entry.Ref)
+	case journalStatus:
+		if msg := user.findMessage(entry.Key, entry.Ref); msg != nil {
+			user.setStatus(msg, entry.Status)
+		}
+	case journalRoom:
+		if _, known := user.Rooms[entry.Key]; !known {
+			user.Rooms[entry.Key] = entry.Room
+		}
+	case journalLeftRoom:
+		delete(user.Rooms, entry.Key)
+	case journalChange:
+		user.applyChange(entry.Key, entry.Message)
+	case journalTransfer:
+		if msg := user.findMessage(entry.Key, entry.Ref); msg != nil {
+			msg.Attachment = entry.Message.Attachment
+		}
+	default:
+		Print(JournalTag, "%s skipping journal entry with unknown op %d", user.Name, entry.Op)
+	}
+}
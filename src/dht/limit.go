@@ -0,0 +1,208 @@
+package dht
+
+import "bufio"
+import "encoding/gob"
+import "errors"
+import "fmt"
+import "io"
+import "net"
+import "net/rpc"
+import "sort"
+import "sync"
+import "time"
+
+const LimitTag = "LIMIT"
+
+// how fast someone may call us: Burst calls straight away, then
+// PerSecond calls a second. a PerSecond of 0 is no limit
+type RateLimit struct {
+	PerSecond float64
+	Burst float64
+}
+
+// Limits on what other nodes can make us do, variables so they
+// can be configured and tests can tighten them.
+var (
+	SenderLimit = RateLimit{PerSecond: 20, Burst: 200} // messages from each sender whose signature checks out
+	SourceLimit = RateLimit{PerSecond: 100, Burst: 1000} // RPCs of any kind from each remote address
+	RelayQuota = 500 // relayed messages we hold for any one recipient
+)
+
+var ErrRateLimited = errors.New("dht: too many requests, slow down")
+var ErrRelayQuota = errors.New("dht: holding too many messages for this recipient")
+
+// token buckets for the keys being limited
+type limiter struct {
+	mu sync.Mutex
+	buckets map[string]*bucket
+}
+
+type bucket struct {
+	tokens float64
+	last time.Time
+}
+
+// forget buckets that have filled back up once there are this many
+const limiterPruneAt = 4096
+
+func newLimiter() *limiter {
+	return &limiter{buckets: make(map[string]*bucket)}
+}
+
+// takes one call from key's bucket, returns false if it is empty
+func (l *limiter) allow(key string, limit RateLimit) bool {
+	if limit.PerSecond <= 0 {
+		return true
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	b, exists := l.buckets[key]
+	if !exists {
+		if len(l.buckets) >= limiterPruneAt {
+			l.prune(now, limit)
+		}
+		b = &bucket{tokens: limit.Burst, last: now}
+		l.buckets[key] = b
+	}
+	b.tokens += now.Sub(b.last).Seconds() * limit.PerSecond
+	if b.tokens > limit.Burst {
+		b.tokens = limit.Burst
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// drops the buckets that would be full by now, which behave the
+// same as ones that don't exist. must be called with l.mu held
+func (l *limiter) prune(now time.Time, limit RateLimit) {
+	for key, b := range l.buckets {
+		if b.tokens + now.Sub(b.last).Seconds() * limit.PerSecond >= limit.Burst {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// the address SourceLimit applies to for a connection from addr
+func sourceOf(addr net.Addr) string {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		// an address without a port
+		return addr.String()
+	}
+	return host
+}
+
+// returns true if we serve another RPC from addr
+func (user *User) allowSource(addr net.Addr) bool {
+	source := sourceOf(addr)
+	if user.sources.allow(source, SourceLimit) {
+		return true
+	}
+	Print(LimitTag, "%s refusing an RPC from %s", user.Name, source)
+	return false
+}
+
+// serves RPCs read from conn, charging each one to SourceLimit.
+// the connection is dropped at the first one refused, so holding
+// it open doesn't get round the limit
+func (user *User) serveConn(rpcs *rpc.Server, conn net.Conn) {
+	buf := bufio.NewWriter(conn)
+	rpcs.ServeCodec(&limitedCodec{
+		user: user,
+		addr: conn.RemoteAddr(),
+		rwc: conn,
+		dec: gob.NewDecoder(conn),
+		enc: gob.NewEncoder(buf),
+		encBuf: buf,
+	})
+}
+
+// the gob codec net/rpc serves connections with, with the
+// source of each request checked against SourceLimit
+type limitedCodec struct {
+	user *User
+	addr net.Addr
+	rwc io.ReadWriteCloser
+	dec *gob.Decoder
+	enc *gob.Encoder
+	encBuf *bufio.Writer
+}
+
+func (c *limitedCodec) ReadRequestHeader(r *rpc.Request) error {
+	if err := c.dec.Decode(r); err != nil {
+		return err
+	}
+	if !c.user.allowSource(c.addr) {
+		return fmt.Errorf("%w: %s", ErrRateLimited, sourceOf(c.addr))
+	}
+	return nil
+}
+
+func (c *limitedCodec) ReadRequestBody(body interface{}) error {
+	return c.dec.Decode(body)
+}
+
+func (c *limitedCodec) WriteResponse(r *rpc.Response, body interface{}) error {
+	if err := c.enc.Encode(r); err != nil {
+		return err
+	}
+	if err := c.enc.Encode(body); err != nil {
+		return err
+	}
+	return c.encBuf.Flush()
+}
+
+func (c *limitedCodec) Close() error {
+	return c.rwc.Close()
+}
+
+// returns ErrRateLimited if username has sent us more than
+// SenderLimit allows
+func (user *User) allowSender(username string) error {
+	if user.senders.allow(username, SenderLimit) {
+		return nil
+	}
+	Print(LimitTag, "%s refusing a message from %s", user.Name, username)
+	return fmt.Errorf("%w: %s", ErrRateLimited, username)
+}
+
+// drops messages, signals and presence subscriptions from
+// username, and stops telling them about our presence
+func (user *User) Block(username string) {
+	user.mu.Lock()
+	user.Blocked[username] = true
+	delete(user.subscribers, username)
+	user.mu.Unlock()
+	Print(LimitTag, "%s blocked %s", user.Name, username)
+	user.persist()
+}
+
+func (user *User) Unblock(username string) {
+	user.mu.Lock()
+	delete(user.Blocked, username)
+	user.mu.Unlock()
+	user.persist()
+}
+
+func (user *User) IsBlocked(username string) bool {
+	user.mu.Lock()
+	defer user.mu.Unlock()
+	return user.Blocked[username]
+}
+
+// returns the users we have blocked, in order
+func (user *User) BlockList() []string {
+	user.mu.Lock()
+	defer user.mu.Unlock()
+	blocked := make([]string, 0, len(user.Blocked))
+	for username := range user.Blocked {
+		blocked = append(blocked, username)
+	}
+	sort.Strings(blocked)
+	return blocked
+}
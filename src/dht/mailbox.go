@@ -0,0 +1,217 @@
+package dht
+
+import "crypto/ed25519"
+import "math/rand"
+import "sync"
+import "time"
+
+const MailTag = "MAIL"
+
+// Holding messages for users who are offline, variables so
+// they can be configured and tests can shorten them.
+var (
+	RelayTTL = 7 * 24 * time.Hour // relayed messages are dropped this long after we took them
+	MailboxSize = 10000 // relayed messages we hold for everyone together, see RelayQuota for each recipient
+	MailRetryMin = 50 * time.Millisecond // how soon we first try again to reach a recipient who is offline
+	MailRetryMax = 30 * time.Second // the longest we wait between tries, doubling from MailRetryMin
+)
+
+// how long a PullMailArgs is good for after it is signed
+const mailPullWindow = time.Minute
+
+// when we next try a recipient we couldn't reach, how long we
+// waited before that, and which of their messages we have already
+// left with the nodes closest to them
+type retry struct {
+	delay time.Duration
+	next time.Time
+	attempts int
+	relayed map[int64]bool
+	publicKey []byte // their key when we last found them, to seal what we leave with relays
+	queued bool // something was queued for them since we last tried
+}
+
+// returns true if it's time to try username's queue. must be
+// called with user.mu held
+func (user *User) retryDue(username string) bool {
+	r, backingOff := user.retries[username]
+	return !backingOff || !time.Now().Before(r.next)
+}
+
+// returns username's retry state, creating it if there is none.
+// must be called with user.mu held
+func (user *User) retryState(username string) *retry {
+	r, backingOff := user.retries[username]
+	if !backingOff {
+		r = &retry{relayed: make(map[int64]bool)}
+		user.retries[username] = r
+	}
+	return r
+}
+
+// doubles how long we wait before trying username again, up to
+// MailRetryMax, and picks a time at random in the second half
+// of that wait so senders who lost them together don't all come
+// back at once
+func (user *User) backOff(username string) {
+	user.mu.Lock()
+	defer user.mu.Unlock()
+	r := user.retryState(username)
+	if r.delay == 0 {
+		r.delay = MailRetryMin / 2
+	}
+	r.delay *= 2
+	if r.delay > MailRetryMax {
+		r.delay = MailRetryMax
+	}
+	r.attempts++
+	user.sendStats.Failures++
+	if r.queued {
+		// what was queued while we were trying hasn't been tried
+		return
+	}
+	r.next = time.Now().Add(jitter(r.delay))
+}
+
+// returns a random duration between d/2 and d
+func jitter(d time.Duration) time.Duration {
+	return d/2 + time.Duration(rand.Int63n(int64(d/2) + 1))
+}
+
+// tries username's queue on the next pass, something new was
+// queued for them. if they were away we keep backing off from
+// where we were. must be called with user.mu held
+func (user *User) retryNow(username string) {
+	r := user.retryState(username)
+	r.next, r.queued = time.Time{}, true
+	user.wakeSender()
+}
+
+// forgets that username was away and tries their queue on the
+// next pass, we have just heard from them. must be called with
+// user.mu held
+func (user *User) resetRetry(username string) {
+	// marked queued, so a try already under way doesn't back off
+	user.retries[username] = &retry{relayed: make(map[int64]bool), queued: true}
+	user.wakeSender()
+}
+
+// returns true if it's time to try username's queue, dropping
+// the messages we relay for them that have outlived RelayTTL
+func (user *User) mailDue(username string) bool {
+	user.mu.Lock()
+	if !user.retryDue(username) {
+		user.mu.Unlock()
+		return false
+	}
+	if r, backingOff := user.retries[username]; backingOff {
+		r.queued = false
+	}
+	expired := 0
+	kept := make([]*SendMessageArgs, 0, len(user.PendingMessages[username]))
+	for _, msg := range user.PendingMessages[username] {
+		if msg.Relayed && msg.HeldSince == 0 {
+			// held since before relayed messages were stamped
+			msg.HeldSince = time.Now().Unix()
+		}
+		if msg.Relayed && time.Since(time.Unix(msg.HeldSince, 0)) > RelayTTL {
+			user.journal(journalEntry{Op: journalDropPending, Key: username, Ref: msg.MessageIdentifier})
+			expired++
+			continue
+		}
+		kept = append(kept, msg)
+	}
+	user.PendingMessages[username] = kept
+	user.mu.Unlock()
+	if expired > 0 {
+		Print(MailTag, "%s dropped %d expired message(s) held for %s", user.Name, expired, username)
+		user.flushJournal()
+	}
+	return true
+}
+
+// returns how many messages we hold for anyone on behalf of
+// others. must be called with user.mu held
+func (user *User) relayedTotal() int {
+	relayed := 0
+	for username := range user.PendingMessages {
+		relayed += user.relayedFor(username)
+	}
+	return relayed
+}
+
+func (args *PullMailArgs) signedBytes() []byte {
+	return signedFields([][]byte{[]byte(args.Username)}, args.Seq)
+}
+
+func (user *User) PullMailHandler(args *PullMailArgs, reply *PullMailReply) error {
+	/*
+		Returns everything we hold for args.Username, if
+		they signed args in the last minute: the messages we
+		relay for them and the ones we sent them ourselves,
+		sealed for them. We keep our copies until they are
+		delivered, and try to deliver them straight away.
+	*/
+	record := user.Node.LookupRecord(args.Username)
+	if record == nil || len(record.SigningKey) != ed25519.PublicKeySize || time.Since(time.Unix(0, args.Seq)) > mailPullWindow || !ed25519.Verify(record.SigningKey, args.signedBytes(), args.Signature) {
+		Print(MailTag, "%s refusing to hand over mail for %s", user.Name, args.Username)
+		return ErrBadSignature
+	}
+	user.mu.Lock()
+	held := copyMessages(user.PendingMessages[args.Username])
+	user.resetRetry(args.Username)
+	user.mu.Unlock()
+
+	reply.Messages = make([]SendMessageArgs, 0, len(held))
+	for _, msg := range held {
+		if wire, sealed := user.sealMessage(*msg, record.PublicKey); sealed {
+			wire.Relayed = true
+			reply.Messages = append(reply.Messages, wire)
+		}
+	}
+	Print(MailTag, "%s handing %d message(s) to %s", user.Name, len(reply.Messages), args.Username)
+	return nil
+}
+
+func (user *User) pullMail() {
+	/*
+		Collects the messages held for us by the nodes
+		closest to our username, which is where senders
+		leave them while we are offline. Each is taken as
+		if it had been relayed to us, so its sender hears
+		it was delivered.
+	*/
+	nearest := user.Node.FindNearestNodes(Sha1(user.Name))
+	args := PullMailArgs{Username: user.Name, Seq: time.Now().UnixNano()}
+	args.Signature = ed25519.Sign(user.Keys.SignPrivate, args.signedBytes())
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	mail := make([]SendMessageArgs, 0)
+	for _, entryDist := range nearest {
+		if entryDist.RoutingEntry.IpAddr == user.Node.IpAddr {
+			continue
+		}
+		wg.Add(1)
+		go func(ipAddr string) {
+			defer wg.Done()
+			var reply PullMailReply
+			if user.Node.call(ipAddr, "User.PullMailHandler", &args, &reply) {
+				mu.Lock()
+				mail = append(mail, reply.Messages...)
+				mu.Unlock()
+			}
+		}(entryDist.RoutingEntry.IpAddr)
+	}
+	wg.Wait()
+
+	delivered := 0
+	for i := range mail {
+		if mail[i].ToUsername != user.Name {
+			continue
+		}
+		user.receiveMessage(&mail[i], &SendMessageReply{})
+		delivered++
+	}
+	Print(MailTag, "%s collected %d message(s) from %d node(s)", user.Name, delivered, len(nearest))
+}
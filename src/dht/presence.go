@@ -0,0 +1,286 @@
+package dht
+
+import "crypto/ed25519"
+import "errors"
+import "fmt"
+import "sync"
+import "time"
+
+const PresenceTag = "PRESENCE"
+
+// how often we renew our subscriptions to the presence of the
+// users we watch. Subscriptions that aren't renewed for three
+// times this are dropped, and a user whose node can't be reached
+// when we try is shown as Offline. a variable so tests can
+// shorten it
+var PresenceEvery = 30 * time.Second
+
+// how long a SubscribePresenceArgs is good for after it is signed
+const subscribeWindow = time.Minute
+
+var ErrBadPresence = errors.New("dht: presence must be Online, Away or Busy")
+var ErrUnknownUser = errors.New("dht: user could not be found")
+
+func MakePresenceRecord(username string, state string, text string, keys *KeyPair) PresenceRecord {
+	now := time.Now()
+	presence := PresenceRecord{Username: username, State: state, Text: text, LastSeen: now.Unix(), Seq: now.UnixNano()}
+	presence.Signature = ed25519.Sign(keys.SignPrivate, presence.signedBytes())
+	return presence
+}
+
+func (presence *PresenceRecord) signedBytes() []byte {
+	fields := [][]byte{[]byte(presence.Username), []byte(presence.State), []byte(presence.Text), []byte(fmt.Sprint(presence.LastSeen))}
+	return signedFields(fields, presence.Seq)
+}
+
+// returns true if presence was signed by signingKey, the key in
+// its owner's UserRecord
+func (presence *PresenceRecord) Verify(signingKey []byte) bool {
+	if len(signingKey) != ed25519.PublicKeySize {
+		return false
+	}
+	return ed25519.Verify(signingKey, presence.signedBytes(), presence.Signature)
+}
+
+// someone watching our presence, and when their subscription
+// runs out unless they renew it
+type subscriber struct {
+	IpAddr string
+	Expires time.Time
+}
+
+// returns our presence as we would tell a watcher right now.
+// must be called with user.mu held
+func (user *User) presenceRecord() PresenceRecord {
+	state := user.PresenceState
+	if state == "" {
+		state = Online
+	}
+	return MakePresenceRecord(user.Name, state, user.PresenceText, user.Keys)
+}
+
+func (user *User) Presence() PresenceRecord {
+	user.mu.Lock()
+	defer user.mu.Unlock()
+	return user.presenceRecord()
+}
+
+func (user *User) SetPresence(state string, text string) error {
+	/*
+		Changes what we tell the users watching us, and
+		tells the ones subscribed right now straight away.
+		The presence is saved, so it is kept when we log
+		back in.
+	*/
+	if state != Online && state != Away && state != Busy {
+		return fmt.Errorf("%w: %q", ErrBadPresence, state)
+	}
+	user.mu.Lock()
+	user.PresenceState, user.PresenceText = state, text
+	presence := user.presenceRecord()
+	user.mu.Unlock()
+	Print(PresenceTag, "%s is now %s %q", user.Name, state, text)
+	user.persist()
+	user.pushPresence(presence, user.spawn)
+	return nil
+}
+
+// sends presence to everyone subscribed to us, each from a
+// goroutine started with start
+func (user *User) pushPresence(presence PresenceRecord, start func(f func())) {
+	user.mu.Lock()
+	targets := make([]string, 0, len(user.subscribers))
+	for _, sub := range user.subscribers {
+		if time.Now().Before(sub.Expires) {
+			targets = append(targets, sub.IpAddr)
+		}
+	}
+	user.mu.Unlock()
+	for _, ipAddr := range targets {
+		ipAddr := ipAddr
+		start(func() {
+			var reply PresenceReply
+			user.Node.call(ipAddr, "User.PresenceHandler", &presence, &reply)
+		})
+	}
+}
+
+// tells our subscribers we are going offline. called once, by
+// Logoff, before our goroutines are stopped
+func (user *User) announceOffline() {
+	user.mu.Lock()
+	presence := MakePresenceRecord(user.Name, Offline, user.PresenceText, user.Keys)
+	user.mu.Unlock()
+	var wg sync.WaitGroup
+	user.pushPresence(presence, func(f func()) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			f()
+		}()
+	})
+	wg.Wait()
+}
+
+func (args *SubscribePresenceArgs) signedBytes() []byte {
+	return signedFields([][]byte{[]byte(args.Username), []byte(args.IpAddr)}, args.Seq)
+}
+
+func (user *User) SubscribePresenceHandler(args *SubscribePresenceArgs, reply *SubscribePresenceReply) error {
+	/*
+		Pushes our presence to args.Username from now on, if
+		they signed args in the last minute. It only goes to
+		the address in their record, so nobody can have us
+		send it somewhere else.
+	*/
+	record := user.Node.LookupRecord(args.Username)
+	if record == nil || len(record.SigningKey) != ed25519.PublicKeySize || time.Since(time.Unix(0, args.Seq)) > subscribeWindow || !ed25519.Verify(record.SigningKey, args.signedBytes(), args.Signature) {
+		Print(PresenceTag, "%s refusing a subscription from %s", user.Name, args.Username)
+		return ErrBadSignature
+	}
+	if args.IpAddr != record.IpAddr {
+		Print(PresenceTag, "%s refusing to push presence for %s to %s, they are at %s", user.Name, args.Username, args.IpAddr, record.IpAddr)
+		return ErrBadSignature
+	}
+	user.mu.Lock()
+	defer user.mu.Unlock()
+	if user.Blocked[args.Username] {
+		// as far as they can tell we are never around
+		reply.Presence = MakePresenceRecord(user.Name, Offline, "", user.Keys)
+		return nil
+	}
+	user.subscribers[args.Username] = subscriber{IpAddr: args.IpAddr, Expires: time.Now().Add(3 * PresenceEvery)}
+	reply.Presence = user.presenceRecord()
+	return nil
+}
+
+func (user *User) PresenceHandler(args *PresenceRecord, reply *PresenceReply) error {
+	record := user.Node.LookupRecord(args.Username)
+	if record == nil {
+		return fmt.Errorf("%w: %s", ErrUnknownUser, args.Username)
+	}
+	user.acceptPresence(*args, record.SigningKey)
+	return nil
+}
+
+func (user *User) acceptPresence(presence PresenceRecord, signingKey []byte) {
+	/*
+		Stores presence if it is about someone we watch,
+		verifies with their signingKey, and is newer than what
+		we have, and lets the UI know if it changed anything
+		it shows.
+	*/
+	if !presence.Verify(signingKey) {
+		Print(PresenceTag, "%s dropping presence for %s with a bad signature", user.Name, presence.Username)
+		return
+	}
+	user.mu.Lock()
+	defer user.mu.Unlock()
+	current, watched := user.Watched[presence.Username]
+	if !watched || presence.Seq <= current.Seq {
+		return
+	}
+	user.Watched[presence.Username] = presence
+	if presence.State != Offline {
+		user.resetRetry(presence.Username)
+	}
+	if presence.State != current.State || presence.Text != current.Text {
+		user.notifyPresence(presence)
+	}
+}
+
+// lets the UI know about presence, unless it isn't keeping up.
+// must be called with user.mu held
+func (user *User) notifyPresence(presence PresenceRecord) {
+	select {
+	case user.presenceUpdates <- presence:
+	default:
+	}
+}
+
+func (user *User) GetPresenceChannel() chan PresenceRecord {
+	return user.presenceUpdates
+}
+
+// starts following username's presence
+func (user *User) Watch(username string) {
+	user.mu.Lock()
+	_, watched := user.Watched[username]
+	if !watched && username != user.Name {
+		user.Watched[username] = PresenceRecord{Username: username, State: Offline}
+	}
+	user.mu.Unlock()
+	if !watched && user.done != nil && !user.isDead() {
+		user.spawn(func() { user.subscribe(username) })
+	}
+}
+
+func (user *User) Unwatch(username string) {
+	user.mu.Lock()
+	defer user.mu.Unlock()
+	delete(user.Watched, username)
+}
+
+// returns what we last heard from each user we watch
+func (user *User) Presences() map[string]PresenceRecord {
+	user.mu.Lock()
+	defer user.mu.Unlock()
+	presences := make(map[string]PresenceRecord, len(user.Watched))
+	for username, presence := range user.Watched {
+		presences[username] = presence
+	}
+	return presences
+}
+
+func (user *User) startPresence() {
+	/*
+		Renews our subscriptions to everyone we watch every
+		PresenceEvery, which also finds out who went away
+		without saying so, and forgets the subscribers who
+		stopped renewing theirs.
+	*/
+	for {
+		user.mu.Lock()
+		usernames := make([]string, 0, len(user.Watched))
+		for username, _ := range user.Watched {
+			usernames = append(usernames, username)
+		}
+		for username, sub := range user.subscribers {
+			if time.Now().After(sub.Expires) {
+				delete(user.subscribers, username)
+			}
+		}
+		user.mu.Unlock()
+		for _, username := range usernames {
+			if user.isDead() {
+				return
+			}
+			user.subscribe(username)
+		}
+		if !user.sleep(PresenceEvery) {
+			return
+		}
+	}
+}
+
+// subscribes to username's presence, or marks them Offline if
+// their node can't be reached
+func (user *User) subscribe(username string) {
+	record := user.Node.LookupRecord(username)
+	args := SubscribePresenceArgs{Username: user.Name, IpAddr: user.Node.IpAddr, Seq: time.Now().UnixNano()}
+	args.Signature = ed25519.Sign(user.Keys.SignPrivate, args.signedBytes())
+	var reply SubscribePresenceReply
+	if record != nil && user.Node.call(record.IpAddr, "User.SubscribePresenceHandler", &args, &reply) {
+		user.reached(username, record.IpAddr)
+		user.acceptPresence(reply.Presence, record.SigningKey)
+		return
+	}
+	user.mu.Lock()
+	defer user.mu.Unlock()
+	if current, watched := user.Watched[username]; watched && current.State != Offline {
+		// keep LastSeen from the last record they signed
+		current.State = Offline
+		user.Watched[username] = current
+		user.notifyPresence(current)
+	}
+}
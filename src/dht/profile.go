@@ -0,0 +1,222 @@
+package dht
+
+import "bytes"
+import "crypto/pbkdf2"
+import "crypto/rand"
+import "crypto/sha256"
+import "encoding/gob"
+import "errors"
+import "fmt"
+import "time"
+
+const ProfileTag = "PROFILE"
+
+// the version of the profile format Serialize writes. Bump it
+// whenever User, DhtNode or anything they hold changes in a way
+// gob can't decode into, and register a migration from the
+// previous version.
+const ProfileVersion = 4
+
+// every version profiles have been saved at
+const (
+	legacyIdVersion = 0 // a bare gob of a User with 64 bit IDs
+	bareUserVersion = 1 // a bare gob of a User
+	envelopeVersion = 2 // a User in a profileEnvelope
+	encryptedVersion = 3 // the envelope can be encrypted
+	clockVersion = 4 // LastSeenMap holds clock values rather than Timestamps
+)
+
+// PBKDF2 rounds used for new passphrases. Profiles record the
+// count they were saved with, so raising it doesn't lock anyone
+// out. a variable so tests can lower it
+var PassphraseIterations = 600000
+
+var ErrProfileTooNew = errors.New("dht: profile was saved by a newer version of peerchat")
+var ErrPassphraseRequired = errors.New("dht: profile is encrypted, a passphrase is needed to open it")
+var ErrWrongPassphrase = errors.New("dht: wrong passphrase")
+
+const profileMagic = "peerchat profile"
+
+// what Serialize writes: the gob encoded User, tagged with the
+// version of its layout. If Salt is set, Data is sealed with a
+// key derived from the user's passphrase, Salt and Iterations.
+type profileEnvelope struct {
+	Magic string
+	Version int
+	Salt []byte
+	Iterations int
+	Data []byte
+}
+
+// migrations[v] converts a profile's Data from version v to v+1
+var migrations = map[int]func(data []byte) ([]byte, error){
+	legacyIdVersion: func(data []byte) ([]byte, error) {
+		user, ok := migrateLegacyUser(data)
+		if !ok {
+			return nil, errors.New("not a profile with 64 bit IDs")
+		}
+		return encodeUser(user)
+	},
+	// version 2 only added the envelope around the same User
+	bareUserVersion: func(data []byte) ([]byte, error) {
+		return data, nil
+	},
+	// version 3 only allowed the envelope to be encrypted
+	envelopeVersion: func(data []byte) ([]byte, error) {
+		return data, nil
+	},
+	// version 4 ordered messages by clock, so what was last seen
+	// is a clock value
+	encryptedVersion: func(data []byte) ([]byte, error) {
+		var user User
+		if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&user); err != nil {
+			return nil, err
+		}
+		for peer, timestamp := range user.LastSeenMap {
+			user.LastSeenMap[peer] = wallClock(time.Unix(timestamp, 0))
+		}
+		return encodeUser(&user)
+	},
+}
+
+// a key derived from a user's passphrase, which their profile
+// and journal are encrypted with. Deriving one is slow on
+// purpose, so it is done once at login and kept.
+type passphraseKey struct {
+	salt []byte
+	iterations int
+	key []byte
+}
+
+func deriveKey(passphrase string, salt []byte, iterations int) (*passphraseKey, error) {
+	key, err := pbkdf2.Key(sha256.New, passphrase, salt, iterations, 32)
+	if err != nil {
+		return nil, err
+	}
+	return &passphraseKey{salt: salt, iterations: iterations, key: key}, nil
+}
+
+// derives a key for a new passphrase, with a fresh salt
+func newPassphraseKey(passphrase string) (*passphraseKey, error) {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	return deriveKey(passphrase, salt, PassphraseIterations)
+}
+
+// encrypts plaintext as nonce | AES-GCM ciphertext
+func (k *passphraseKey) seal(plaintext []byte) ([]byte, error) {
+	gcm, err := newGCM(k.key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return gcm.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+// returns ErrWrongPassphrase if sealed wasn't encrypted with this
+// key, which is also what happens if it was tampered with
+func (k *passphraseKey) open(sealed []byte) ([]byte, error) {
+	gcm, err := newGCM(k.key)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < gcm.NonceSize() {
+		return nil, ErrWrongPassphrase
+	}
+	plaintext, err := gcm.Open(nil, sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():], nil)
+	if err != nil {
+		return nil, ErrWrongPassphrase
+	}
+	return plaintext, nil
+}
+
+func encodeUser(user *User) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(user); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// wraps data in an envelope, encrypted with key unless it is nil
+func encodeProfile(data []byte, key *passphraseKey) ([]byte, error) {
+	envelope := profileEnvelope{Magic: profileMagic, Version: ProfileVersion, Data: data}
+	if key != nil {
+		sealed, err := key.seal(data)
+		if err != nil {
+			return nil, err
+		}
+		envelope.Salt = key.salt
+		envelope.Iterations = key.iterations
+		envelope.Data = sealed
+	}
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(&envelope); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// returns the envelope of a saved profile. Profiles saved before
+// envelopes get one made up for them, with the version they are
+func openProfile(raw []byte) profileEnvelope {
+	var envelope profileEnvelope
+	if err := gob.NewDecoder(bytes.NewReader(raw)).Decode(&envelope); err == nil && envelope.Magic == profileMagic {
+		return envelope
+	}
+	// saved before envelopes, when the data was the whole file
+	var user User
+	if err := gob.NewDecoder(bytes.NewReader(raw)).Decode(&user); err == nil && user.Node != nil {
+		return profileEnvelope{Version: bareUserVersion, Data: raw}
+	}
+	return profileEnvelope{Version: legacyIdVersion, Data: raw}
+}
+
+func decodeProfile(raw []byte, passphrase string) ([]byte, *passphraseKey, error) {
+	/*
+		Takes a profile as Serialize saved it, at any
+		version, decrypts it with passphrase if it is
+		encrypted, and returns its Data migrated to
+		ProfileVersion along with the key it was encrypted
+		with, or nil if it wasn't. Returns ErrProfileTooNew
+		for profiles from a later version than ours,
+		ErrPassphraseRequired or ErrWrongPassphrase if it
+		can't be decrypted, and an error wrapping
+		ErrCorruptProfile if a migration fails.
+	*/
+	envelope := openProfile(raw)
+	version, data := envelope.Version, envelope.Data
+	if version > ProfileVersion {
+		return nil, nil, fmt.Errorf("%w: version %d, we understand up to %d", ErrProfileTooNew, version, ProfileVersion)
+	}
+	var key *passphraseKey
+	if version >= encryptedVersion && len(envelope.Salt) > 0 {
+		if passphrase == "" {
+			return nil, nil, ErrPassphraseRequired
+		}
+		var err error
+		if key, err = deriveKey(passphrase, envelope.Salt, envelope.Iterations); err != nil {
+			return nil, nil, fmt.Errorf("%w: %v", ErrCorruptProfile, err)
+		}
+		if data, err = key.open(data); err != nil {
+			return nil, nil, err
+		}
+	}
+	for ; version < ProfileVersion; version++ {
+		migrate, ok := migrations[version]
+		if !ok {
+			return nil, nil, fmt.Errorf("%w: no migration from version %d", ErrCorruptProfile, version)
+		}
+		Print(ProfileTag, "Migrating profile from version %d to %d", version, version+1)
+		var err error
+		if data, err = migrate(data); err != nil {
+			return nil, nil, fmt.Errorf("%w: migrating from version %d: %v", ErrCorruptProfile, version, err)
+		}
+	}
+	return data, key, nil
+}
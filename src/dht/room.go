@@ -0,0 +1,304 @@
+package dht
+
+import "bytes"
+import "crypto/ed25519"
+import "errors"
+import "time"
+
+const RoomTag = "ROOM"
+
+var ErrRoomTaken = errors.New("dht: room name is already claimed by another key")
+var ErrNotRoomOwner = errors.New("dht: only the room's owner can change its members")
+var ErrNoSuchRoom = errors.New("dht: no such room")
+
+// rooms live in the same key space as usernames, so
+// their names are prefixed to keep the two apart
+func RoomId(name string) ID {
+	return Sha1("#" + name)
+}
+
+func MakeRoomRecord(name string, owner string, members []string, keys *KeyPair) RoomRecord {
+	room := RoomRecord{Name: name, Owner: owner, Members: members, OwnerKey: keys.SignPublic, Seq: time.Now().UnixNano()}
+	room.Signature = ed25519.Sign(keys.SignPrivate, room.signedBytes())
+	return room
+}
+
+func (room *RoomRecord) signedBytes() []byte {
+	fields := [][]byte{[]byte(room.Name), []byte(room.Owner), room.OwnerKey}
+	for _, member := range room.Members {
+		fields = append(fields, []byte(member))
+	}
+	return signedFields(fields, room.Seq)
+}
+
+// returns true if room was signed by the key it carries
+func (room *RoomRecord) Verify() bool {
+	if len(room.OwnerKey) != ed25519.PublicKeySize {
+		return false
+	}
+	return ed25519.Verify(room.OwnerKey, room.signedBytes(), room.Signature)
+}
+
+func (room RoomRecord) IsMember(username string) bool {
+	for _, member := range room.Members {
+		if member == username {
+			return true
+		}
+	}
+	return false
+}
+
+func (user *User) CreateRoom(name string) error {
+	/*
+		Creates a room with us as its only member and
+		stores it in the DHT. Fails if someone else
+		already has a room with this name.
+	*/
+	Print(RoomTag, "%s creating room %s", user.Name, name)
+	if existing := user.Node.LookupRoom(name); existing != nil {
+		if !bytes.Equal(existing.OwnerKey, user.Keys.SignPublic) {
+			return ErrRoomTaken
+		}
+		user.mu.Lock()
+		user.Rooms[name] = *existing
+		user.mu.Unlock()
+		return nil
+	}
+	room := MakeRoomRecord(name, user.Name, []string{user.Name}, user.Keys)
+	user.mu.Lock()
+	user.Rooms[name] = room
+	user.mu.Unlock()
+	user.Node.AnnounceRoom(room)
+	return nil
+}
+
+func (user *User) InviteToRoom(name string, username string) error {
+	/*
+		Adds username to a room we own, publishes the new
+		membership and lets them know they were invited.
+	*/
+	user.mu.Lock()
+	room, ok := user.Rooms[name]
+	if !ok {
+		user.mu.Unlock()
+		return ErrNoSuchRoom
+	}
+	if !user.ownsRoom(room) {
+		user.mu.Unlock()
+		return ErrNotRoomOwner
+	}
+	if room.IsMember(username) {
+		user.mu.Unlock()
+		return nil
+	}
+	Print(RoomTag, "%s inviting %s to room %s", user.Name, username, name)
+	members := append(append([]string{}, room.Members...), username)
+	room = MakeRoomRecord(name, user.Name, members, user.Keys)
+	user.Rooms[name] = room
+	user.mu.Unlock()
+	user.Node.AnnounceRoom(room)
+
+	// only invite them once the new membership is stored,
+	// so the room they look up has them in it
+	invite := &SendMessageArgs{Timestamp: time.Now().Unix(), ToUsername: username, FromUsername: user.Name, MessageIdentifier: nrand(), Kind: InviteKind, Room: name}
+	user.mu.Lock()
+	user.enqueue(username, invite)
+	user.mu.Unlock()
+	return nil
+}
+
+func (user *User) RefreshRoom(name string) {
+	/*
+		Fetches the latest membership of a room we are
+		in from the DHT.
+	*/
+	user.refreshRoom(name)
+}
+
+// fetches the latest membership of room name. it is kept if it
+// lists us and is signed by the key of the owner it names, and
+// the room is dropped if we have been removed from it. returns
+// the room as we hold it afterwards and true if we are in it
+func (user *User) refreshRoom(name string) (RoomRecord, bool) {
+	room := user.Node.LookupRoom(name)
+	if room == nil {
+		Print(RoomTag, "%s could not find room %s", user.Name, name)
+	}
+	trusted := room != nil && bytes.Equal(room.OwnerKey, user.signingKey(room.Owner))
+	user.mu.Lock()
+	held, ok := user.Rooms[name]
+	if !trusted || (ok && room.Seq < held.Seq) {
+		user.mu.Unlock()
+		return held, ok && held.IsMember(user.Name)
+	}
+	if !room.IsMember(user.Name) {
+		if ok {
+			Print(RoomTag, "%s was removed from room %s", user.Name, name)
+			delete(user.Rooms, name)
+			user.journal(journalEntry{Op: journalLeftRoom, Key: name})
+		}
+		user.mu.Unlock()
+		user.flushJournal()
+		return *room, false
+	}
+	user.Rooms[name] = *room
+	if !ok {
+		user.journal(journalEntry{Op: journalRoom, Key: name, Room: *room})
+	}
+	user.mu.Unlock()
+	user.flushJournal()
+	return *room, true
+}
+
+func (user *User) refreshRooms() {
+	/*
+		Called on login. Owners store their rooms again so
+		they outlive the nodes that held them, and members
+		pick up anyone invited while they were away.
+	*/
+	owned := user.ownedRooms()
+	for _, room := range owned {
+		user.republishRoom(room)
+	}
+	for _, name := range user.RoomNames() {
+		if _, isOwned := owned[name]; !isOwned {
+			user.RefreshRoom(name)
+		}
+	}
+}
+
+func (user *User) ownsRoom(room RoomRecord) bool {
+	return room.Owner == user.Name && bytes.Equal(room.OwnerKey, user.Keys.SignPublic)
+}
+
+// returns the rooms we own, by name
+func (user *User) ownedRooms() map[string]RoomRecord {
+	user.mu.Lock()
+	defer user.mu.Unlock()
+	owned := make(map[string]RoomRecord)
+	for name, room := range user.Rooms {
+		if user.ownsRoom(room) {
+			owned[name] = room
+		}
+	}
+	return owned
+}
+
+// signs a room we own again so it doesn't expire, and stores it
+func (user *User) republishRoom(room RoomRecord) {
+	room = MakeRoomRecord(room.Name, room.Owner, room.Members, user.Keys)
+	user.mu.Lock()
+	user.Rooms[room.Name] = room
+	user.mu.Unlock()
+	user.Node.AnnounceRoom(room)
+}
+
+// returns the membership of a room we are in
+func (user *User) Room(name string) (RoomRecord, bool) {
+	user.mu.Lock()
+	defer user.mu.Unlock()
+	room, ok := user.Rooms[name]
+	return room, ok
+}
+
+//SendRoomMessage API
+func (user *User) SendRoomMessage(name string, content string) error {
+	/*
+		Sends content to every other member of a room. Each
+		member gets their own copy through the sender queue,
+		so offline members are reached through relays the
+		same way one-to-one messages are.
+	*/
+	user.mu.Lock()
+	room, ok := user.Rooms[name]
+	if !ok {
+		user.mu.Unlock()
+		return ErrNoSuchRoom
+	}
+	Print(RoomTag, "Queuing message \"%s\" to room %s", content, name)
+	message := &SendMessageArgs{Content: content, Timestamp: user.now().Unix(), Clock: user.tick(roomClock(name)), FromUsername: user.Name, MessageIdentifier: nrand(), Status: Queued, Room: name}
+	user.RoomHistory[name] = append(user.RoomHistory[name], message)
+	user.journal(journalEntry{Op: journalRoomHistory, Key: name, Message: message})
+	for _, member := range room.Members {
+		if member == user.Name {
+			continue
+		}
+		memberCopy := *message
+		memberCopy.ToUsername = member
+		user.enqueue(member, &memberCopy)
+		user.journal(journalEntry{Op: journalPending, Key: member, Message: &memberCopy})
+	}
+	user.mu.Unlock()
+	user.flushJournal()
+	return nil
+}
+
+// called by SendMessageHandler with user.mu held
+func (user *User) receiveRoomMessage(args *SendMessageArgs) {
+	room, known := user.Rooms[args.Room]
+	if known && room.IsMember(user.Name) && room.IsMember(args.FromUsername) {
+		user.storeRoomMessage(args)
+		return
+	}
+	// we may not have heard yet that they, or we, were added
+	user.spawn(func() {
+		room, in := user.refreshRoom(args.Room)
+		if !in || !room.IsMember(args.FromUsername) {
+			Print(RoomTag, "%s dropping message to room %s from non-member %s", user.Name, args.Room, args.FromUsername)
+			return
+		}
+		user.mu.Lock()
+		user.storeRoomMessage(args)
+		user.mu.Unlock()
+		user.flushJournal()
+	})
+}
+
+// must be called with user.mu held
+func (user *User) storeRoomMessage(args *SendMessageArgs) {
+	args.Status = Delivered
+	user.RoomHistory[args.Room] = append(user.RoomHistory[args.Room], args)
+	user.observeClock(roomClock(args.Room), args)
+	user.journal(journalEntry{Op: journalRoomHistory, Key: args.Room, Message: args})
+	user.notify(args)
+}
+
+// called by SendMessageHandler with user.mu held
+func (user *User) acceptInvite(args *SendMessageArgs) {
+	Print(RoomTag, "%s was invited to room %s by %s", user.Name, args.Room, args.FromUsername)
+	// the invite only counts if the room's owner sent it and
+	// their signed record lists us
+	user.spawn(func() {
+		room, in := user.refreshRoom(args.Room)
+		if !in || room.Owner != args.FromUsername {
+			Print(RoomTag, "%s ignoring invite to room %s from %s", user.Name, args.Room, args.FromUsername)
+			return
+		}
+		user.mu.Lock()
+		user.notify(args)
+		user.mu.Unlock()
+	})
+}
+
+// returns copies of the messages in a room, in clock order
+func (user *User) RoomMessages(name string) []*SendMessageArgs {
+	user.mu.Lock()
+	defer user.mu.Unlock()
+	if messages, ok := user.RoomHistory[name]; ok {
+		copies := copyMessages(messages)
+		sortMessages(copies)
+		return copies
+	}
+	return make([]*SendMessageArgs, 0)
+}
+
+// returns the names of the rooms we are in
+func (user *User) RoomNames() []string {
+	user.mu.Lock()
+	defer user.mu.Unlock()
+	names := make([]string, 0, len(user.Rooms))
+	for name, _ := range user.Rooms {
+		names = append(names, name)
+	}
+	return names
+}
@@ -0,0 +1,241 @@
+package dht
+
+import "errors"
+import "fmt"
+import "sort"
+import "strings"
+import "time"
+import "unicode"
+
+const SearchTag = "SEARCH"
+
+var ErrBadQuery = errors.New("dht: could not parse search query")
+
+// An inverted index over the messages in a user's
+// MessageHistory. It is saved with the profile so it doesn't
+// have to be rebuilt at every login.
+type SearchIndex struct {
+	Terms map[string]map[int64]bool // term => identifiers of the messages containing it
+	Peers map[int64]string // message identifier => the conversation it is in
+}
+
+func NewSearchIndex() *SearchIndex {
+	return &SearchIndex{Terms: make(map[string]map[int64]bool), Peers: make(map[int64]string)}
+}
+
+// splits text into lower case words, so "Deploy, deploy!" is
+// two "deploy"s
+func tokenize(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+// adds msg, from our conversation with peer, to the index
+func (index *SearchIndex) add(peer string, msg *SendMessageArgs) {
+	index.Peers[msg.MessageIdentifier] = peer
+	for _, term := range tokenize(msg.Content) {
+		if index.Terms[term] == nil {
+			index.Terms[term] = make(map[int64]bool)
+		}
+		index.Terms[term][msg.MessageIdentifier] = true
+	}
+}
+
+// removes msg from the index, it must have the content it was added with
+func (index *SearchIndex) remove(msg *SendMessageArgs) {
+	delete(index.Peers, msg.MessageIdentifier)
+	for _, term := range tokenize(msg.Content) {
+		delete(index.Terms[term], msg.MessageIdentifier)
+		if len(index.Terms[term]) == 0 {
+			delete(index.Terms, term)
+		}
+	}
+}
+
+// indexes a message just added to MessageHistory[peer]. must be
+// called with user.mu held
+func (user *User) indexMessage(peer string, msg *SendMessageArgs) {
+	if user.Index == nil {
+		user.Index = NewSearchIndex()
+	}
+	user.Index.add(peer, msg)
+}
+
+// removes msg from the index before its content changes. must be
+// called with user.mu held
+func (user *User) unindexMessage(msg *SendMessageArgs) {
+	if user.Index != nil {
+		user.Index.remove(msg)
+	}
+}
+
+// indexes all of MessageHistory again, for profiles saved
+// before they had an index. must be called with user.mu held
+func (user *User) rebuildIndex() {
+	user.Index = NewSearchIndex()
+	for peer, messages := range user.MessageHistory {
+		for _, msg := range messages {
+			user.Index.add(peer, msg)
+		}
+	}
+}
+
+// A SearchQuery selects the messages that match all of its
+// fields that are set
+type SearchQuery struct {
+	Keywords []string // words that must all appear
+	Phrases []string // runs of words that must appear in order
+	From string // who sent the message
+	Peer string // who the conversation is with
+	After time.Time // sent at or after this
+	Before time.Time // sent before this
+}
+
+func ParseSearchQuery(text string) (SearchQuery, error) {
+	/*
+		Parses a query the way it is typed into /search:
+		words, "quoted phrases", and the filters from:user,
+		with:user, after:YYYY-MM-DD and before:YYYY-MM-DD.
+		Dates are midnight local time, so before: excludes
+		the day it names. For example
+			deploy "release notes" from:alice after:2024-01-01
+	*/
+	var query SearchQuery
+	for text = strings.TrimSpace(text); text != ""; text = strings.TrimSpace(text) {
+		if text[0] == '"' {
+			end := strings.IndexByte(text[1:], '"')
+			if end < 0 {
+				return query, fmt.Errorf("%w: unterminated quote", ErrBadQuery)
+			}
+			if phrase := strings.Join(tokenize(text[1:end+1]), " "); phrase != "" {
+				query.Phrases = append(query.Phrases, phrase)
+			}
+			text = text[end+2:]
+			continue
+		}
+		word := text
+		if end := strings.IndexAny(text, " \t"); end >= 0 {
+			word = text[:end]
+		}
+		text = text[len(word):]
+
+		var err error
+		switch {
+		case strings.HasPrefix(word, "from:"):
+			query.From = word[len("from:"):]
+		case strings.HasPrefix(word, "with:"):
+			query.Peer = word[len("with:"):]
+		case strings.HasPrefix(word, "after:"):
+			query.After, err = time.ParseInLocation("2006-01-02", word[len("after:"):], time.Local)
+		case strings.HasPrefix(word, "before:"):
+			query.Before, err = time.ParseInLocation("2006-01-02", word[len("before:"):], time.Local)
+		default:
+			query.Keywords = append(query.Keywords, tokenize(word)...)
+		}
+		if err != nil {
+			return query, fmt.Errorf("%w: %s: %v", ErrBadQuery, word, err)
+		}
+	}
+	return query, nil
+}
+
+// returns the terms a message must contain to match query
+func (query SearchQuery) terms() []string {
+	terms := append([]string{}, query.Keywords...)
+	for _, phrase := range query.Phrases {
+		terms = append(terms, strings.Fields(phrase)...)
+	}
+	return terms
+}
+
+// checks everything about msg in our conversation with peer
+// except its terms, which the index already checked
+func (query SearchQuery) matches(peer string, msg *SendMessageArgs) bool {
+	if query.Peer != "" && peer != query.Peer {
+		return false
+	}
+	if query.From != "" && msg.FromUsername != query.From {
+		return false
+	}
+	sent := time.Unix(msg.Timestamp, 0)
+	if !query.After.IsZero() && sent.Before(query.After) {
+		return false
+	}
+	if !query.Before.IsZero() && !sent.Before(query.Before) {
+		return false
+	}
+	if len(query.Phrases) > 0 {
+		words := " " + strings.Join(tokenize(msg.Content), " ") + " "
+		for _, phrase := range query.Phrases {
+			if !strings.Contains(words, " " + phrase + " ") {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// must be called with user.mu held. returns the identifiers of
+// the messages that contain every term, by conversation
+func (user *User) candidates(terms []string) map[string]map[int64]bool {
+	if len(terms) == 0 {
+		return nil
+	}
+	found := make(map[string]map[int64]bool)
+	// walk the rarest term's postings and check the rest
+	sort.Slice(terms, func(i, j int) bool {
+		return len(user.Index.Terms[terms[i]]) < len(user.Index.Terms[terms[j]])
+	})
+	for id, _ := range user.Index.Terms[terms[0]] {
+		inAll := true
+		for _, term := range terms[1:] {
+			if !user.Index.Terms[term][id] {
+				inAll = false
+				break
+			}
+		}
+		if inAll {
+			peer := user.Index.Peers[id]
+			if found[peer] == nil {
+				found[peer] = make(map[int64]bool)
+			}
+			found[peer][id] = true
+		}
+	}
+	return found
+}
+
+func (user *User) Search(query SearchQuery) []*SendMessageArgs {
+	/*
+		Returns copies of the messages in our history that
+		match query, in clock order. Words and phrases are
+		looked up in the index, so only the conversations
+		holding a match are read.
+	*/
+	user.mu.Lock()
+	defer user.mu.Unlock()
+	if user.Index == nil {
+		user.rebuildIndex()
+	}
+
+	results := make([]*SendMessageArgs, 0)
+	terms := query.terms()
+	found := user.candidates(terms)
+	for peer, messages := range user.MessageHistory {
+		if len(terms) > 0 && found[peer] == nil {
+			continue
+		}
+		for _, msg := range messages {
+			if len(terms) > 0 && !found[peer][msg.MessageIdentifier] {
+				continue
+			}
+			if query.matches(peer, msg) {
+				results = append(results, msg)
+			}
+		}
+	}
+	sortMessages(results)
+	Print(SearchTag, "%s found %d messages for %+v", user.Name, len(results), query)
+	return copyMessages(results)
+}
@@ -0,0 +1,269 @@
+package dht
+
+import "sort"
+import "sync"
+import "time"
+
+// how many queued messages go to a node in one SendMessagesHandler
+// call, must be at least 1. a variable so tests can shrink it
+var SendBatchSize = 50
+
+// what is waiting to be sent to one recipient
+type QueueStats struct {
+	Username string
+	Pending int // messages queued for them, ours and the ones we relay
+	Relaying int // of those, the ones we hold for others
+	Attempts int // tries that failed since we last reached them
+	NextRetry time.Time // zero if they are due now
+}
+
+// what the sender has done since we were loaded, and what it
+// still has to do
+type SenderStats struct {
+	Delivered int64 // messages taken by their recipient's node
+	Forwarded int64 // copies left with the nodes closest to a recipient who was away
+	Batches int64 // SendMessagesHandler calls we made
+	Failures int64 // times we couldn't get everything queued for a recipient to them
+	Queues []QueueStats // recipients we have something queued for, in order of username
+}
+
+func (user *User) QueueMetrics() SenderStats {
+	user.mu.Lock()
+	defer user.mu.Unlock()
+	stats := user.sendStats
+	stats.Queues = make([]QueueStats, 0, len(user.PendingMessages))
+	for username, queued := range user.PendingMessages {
+		if len(queued) == 0 {
+			continue
+		}
+		queue := QueueStats{Username: username, Pending: len(queued), Relaying: user.relayedFor(username)}
+		if r, backingOff := user.retries[username]; backingOff {
+			queue.Attempts, queue.NextRetry = r.attempts, r.next
+		}
+		stats.Queues = append(stats.Queues, queue)
+	}
+	sort.Slice(stats.Queues, func(i, j int) bool { return stats.Queues[i].Username < stats.Queues[j].Username })
+	return stats
+}
+
+// lets the sender know there may be something to send now.
+// never blocks, a wakeup already waiting covers this one
+func (user *User) wakeSender() {
+	select {
+	case user.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (user *User) startSender() {
+	/*
+		A separate thread which delivers what we have
+		queued. Each pass tries every recipient who is due
+		once, then we sleep until the next one is due, or
+		until wakeSender says something was queued or a
+		recipient is back. Recipients we can't reach are
+		tried again after a delay that doubles each time,
+		see backOff.
+	*/
+	Print(SendingTag, "Sender process for %s starting...", user.Name)
+	for ! user.isDead() {
+		for _, username := range user.pendingUsernames() {
+			if user.isDead() {
+				return
+			}
+			if user.mailDue(username) {
+				user.deliver(username)
+			}
+		}
+		select {
+		case <-user.done:
+			return
+		case <-user.wake:
+		case <-time.After(user.untilDue()):
+		}
+	}
+}
+
+// returns how long until a recipient we have something queued
+// for is due, at most MailRetryMax
+func (user *User) untilDue() time.Duration {
+	user.mu.Lock()
+	defer user.mu.Unlock()
+	wait := MailRetryMax
+	for username, queued := range user.PendingMessages {
+		if len(queued) == 0 {
+			continue
+		}
+		r, backingOff := user.retries[username]
+		if !backingOff {
+			return 0
+		}
+		if until := time.Until(r.next); until < wait {
+			wait = until
+		}
+	}
+	if wait < 0 {
+		wait = 0
+	}
+	return wait
+}
+
+func (user *User) deliver(username string) {
+	/*
+		Tries once to get everything queued for username to
+		them: straight to their node if it is up, otherwise
+		to the nodes closest to them, who hold it until they
+		are back. Either way each node gets the messages in
+		batches of SendBatchSize.
+	*/
+	queued := user.pendingCopies(username)
+	if len(queued) == 0 {
+		return
+	}
+	ip, publicKey := user.Node.LookupUser(username)
+	if user.CheckStatus(ip) != Online {
+		Print(SendingTag, "%s is offline- leave their messages with the nodes closest to them", username)
+		user.relay(username, queued, publicKey)
+		return
+	}
+	user.reached(username, ip)
+
+	// messages we can't seal yet wait until we know their key
+	sealed, wires := user.seal(queued, publicKey)
+	if len(sealed) < len(queued) {
+		Print(SendingTag, "No public key for %s yet- wait to send their messages", username)
+	}
+	Print(SendingTag, "SenderLoop: Node %v sending %d message(s) to %s...", user.Name, len(wires), username)
+	statuses, ok := user.sendBatches(ip, wires)
+
+	taken := 0
+	for i, status := range statuses {
+		if status != "" {
+			user.updateSentStatus(sealed[i], status)
+			taken++
+		}
+	}
+	user.mu.Lock()
+	for i, status := range statuses {
+		if status != "" {
+			user.dropPending(username, sealed[i].MessageIdentifier)
+			user.journal(journalEntry{Op: journalDropPending, Key: username, Ref: sealed[i].MessageIdentifier})
+		}
+	}
+	user.sendStats.Delivered += int64(taken)
+	all := ok && taken == len(queued)
+	if all {
+		// anything queued since is due straight away
+		delete(user.retries, username)
+	}
+	user.mu.Unlock()
+	user.flushJournal()
+
+	// if some didn't get through, wait before trying again
+	if ! all {
+		user.backOff(username)
+	}
+}
+
+// leaves the messages in queued that we haven't already left
+// with the nodes closest to username with each of those nodes,
+// then waits before trying username again
+func (user *User) relay(username string, queued []*SendMessageArgs, publicKey []byte) {
+	user.mu.Lock()
+	r := user.retryState(username)
+	// relays forget their record too, so keep sealing with
+	// the key we found them with while they are away
+	if len(publicKey) > 0 {
+		r.publicKey = publicKey
+	}
+	publicKey = r.publicKey
+	fresh := make([]*SendMessageArgs, 0, len(queued))
+	for _, msg := range queued {
+		if !r.relayed[msg.MessageIdentifier] {
+			fresh = append(fresh, msg)
+		}
+	}
+	user.mu.Unlock()
+
+	sealed, wires := user.seal(fresh, publicKey)
+	if len(wires) > 0 {
+		var wg sync.WaitGroup
+		for _, entryDist := range user.Node.FindNearestNodes(Sha1(username)) {
+			wg.Add(1)
+			go func(ipAddr string) {
+				defer wg.Done()
+				statuses, _ := user.sendBatches(ipAddr, wires)
+				for i, status := range statuses {
+					if status == "" {
+						continue
+					}
+					user.updateSentStatus(sealed[i], status)
+					user.mu.Lock()
+					user.retryState(username).relayed[sealed[i].MessageIdentifier] = true
+					user.sendStats.Forwarded++
+					user.mu.Unlock()
+				}
+			}(entryDist.RoutingEntry.IpAddr)
+		}
+		wg.Wait()
+	}
+
+	// they may come back somewhere else, so look them up afresh
+	user.Node.forgetRecord(username)
+	user.backOff(username)
+}
+
+// returns the messages in queued that can be sealed for
+// publicKey, and the copies of them that go on the wire
+func (user *User) seal(queued []*SendMessageArgs, publicKey []byte) ([]*SendMessageArgs, []SendMessageArgs) {
+	sealed := make([]*SendMessageArgs, 0, len(queued))
+	wires := make([]SendMessageArgs, 0, len(queued))
+	for _, msg := range queued {
+		if wire, ok := user.sealMessage(*msg, publicKey); ok {
+			sealed = append(sealed, msg)
+			wires = append(wires, wire)
+		}
+	}
+	return sealed, wires
+}
+
+// sends wires to ipAddr in batches of SendBatchSize. returns the
+// status the node replied with for each message it was sent, in
+// order, and false if a call failed before all of them were
+func (user *User) sendBatches(ipAddr string, wires []SendMessageArgs) ([]string, bool) {
+	statuses := make([]string, 0, len(wires))
+	for start := 0; start < len(wires); start += SendBatchSize {
+		end := start + SendBatchSize
+		if end > len(wires) {
+			end = len(wires)
+		}
+		args := SendMessagesArgs{Messages: wires[start:end]}
+		var reply SendMessagesReply
+		user.mu.Lock()
+		user.sendStats.Batches++
+		user.mu.Unlock()
+		if !user.Node.call(ipAddr, "User.SendMessagesHandler", &args, &reply) || len(reply.Statuses) != end - start {
+			return statuses, false
+		}
+		statuses = append(statuses, reply.Statuses...)
+	}
+	return statuses, true
+}
+
+func (user *User) SendMessagesHandler(args *SendMessagesArgs, reply *SendMessagesReply) error {
+	/*
+		Takes each of args.Messages as SendMessageHandler
+		would, each counting against SenderLimit. A message
+		we refuse gets "" for its status, and doesn't stop
+		us taking the ones after it.
+	*/
+	Print(UserTag, "%s entering SendMessagesHandler with %d message(s)", user.Name, len(args.Messages))
+	reply.Statuses = make([]string, len(args.Messages))
+	for i := range args.Messages {
+		var one SendMessageReply
+		if user.SendMessageHandler(&args.Messages[i], &one) == nil {
+			reply.Statuses[i] = one.Status
+		}
+	}
+	return nil
+}
@@ -0,0 +1,75 @@
+package dht
+
+import "crypto/ed25519"
+import "errors"
+import "fmt"
+import "time"
+
+const SignalTag = "SIGNAL"
+
+// how long a TypingSignal lasts. Someone still typing sends
+// another before it runs out, and older signals are dropped when
+// they arrive. a variable so tests can shorten it
+var TypingFor = 6 * time.Second
+
+var ErrNotOnline = errors.New("dht: user is not online")
+
+func (signal *SignalArgs) signedBytes() []byte {
+	fields := [][]byte{[]byte(signal.FromUsername), []byte(signal.ToUsername), []byte(signal.Kind)}
+	return signedFields(fields, signal.Seq)
+}
+
+func (user *User) SendSignal(username string, kind string) error {
+	/*
+		Sends kind straight to username. Returns
+		ErrUnknownUser if they can't be found and
+		ErrNotOnline if they can't be reached, in which
+		case the signal is dropped: it would mean nothing
+		by the time they are back.
+	*/
+	record := user.Node.LookupRecord(username)
+	if record == nil {
+		return fmt.Errorf("%w: %s", ErrUnknownUser, username)
+	}
+	signal := SignalArgs{FromUsername: user.Name, ToUsername: username, Kind: kind, Seq: time.Now().UnixNano()}
+	signal.Signature = ed25519.Sign(user.Keys.SignPrivate, signal.signedBytes())
+	var reply SignalReply
+	if !user.Node.call(record.IpAddr, "User.SignalHandler", &signal, &reply) {
+		return fmt.Errorf("%w: %s", ErrNotOnline, username)
+	}
+	return nil
+}
+
+func (user *User) SignalHandler(args *SignalArgs, reply *SignalReply) error {
+	/*
+		Hands args to the UI if it is for us, signed by a
+		sender we haven't blocked and sent within the last
+		TypingFor. Signals the UI isn't keeping up with are
+		dropped.
+	*/
+	if args.ToUsername != user.Name || time.Now().UnixNano() - args.Seq > int64(TypingFor) {
+		Print(SignalTag, "%s dropping %s signal from %s", user.Name, args.Kind, args.FromUsername)
+		return nil
+	}
+	record := user.Node.LookupRecord(args.FromUsername)
+	if record == nil {
+		return fmt.Errorf("%w: %s", ErrUnknownUser, args.FromUsername)
+	}
+	if len(record.SigningKey) != ed25519.PublicKeySize || !ed25519.Verify(record.SigningKey, args.signedBytes(), args.Signature) {
+		Print(SignalTag, "%s dropping %s signal from %s with a bad signature", user.Name, args.Kind, args.FromUsername)
+		return nil
+	}
+	if user.IsBlocked(args.FromUsername) {
+		Print(SignalTag, "%s dropping %s signal from blocked %s", user.Name, args.Kind, args.FromUsername)
+		return nil
+	}
+	select {
+	case user.signals <- *args:
+	default:
+	}
+	return nil
+}
+
+func (user *User) GetSignalsChannel() chan SignalArgs {
+	return user.signals
+}
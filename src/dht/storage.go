@@ -0,0 +1,252 @@
+package dht
+
+import "os"
+import "io/ioutil"
+import "path/filepath"
+import "strings"
+import "fmt"
+import "sync"
+
+const StorageTag = "STORAGE"
+
+// A Storage keeps each user's saved profile between logins.
+// A profile is a snapshot of the user plus a journal of the
+// changes made since the snapshot was taken. User never touches
+// the filesystem directly, so tests can swap in an in-memory
+// store instead of writing files.
+type Storage interface {
+	// returns the snapshot saved for username, or ErrNoProfile
+	Load(username string) ([]byte, error)
+	// replaces the snapshot saved for username with data
+	Save(username string, data []byte) error
+	// returns true if a snapshot is saved for username
+	Exists(username string) bool
+	// deletes the snapshot and journal saved for username, if there are any
+	Remove(username string) error
+	// adds data to the end of username's journal
+	Append(username string, data []byte) error
+	// returns everything appended to username's journal since
+	// it was last reset, or nil if nothing was
+	LoadJournal(username string) ([]byte, error)
+	// empties username's journal, once a snapshot includes it
+	ResetJournal(username string) error
+}
+
+// the storage used by users created with MakeUser or loaded with Login
+var DefaultStorage Storage = NewFileStorage(DataDir())
+
+// DataDir returns the directory profiles are saved in by
+// default: $PEERCHAT_DATA_DIR if it is set, otherwise peerchat
+// under the XDG data directory
+func DataDir() string {
+	if dir := os.Getenv("PEERCHAT_DATA_DIR"); dir != "" {
+		return dir
+	}
+	if dir := os.Getenv("XDG_DATA_HOME"); dir != "" {
+		return filepath.Join(dir, "peerchat")
+	}
+	if home, err := os.UserHomeDir(); err == nil {
+		return filepath.Join(home, ".local", "share", "peerchat")
+	}
+	return filepath.Join(os.TempDir(), "peerchat")
+}
+
+// FileStorage saves each snapshot as a gob file in Dir, with
+// the journal next to it
+type FileStorage struct {
+	Dir string
+}
+
+func NewFileStorage(dir string) *FileStorage {
+	return &FileStorage{Dir: dir}
+}
+
+// escapeUsername turns a username into a string that is safe to
+// use as a file name on any platform. Letters, digits, '-' and
+// '_' are kept, every other byte becomes %XX, so no two
+// usernames share a file and none can climb out of Dir.
+func escapeUsername(username string) string {
+	var b strings.Builder
+	for i := 0; i < len(username); i++ {
+		c := username[i]
+		if (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9') || c == '-' || c == '_' {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// Path returns the file username's snapshot is saved in
+func (s *FileStorage) Path(username string) string {
+	return filepath.Join(s.Dir, escapeUsername(username)+".gob")
+}
+
+// JournalPath returns the file username's journal is saved in
+func (s *FileStorage) JournalPath(username string) string {
+	return filepath.Join(s.Dir, escapeUsername(username)+".journal")
+}
+
+func (s *FileStorage) Load(username string) ([]byte, error) {
+	data, err := ioutil.ReadFile(s.Path(username))
+	if os.IsNotExist(err) {
+		return nil, ErrNoProfile
+	}
+	return data, err
+}
+
+func (s *FileStorage) Save(username string, data []byte) error {
+	/*
+		Writes data to a temporary file next to the profile,
+		then renames it into place, so a crash part way
+		through leaves the previous profile intact rather
+		than a truncated one.
+	*/
+	if err := os.MkdirAll(s.Dir, 0700); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(s.Dir, "."+escapeUsername(username)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Rename(tmp.Name(), s.Path(username)); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	Print(StorageTag, "Saved %d bytes to %s", len(data), s.Path(username))
+	return nil
+}
+
+func (s *FileStorage) Exists(username string) bool {
+	_, err := os.Stat(s.Path(username))
+	return err == nil
+}
+
+func (s *FileStorage) Remove(username string) error {
+	if err := s.ResetJournal(username); err != nil {
+		return err
+	}
+	err := os.Remove(s.Path(username))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+func (s *FileStorage) Append(username string, data []byte) error {
+	if err := os.MkdirAll(s.Dir, 0700); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(s.JournalPath(username), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func (s *FileStorage) LoadJournal(username string) ([]byte, error) {
+	data, err := ioutil.ReadFile(s.JournalPath(username))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	return data, err
+}
+
+func (s *FileStorage) ResetJournal(username string) error {
+	err := os.Remove(s.JournalPath(username))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// MemStorage keeps profiles in memory, for tests. Like files,
+// the data saved is copied, so later changes by the caller
+// don't leak into the store.
+type MemStorage struct {
+	mu sync.Mutex
+	profiles map[string][]byte
+	journals map[string][]byte
+}
+
+func NewMemStorage() *MemStorage {
+	return &MemStorage{profiles: make(map[string][]byte), journals: make(map[string][]byte)}
+}
+
+func (s *MemStorage) Load(username string) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	data, ok := s.profiles[username]
+	if !ok {
+		return nil, ErrNoProfile
+	}
+	return append([]byte{}, data...), nil
+}
+
+func (s *MemStorage) Save(username string, data []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.profiles[username] = append([]byte{}, data...)
+	return nil
+}
+
+func (s *MemStorage) Exists(username string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.profiles[username]
+	return ok
+}
+
+func (s *MemStorage) Remove(username string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.profiles, username)
+	delete(s.journals, username)
+	return nil
+}
+
+func (s *MemStorage) Append(username string, data []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.journals[username] = append(s.journals[username], data...)
+	return nil
+}
+
+func (s *MemStorage) LoadJournal(username string) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if journal, ok := s.journals[username]; ok {
+		return append([]byte{}, journal...), nil
+	}
+	return nil, nil
+}
+
+func (s *MemStorage) ResetJournal(username string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.journals, username)
+	return nil
+}
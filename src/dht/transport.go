@@ -0,0 +1,263 @@
+package dht
+
+import "net"
+import "net/rpc"
+import "time"
+import "sync"
+import "errors"
+import "math/rand"
+
+const TransportTag = "TRANSPORT"
+
+// A Transport moves RPCs between nodes. DhtNode and User
+// never touch the network directly, so tests can swap in
+// an in-process network instead of real TCP sockets.
+type Transport interface {
+	// start accepting connections for addr
+	Listen(addr string) (net.Listener, error)
+	// open a connection from one node's address to another's
+	Dial(from string, to string) (net.Conn, error)
+	// call() sends an RPC to the rpcname handler on server to,
+	// and returns true if the server responded. the reply's
+	// contents are only valid if Call() returned true.
+	Call(from string, to string, rpcname string, args interface{}, reply interface{}) bool
+}
+
+// the transport used by nodes created with MakeNode or loaded from disk
+var DefaultTransport Transport = &TCPTransport{Timeout: 2 * time.Second}
+
+func rpcCall(conn net.Conn, rpcname string, args interface{}, reply interface{}, timeout time.Duration) bool {
+	/*
+		Runs one RPC over an already open connection,
+		giving up after timeout. The connection is always
+		closed when the call returns.
+	*/
+	client := rpc.NewClient(conn)
+	c := make(chan bool, 1)
+	go func() {
+		c <- client.Call(rpcname, args, reply) == nil
+	}()
+
+	select {
+	case result := <-c:
+		client.Close()
+		return result
+	case <-time.After(timeout):
+		client.Close()
+		return false
+	}
+}
+
+// TCPTransport sends RPCs over real TCP connections
+type TCPTransport struct {
+	Timeout time.Duration
+}
+
+func (t *TCPTransport) Listen(addr string) (net.Listener, error) {
+	return net.Listen("tcp", addr)
+}
+
+func (t *TCPTransport) Dial(from string, to string) (net.Conn, error) {
+	return net.DialTimeout("tcp", to, t.Timeout)
+}
+
+func (t *TCPTransport) Call(from string, to string, rpcname string, args interface{}, reply interface{}) bool {
+
+	// collect data
+	/*
+	n := 640
+	text := fmt.Sprintf("%s, %d, %d, %d, %d\n", rpcname, time.Now().Unix(), K, Alpha, n)
+	filename := fmt.Sprintf("/Users/will/Code/Go/peerchat/writeup/plots/SWEEP.csv")
+	appendToCsv(filename, text)
+	*/
+
+	conn, err := t.Dial(from, to)
+	if err != nil {
+		return false
+	}
+	return rpcCall(conn, rpcname, args, reply, t.Timeout)
+}
+
+// MemNetwork is a simulated network that lives inside one
+// process. Connections are net.Pipes, so no ports or file
+// descriptors are used, and latency, packet loss, partitions
+// and crashed nodes can all be configured. Randomness comes
+// from a seeded source so runs are repeatable.
+type MemNetwork struct {
+	Timeout time.Duration // calls slower than this fail
+	Latency time.Duration // added to every call
+	Jitter time.Duration // up to this much more latency, chosen at random
+	LossRate float64 // probability in [0, 1) that a call is dropped
+
+	mu sync.Mutex
+	rand *rand.Rand
+	listeners map[string]*memListener
+	crashed map[string]bool
+	partition map[string]int // addr => partition number, 0 if unassigned
+}
+
+func NewMemNetwork(seed int64) *MemNetwork {
+	return &MemNetwork{
+		Timeout: 2 * time.Second,
+		rand: rand.New(rand.NewSource(seed)),
+		listeners: make(map[string]*memListener),
+		crashed: make(map[string]bool),
+		partition: make(map[string]int),
+	}
+}
+
+// SetConditions changes the latency, jitter and loss rate of
+// a network that is already in use
+func (network *MemNetwork) SetConditions(latency time.Duration, jitter time.Duration, lossRate float64) {
+	network.mu.Lock()
+	defer network.mu.Unlock()
+	network.Latency = latency
+	network.Jitter = jitter
+	network.LossRate = lossRate
+}
+
+// Crash makes addr unreachable, and stops it from reaching
+// anyone else, until Restart is called
+func (network *MemNetwork) Crash(addr string) {
+	network.mu.Lock()
+	defer network.mu.Unlock()
+	network.crashed[addr] = true
+}
+
+func (network *MemNetwork) Restart(addr string) {
+	network.mu.Lock()
+	defer network.mu.Unlock()
+	delete(network.crashed, addr)
+}
+
+// Partition splits the network so that nodes can only talk to
+// nodes in the same group. Addresses not listed in any group
+// form one more group of their own.
+func (network *MemNetwork) Partition(groups ...[]string) {
+	network.mu.Lock()
+	defer network.mu.Unlock()
+	network.partition = make(map[string]int)
+	for i, group := range groups {
+		for _, addr := range group {
+			network.partition[addr] = i + 1
+		}
+	}
+}
+
+// Heal removes all partitions
+func (network *MemNetwork) Heal() {
+	network.Partition()
+}
+
+func (network *MemNetwork) Listen(addr string) (net.Listener, error) {
+	network.mu.Lock()
+	defer network.mu.Unlock()
+	if _, exists := network.listeners[addr]; exists {
+		return nil, errors.New("address already in use: " + addr)
+	}
+	l := &memListener{network: network, addr: addr, conns: make(chan net.Conn), done: make(chan bool)}
+	network.listeners[addr] = l
+	return l, nil
+}
+
+func (network *MemNetwork) Dial(from string, to string) (net.Conn, error) {
+	network.mu.Lock()
+	l, exists := network.listeners[to]
+	reachable := exists && network.canReach(from, to)
+	network.mu.Unlock()
+
+	if !reachable {
+		return nil, errors.New("connection refused: " + to)
+	}
+	client, server := net.Pipe()
+	select {
+	case l.conns <- &memConn{Conn: server, from: memAddr(from)}:
+		return client, nil
+	case <-l.done:
+		client.Close()
+		server.Close()
+		return nil, errors.New("connection refused: " + to)
+	}
+}
+
+func (network *MemNetwork) Call(from string, to string, rpcname string, args interface{}, reply interface{}) bool {
+	network.mu.Lock()
+	delay := network.Latency
+	if network.Jitter > 0 {
+		delay += time.Duration(network.rand.Int63n(int64(network.Jitter)))
+	}
+	dropped := network.rand.Float64() < network.LossRate
+	timeout := network.Timeout
+	network.mu.Unlock()
+
+	if dropped || delay >= timeout {
+		Print(TransportTag, "Dropping %s from %s to %s", rpcname, from, to)
+		return false
+	}
+	time.Sleep(delay)
+
+	conn, err := network.Dial(from, to)
+	if err != nil {
+		return false
+	}
+	return rpcCall(conn, rpcname, args, reply, timeout - delay)
+}
+
+// must be called with network.mu held
+func (network *MemNetwork) canReach(from string, to string) bool {
+	if network.crashed[from] || network.crashed[to] {
+		return false
+	}
+	return network.partition[from] == network.partition[to]
+}
+
+func (network *MemNetwork) removeListener(l *memListener) {
+	network.mu.Lock()
+	defer network.mu.Unlock()
+	if network.listeners[l.addr] == l {
+		delete(network.listeners, l.addr)
+	}
+}
+
+type memListener struct {
+	network *MemNetwork
+	addr string
+	conns chan net.Conn
+	done chan bool
+	closeOnce sync.Once
+}
+
+func (l *memListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, errors.New("listener closed: " + l.addr)
+	}
+}
+
+func (l *memListener) Close() error {
+	l.closeOnce.Do(func() {
+		close(l.done)
+		l.network.removeListener(l)
+	})
+	return nil
+}
+
+func (l *memListener) Addr() net.Addr {
+	return memAddr(l.addr)
+}
+
+type memAddr string
+
+func (a memAddr) Network() string { return "mem" }
+func (a memAddr) String() string { return string(a) }
+
+// the server's end of a MemNetwork connection, which knows the
+// address it was dialed from
+type memConn struct {
+	net.Conn
+	from memAddr
+}
+
+func (c *memConn) RemoteAddr() net.Addr { return c.from }
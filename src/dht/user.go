@@ -1,41 +1,83 @@
 package dht
 
 import "time"
-import "os"
+import "bytes"
 import "encoding/gob"
 import "net"
-import "log"
-import "github.com/pmylund/sortutil"
+import "errors"
+import "fmt"
+import "sync"
+import "crypto/subtle"
+import "crypto/ed25519"
 
 const UserTag = "USER"
 const SendingTag = "SENDING"
 
+var ErrNoProfile = errors.New("dht: no saved profile for this username")
+var ErrCorruptProfile = errors.New("dht: saved profile could not be decoded")
+var ErrAddressInUse = errors.New("dht: could not listen on address")
+var ErrBootstrapUnreachable = errors.New("dht: bootstrap node is not online")
+
 type User struct {
+	mu sync.Mutex // guards the maps below and the messages in them, never held across an RPC
 	l net.Listener
 	Node *DhtNode
 	Name string
+	Keys *KeyPair // our long-term keypair, the public half is announced in the DHT
 	MessageHistory map[string][]*SendMessageArgs // username => messages we've gotten so far
 	PendingMessages map[string][]*SendMessageArgs // username => slice of pending messages to apply
 	ReceivedMessageIdentifiers map[int64]bool // messageIdentifier (int64) => true if seen messageIdentifier before
 	notifications chan *SendMessageArgs
-	dead bool
+	storage Storage // where Serialize saves us, DefaultStorage if nil
+	journalMu sync.Mutex // orders writes to our journal, taken before mu
+	unjournaled []journalEntry // changes not yet written to our journal
+	journaled int // entries written to our journal since the last snapshot
+	JournalSeq int64 // Seq of the last journal entry this snapshot includes
+	profileKey *passphraseKey // encrypts our profile and journal, nil without a passphrase. guarded by journalMu
+	done chan struct{} // closed by Logoff to stop our goroutines
+	stop sync.Once
+	wg sync.WaitGroup // the goroutines we started, Logoff waits for them
+	connMu sync.Mutex // guards conns, and orders spawn against shutdown
+	conns map[net.Conn]bool // connections we are serving RPCs on, closed by Logoff
+	wallTime func() time.Time // time.Now if nil, see now()
 	
-	LastSeenMap map[string]int64
+	LastSeenMap map[string]int64 // username => clock value of the last message in our conversation we showed
+	Clocks map[string]int64 // username, or roomClock(room) => the latest clock value in that conversation
+	OrphanChanges map[int64][]*SendMessageArgs // MessageIdentifier => edits, deletions and reactions that arrived before it
 	Current string // the current ser we're chatting with
+
+	Rooms map[string]RoomRecord // room name => membership of rooms we are in
+	RoomHistory map[string][]*SendMessageArgs // room name => messages sent to the room
+
+	Index *SearchIndex // words in MessageHistory, for Search
+
+	PresenceState string // what we tell our watchers, Online if ""
+	PresenceText string // our custom status
+	Watched map[string]PresenceRecord // username => the last presence we heard from them
+	subscribers map[string]subscriber // username => where to push our presence to them
+	presenceUpdates chan PresenceRecord // changes to Watched, for the UI
+	signals chan SignalArgs // signals sent to us, for the UI
+
+	Contacts map[string]Contact // username => our address book entry for them
+	Blocked map[string]bool // username => true if we drop everything they send us
+	senders *limiter // messages by verified FromUsername, see SenderLimit
+	retries map[string]*retry // username => when we next try to reach them and how often we have failed
+	wake chan struct{} // tells the sender there may be something to send, see wakeSender
+	sendStats SenderStats // what the sender has done since we were loaded, without Queues
+	sources *limiter // RPCs by remote address, see SourceLimit
 }
 
-const PEERCHAT_USERDATA_DIR = "/tmp"
 const PERSIST_EVERY = 30
 
-func UsernameToPath(username string) string {
-	/*
-		Given a username, returns the filepath
-		where the backup will be located.
-		
-		NOTE: Go treats "/" as the path separator on
-		all platforms.
-	*/
-	return PEERCHAT_USERDATA_DIR + "/" + username + ".gob"
+func (user *User) SetStorage(storage Storage) {
+	user.storage = storage
+}
+
+func (user *User) GetStorage() Storage {
+	if user.storage == nil {
+		return DefaultStorage
+	}
+	return user.storage
 }
 
 func (user *User) GetNotificationsChannel() chan *SendMessageArgs {
@@ -46,140 +88,471 @@ func (user *User) GetMessagesFrom(other *User) []*SendMessageArgs {
 	/*
 		Returns the list of SendMessageArgs
 	*/
-	if _, ok := user.MessageHistory[other.Name]; ok {
-		return user.MessageHistory[other.Name]
+	return user.AllMessagesFromUser(other.Name)
+}
+
+// returns copies of msgs, so callers can read them while
+// handlers keep updating the originals
+func copyMessages(msgs []*SendMessageArgs) []*SendMessageArgs {
+	copies := make([]*SendMessageArgs, len(msgs))
+	for i, msg := range msgs {
+		copies[i] = copyMessage(msg)
 	}
-	return make([]*SendMessageArgs, 0)
+	return copies
+}
+
+// returns a copy of msg that shares nothing with it
+func copyMessage(msg *SendMessageArgs) *SendMessageArgs {
+	msgCopy := *msg
+	if msg.Reactions != nil {
+		msgCopy.Reactions = make(map[string][]string, len(msg.Reactions))
+		for emoji, users := range msg.Reactions {
+			msgCopy.Reactions[emoji] = append([]string{}, users...)
+		}
+	}
+	// the slices in an attachment are replaced, never written to
+	if msg.Attachment != nil {
+		attachmentCopy := *msg.Attachment
+		msgCopy.Attachment = &attachmentCopy
+	}
+	return &msgCopy
+}
+
+// tells the UI about msg
+func (user *User) notify(msg *SendMessageArgs) {
+	user.notifications <- copyMessage(msg)
 }
 
-func (user *User) Serialize() {
+func (user *User) Serialize() error {
 	/*
-		Serializes this User struct.
+		Serializes this User struct into a snapshot, which
+		includes every change in our journal, so the journal
+		is emptied afterwards.
 	*/
-	path := UsernameToPath(user.Name)
-	Print(UserTag, "Serializing path=%s for User %+v", path, user)
-	encodeFile, err := os.Create(path)
+	user.journalMu.Lock()
+	defer user.journalMu.Unlock()
+	return user.snapshot()
+}
+
+// must be called with user.journalMu held
+func (user *User) snapshot() error {
+	user.mu.Lock()
+	defer user.mu.Unlock()
+	user.Node.mu.Lock()
+	defer user.Node.mu.Unlock()
+
+	Print(UserTag, "Serializing User %+v", user)
+	data, err := encodeUser(user)
+	if err != nil {
+		return err
+	}
+	profile, err := encodeProfile(data, user.profileKey)
 	if err != nil {
-		panic(err)
+		return err
+	}
+	if err := user.GetStorage().Save(user.Name, profile); err != nil {
+		return err
+	}
+	user.unjournaled = nil
+	user.journaled = 0
+	// entries left behind if this fails are already in the
+	// snapshot, so replaying skips them
+	if err := user.GetStorage().ResetJournal(user.Name); err != nil {
+		return err
 	}
+	Print("USER", "Written to storage successfully")
+	return nil
+}
 
-	// encode and write to file
-	encoder := gob.NewEncoder(encodeFile)
-	if err := encoder.Encode(user); err != nil {
-		panic(err)
+// saves the user from a background goroutine, where there
+// is no one to return an error to
+func (user *User) persist() {
+	if err := user.Serialize(); err != nil {
+		Print(UserTag, "%s could not be saved: %v", user.Name, err)
 	}
-	encodeFile.Close()
-	Print("USER", "Written to file successfully")
 }
 
-func Deserialize(username string) (bool, *User) {
+func Deserialize(username string) (*User, error) {
+	return deserialize(DefaultStorage, username, "")
+}
+
+func deserialize(storage Storage, username string, passphrase string) (*User, error) {
 	/*
 		Deserializes a DhtNode and loads
 		it into a new DhtNode, which is 
-		returned. 
+		returned. Only the snapshot is read,
+		loadUser replays the journal on top of
+		it. Profiles saved by older versions are
+		migrated. Returns ErrNoProfile if username
+		was never saved in storage,
+		ErrProfileTooNew if it was saved by a later
+		version, ErrPassphraseRequired or
+		ErrWrongPassphrase if it is encrypted and
+		passphrase doesn't open it, and an error
+		wrapping ErrCorruptProfile if it can't be
+		decoded.
 	*/
 	newUser := new(User)
 	
-	// check if this file exists
-	path := UsernameToPath(username)
-	Print(UserTag, "Loading user from path=%s", path)
-	if _, err := os.Stat(path); os.IsNotExist(err) {
-		// this file does not exist
-		Print(UserTag, "File %s does not exist!", path)
-		return false, newUser
+	Print(UserTag, "Loading user %s from storage", username)
+	raw, err := storage.Load(username)
+	if err != nil {
+		Print(UserTag, "Could not load %s: %v", username, err)
+		return nil, err
 	}
-	
-	decodeFile, err := os.Open(path)
+	data, key, err := decodeProfile(raw, passphrase)
 	if err != nil {
-		panic(err)
+		Print(UserTag, "Could not open profile of %s: %v", username, err)
+		return nil, err
 	}
-	defer decodeFile.Close()
 
 	// create decoder
-	decoder := gob.NewDecoder(decodeFile)
-	decoder.Decode(&newUser)
-	return true, newUser
+	decoder := gob.NewDecoder(bytes.NewReader(data))
+	if err := decoder.Decode(&newUser); err != nil {
+		return nil, fmt.Errorf("%w: %s: %v", ErrCorruptProfile, username, err)
+	}
+	if newUser.Node == nil {
+		return nil, fmt.Errorf("%w: %s has no node", ErrCorruptProfile, username)
+	}
+	newUser.profileKey = key
+	return newUser, nil
 }
 
-// might return nil- handled by Application
-func Login(username string, userIpAddr string) *User {
+// the on-disk layout of a User from when an ID was a uint64
+type legacyRoutingEntry struct {
+	IpAddr string
+	NodeId uint64
+}
+
+type legacyDhtNode struct {
+	IpAddr string
+	NodeId uint64
+	RoutingTable [64][]legacyRoutingEntry
+}
+
+type legacyUser struct {
+	Node *legacyDhtNode
+	Name string
+	Keys *KeyPair // our long-term keypair, the public half is announced in the DHT
+	MessageHistory map[string][]*SendMessageArgs
+	PendingMessages map[string][]*SendMessageArgs
+	ReceivedMessageIdentifiers map[int64]bool
+	LastSeenMap map[string]int64
+	Current string
+}
+
+func migrateLegacyUser(data []byte) (*User, bool) {
+	/*
+		Decodes a User saved with 64 bit IDs and converts
+		it to the current format. NodeIds are just the hash
+		of the node's IP address so they can be recomputed
+		at full width. The username cache is keyed on truncated
+		hashes which can't be recovered, so it is dropped; it
+		gets repopulated by AnnounceUser. Our keys are kept,
+		since they are who we are to everyone who pinned
+		them.
+	*/
+	var old legacyUser
+	decoder := gob.NewDecoder(bytes.NewReader(data))
+	if err := decoder.Decode(&old); err != nil || old.Node == nil {
+		Print(UserTag, "Could not decode legacy user: %v", err)
+		return nil, false
+	}
+
+	user := MakeUser(old.Name, old.Node.IpAddr)
+	for _, row := range old.Node.RoutingTable {
+		for _, oldEntry := range row {
+			entry := RoutingEntry{IpAddr: oldEntry.IpAddr, NodeId: Sha1(oldEntry.IpAddr)}
+			n := find_n(entry.NodeId, user.Node.NodeId)
+			if len(user.Node.RoutingTable[n]) < K {
+				user.Node.RoutingTable[n] = append(user.Node.RoutingTable[n], entry)
+			}
+		}
+	}
+	if old.MessageHistory != nil {
+		user.MessageHistory = old.MessageHistory
+	}
+	if old.PendingMessages != nil {
+		user.PendingMessages = old.PendingMessages
+	}
+	if old.ReceivedMessageIdentifiers != nil {
+		user.ReceivedMessageIdentifiers = old.ReceivedMessageIdentifiers
+	}
+	if old.LastSeenMap != nil {
+		user.LastSeenMap = old.LastSeenMap
+	}
+	user.Current = old.Current
+	if old.Keys != nil && len(old.Keys.Private) > 0 {
+		user.Keys = old.Keys
+		user.Keys.ensureSigningKey()
+	}
+	user.rebuildIndex()
+	Print(UserTag, "Migrated legacy user %s", user.Name)
+	return user, true
+}
+
+// returns ErrNoProfile if username has never logged in on this
+// machine, ErrCorruptProfile if its profile can't be read,
+// ErrProfileTooNew if it was saved by a later version of peerchat
+// and ErrAddressInUse if userIpAddr can't be listened on
+func Login(username string, userIpAddr string) (*User, error) {
+	return LoginWithPassphrase(username, userIpAddr, "")
+}
+
+// like Login, for profiles encrypted with a passphrase. returns
+// ErrPassphraseRequired or ErrWrongPassphrase if passphrase doesn't
+// open the profile
+func LoginWithPassphrase(username string, userIpAddr string, passphrase string) (*User, error) {
 	/*
 		Attempts to log into the Peerchat network by loading a previous configuration
 		and defaulting to creating a new one. 
 	*/
 	
 	Print(UserTag, "Attempting to log on with username=%s and ip=%s...", username, userIpAddr) 
-	user := loadUser(username, userIpAddr)
-	if user != nil {
-		user.setupUser()
-		time.Sleep(10*time.Millisecond)
-		user.Node.AnnounceUser(username, userIpAddr)
-		go user.startSender()
-		go user.startPersistor()
+	user, err := loadUser(username, userIpAddr, passphrase)
+	if err != nil {
+		return nil, err
 	}
-	return user
+	if err := user.setupUser(); err != nil {
+		return nil, err
+	}
+	time.Sleep(10*time.Millisecond)
+	user.Node.AnnounceUser(username, userIpAddr, user.Keys)
+	user.spawn(user.refreshRooms)
+	user.spawn(user.pullMail)
+	user.spawn(user.startSender)
+	user.spawn(user.startPersistor)
+	user.spawn(user.startRepublisher)
+	user.spawn(user.startMaintainer)
+	user.spawn(user.startDownloader)
+	user.spawn(user.startPresence)
+	return user, nil
+}
+
+// returns ErrAddressInUse if userIpAddr can't be listened on,
+// ErrBootstrapUnreachable if bootstrapIpAddr isn't online and
+// ErrUsernameTaken if username is registered by someone else.
+// an empty bootstrapIpAddr starts a new network
+func RegisterAndLogin(username string, userIpAddr string, bootstrapIpAddr string) (*User, error) { 
+	return RegisterWithPassphrase(username, userIpAddr, bootstrapIpAddr, "")
 }
 
-func RegisterAndLogin(username string, userIpAddr string, bootstrapIpAddr string) *User { 
+// like RegisterAndLogin, but the profile is encrypted with a key
+// derived from passphrase unless it is empty
+func RegisterWithPassphrase(username string, userIpAddr string, bootstrapIpAddr string, passphrase string) (*User, error) { 
 	/*
 		Attempts to register as a new user on the Peerchat network using 
 		a known IP address as a boostrap. 
 	*/
 	Print(UserTag, "Bootstraping register with %s using username=%s, ip=%s, and ...", bootstrapIpAddr, username, userIpAddr) 
 	user := MakeUser(username, userIpAddr)
-	user.setupUser()
+	if passphrase != "" {
+		key, err := newPassphraseKey(passphrase)
+		if err != nil {
+			return nil, err
+		}
+		user.profileKey = key
+	}
+	if err := user.setupUser(); err != nil {
+		return nil, err
+	}
 	
 	// check status of user we are about to bootstrap from
-	status := user.CheckStatus(bootstrapIpAddr)
-	if status == Offline {
+	if bootstrapIpAddr != "" && user.CheckStatus(bootstrapIpAddr) == Offline {
 		Print(UserTag, "Could not boostrap: %s was not online!", bootstrapIpAddr)
-		//return some error
+		user.shutdown()
+		return nil, fmt.Errorf("%w: %s", ErrBootstrapUnreachable, bootstrapIpAddr)
+	}
+
+	// usernames belong to the first key that registers them,
+	// even once its record has expired
+	if user.Node.OwnedByOther(username, user.Keys.SignPublic) {
+		Print(UserTag, "Could not register: %s is already claimed by another key!", username)
+		user.shutdown()
+		return nil, ErrUsernameTaken
 	}
 
 	time.Sleep(10*time.Millisecond)
-	user.Node.AnnounceUser(username, userIpAddr)
-	go user.startSender()
-	go user.startPersistor()
-	return user
+	if err := user.Node.AnnounceUser(username, userIpAddr, user.Keys); err != nil {
+		Print(UserTag, "Could not register: %s was refused by the network: %v", username, err)
+		user.shutdown()
+		return nil, err
+	}
+	user.spawn(user.startSender)
+	user.spawn(user.startPersistor)
+	user.spawn(user.startRepublisher)
+	user.spawn(user.startMaintainer)
+	user.spawn(user.startDownloader)
+	user.spawn(user.startPresence)
+	return user, nil
 }
 
-func (user *User) Logoff() {
-	user.Serialize()
-	user.dead = true
-	user.l.Close()
+func (user *User) ChangePassphrase(old string, new string) error {
+	/*
+		Encrypts our profile and journal with a key derived
+		from new from now on, or stops encrypting them if
+		new is empty, and saves a snapshot with it straight
+		away. Returns ErrWrongPassphrase if old isn't our
+		current passphrase, which is empty if we have none.
+	*/
+	user.journalMu.Lock()
+	defer user.journalMu.Unlock()
+	current := user.profileKey
+	if current == nil && old != "" {
+		return ErrWrongPassphrase
+	}
+	if current != nil {
+		check, err := deriveKey(old, current.salt, current.iterations)
+		if err != nil {
+			return err
+		}
+		if subtle.ConstantTimeCompare(check.key, current.key) != 1 {
+			return ErrWrongPassphrase
+		}
+	}
+
+	var key *passphraseKey
+	if new != "" {
+		var err error
+		if key, err = newPassphraseKey(new); err != nil {
+			return err
+		}
+	}
+	// the journal is emptied by the snapshot, so nothing is
+	// left encrypted with the old key
+	user.profileKey = key
+	if err := user.snapshot(); err != nil {
+		user.profileKey = current
+		return err
+	}
+	Print(UserTag, "%s changed its passphrase", user.Name)
+	return nil
 }
 
-func (user *User) setupUser(){
-	user.dead = false
+func (user *User) Logoff() error {
+	/*
+		Stops our listener and every goroutine we started,
+		waits for them to finish, then saves the user to
+		disk. Calling it more than once is harmless.
+	*/
+	if !user.isDead() {
+		user.announceOffline()
+	}
+	user.shutdown()
+	return user.Serialize()
+}
+
+func (user *User) shutdown() {
+	user.stop.Do(func() {
+		// once done is closed nothing more is spawned, so
+		// everything Wait has to wait for is already added
+		user.connMu.Lock()
+		close(user.done)
+		// peers can hold a connection open for as long as
+		// they like, so don't wait for them to hang up
+		for conn := range user.conns {
+			conn.Close()
+		}
+		user.connMu.Unlock()
+		user.l.Close()
+	})
+	user.wg.Wait()
+}
+
+// remembers conn so Logoff can close it. returns false if we
+// have logged off, in which case it isn't served
+func (user *User) trackConn(conn net.Conn) bool {
+	user.connMu.Lock()
+	defer user.connMu.Unlock()
+	if user.isDead() {
+		return false
+	}
+	user.conns[conn] = true
+	return true
+}
+
+func (user *User) untrackConn(conn net.Conn) {
+	user.connMu.Lock()
+	defer user.connMu.Unlock()
+	delete(user.conns, conn)
+}
+
+// returns true once we have logged off
+func (user *User) isDead() bool {
+	select {
+	case <-user.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// waits for d, returns false if we logged off in the meantime
+func (user *User) sleep(d time.Duration) bool {
+	select {
+	case <-user.done:
+		return false
+	case <-time.After(d):
+		return true
+	}
+}
+
+// runs f in a goroutine that Logoff waits for, unless we have
+// logged off. safe to call from RPC handlers, which Logoff
+// doesn't wait for
+func (user *User) spawn(f func()) {
+	user.connMu.Lock()
+	defer user.connMu.Unlock()
+	if user.isDead() {
+		return
+	}
+	user.wg.Add(1)
+	go func() {
+		defer user.wg.Done()
+		f()
+	}()
+}
+
+func (user *User) setupUser() error {
+	user.done = make(chan struct{})
+	user.conns = make(map[net.Conn]bool)
 	rpcs := user.Node.SetupNode()
 	rpcs.Register(user)
 
 	// set up a connection listener
-	l, e := net.Listen("tcp", user.Node.IpAddr)
+	l, e := user.Node.GetTransport().Listen(user.Node.IpAddr)
 	if e != nil {
-		log.Fatal("listen error: ", e)
+		return fmt.Errorf("%w: %s: %v", ErrAddressInUse, user.Node.IpAddr, e)
 	}
 	user.l = l
 	
 	// spin off go routine to listen for connections
-	go func() {
+	user.spawn(func() {
 		Print(StartTag, "Connection listener for %s starting...", user.Node.IpAddr)
-		for user.dead == false{
+		for {
 			conn, err := l.Accept()
-			if err == nil && ! user.dead{
-				// spin off goroutine to handle
-				// RPC requests from other nodes
-				go rpcs.ServeConn(conn)
-			} else if err == nil {
+			if err != nil {
+				// Logoff waits for us, so it can't be called from here
+				if ! user.isDead() {
+					go user.Logoff()
+				}
+				break
+			}
+			if !user.trackConn(conn) {
 				conn.Close()
+				continue
 			}
-			if err != nil && ! user.dead{
-				user.Logoff()
-			}			
+			// spin off goroutine to handle
+			// RPC requests from other nodes
+			user.spawn(func() {
+				defer user.untrackConn(conn)
+				user.serveConn(rpcs, conn)
+			})
 		}
 		
 		Print(StartTag, "!!!!!!!!!!!!!!!!!! Server %s shutting down...", user.Node.IpAddr)
-	}()
+	})
+	return nil
 }
 
 func MakeUser(username string, ipAddr string) *User{
@@ -191,11 +564,96 @@ func MakeUser(username string, ipAddr string) *User{
 	LastSeenMap := make(map[string]int64)
 	
 	node := MakeNode(username, ipAddr)
-	user := &User{Node: node, Name: username, PendingMessages: emptyPendingMessages, MessageHistory: history, ReceivedMessageIdentifiers: receivedMessageIdentifiers, notifications: notifications, Current: "", LastSeenMap: LastSeenMap}
+	user := &User{Node: node, Name: username, Keys: GenerateKeyPair(), PendingMessages: emptyPendingMessages, MessageHistory: history, ReceivedMessageIdentifiers: receivedMessageIdentifiers, notifications: notifications, storage: DefaultStorage, Current: "", LastSeenMap: LastSeenMap}
+	user.Rooms = make(map[string]RoomRecord)
+	user.RoomHistory = make(map[string][]*SendMessageArgs)
+	user.Index = NewSearchIndex()
+	user.Clocks = make(map[string]int64)
+	user.OrphanChanges = make(map[int64][]*SendMessageArgs)
+	user.Watched = make(map[string]PresenceRecord)
+	user.Contacts = make(map[string]Contact)
+	user.Blocked = make(map[string]bool)
+	user.senders, user.sources = newLimiter(), newLimiter()
+	user.retries = make(map[string]*retry)
+	user.wake = make(chan struct{}, 1)
+	user.subscribers = make(map[string]subscriber)
+	user.presenceUpdates = make(chan PresenceRecord, 1000)
+	user.signals = make(chan SignalArgs, 1000)
 	return user
 }
 
-func loadUser(username, myIpAddr string) *User {
+// LoadProfile reads username's saved profile, with the changes
+// in its journal applied, without going online. It is for tools
+// that only need the history, and returns the same errors as
+// LoginWithPassphrase.
+func LoadProfile(username string, passphrase string) (*User, error) {
+	return LoadProfileFrom(DefaultStorage, username, passphrase)
+}
+
+// like LoadProfile, for a profile saved in storage. the user
+// keeps saving to storage
+func LoadProfileFrom(storage Storage, username string, passphrase string) (*User, error) {
+	user, err := deserialize(storage, username, passphrase)
+	if err != nil {
+		return nil, err
+	}
+
+	Print(UserTag, "Loaded User from storage!")
+
+	// profiles saved before users had keys get one now
+	if user.Keys == nil {
+		user.Keys = GenerateKeyPair()
+	}
+	user.Keys.ensureSigningKey()
+	if user.Node.Records == nil {
+		user.Node.Records = make(map[ID]UserRecord)
+	}
+	if user.Node.Owners == nil {
+		user.Node.Owners = make(map[ID][]byte)
+	}
+	if user.Node.Rooms == nil {
+		user.Node.Rooms = make(map[ID]RoomRecord)
+	}
+	if user.Rooms == nil {
+		user.Rooms = make(map[string]RoomRecord)
+	}
+	if user.RoomHistory == nil {
+		user.RoomHistory = make(map[string][]*SendMessageArgs)
+	}
+	if user.Index == nil {
+		user.rebuildIndex()
+	}
+	if user.Clocks == nil {
+		user.rebuildClocks()
+	}
+	if user.OrphanChanges == nil {
+		user.OrphanChanges = make(map[int64][]*SendMessageArgs)
+	}
+	if user.Watched == nil {
+		user.Watched = make(map[string]PresenceRecord)
+	}
+	if user.Contacts == nil {
+		user.Contacts = make(map[string]Contact)
+	}
+	if user.Blocked == nil {
+		user.Blocked = make(map[string]bool)
+	}
+	user.senders, user.sources = newLimiter(), newLimiter()
+	user.retries = make(map[string]*retry)
+	user.wake = make(chan struct{}, 1)
+	user.subscribers = make(map[string]subscriber)
+	user.presenceUpdates = make(chan PresenceRecord, 1000)
+	user.signals = make(chan SignalArgs, 1000)
+	user.notifications = make(chan *SendMessageArgs, 100000)
+	user.Node.SetTransport(DefaultTransport)
+	user.SetStorage(storage)
+
+	// apply what happened after the snapshot was taken
+	user.replayJournal()
+	return user, nil
+}
+
+func loadUser(username, myIpAddr string, passphrase string) (*User, error) {
 	/*
 		This method loads the User struct for a given 
 		username from disk, checking if there needs to 
@@ -204,90 +662,424 @@ func loadUser(username, myIpAddr string) *User {
 	*/
 	
 	// first deserialize the old User struct from disk
-	success, user := Deserialize(username)
-	
-	// there was a userfile to load
-	if success {
-	
-		Print(UserTag, "Loaded User from disk!")
-	
-		// check and see if ipaddr is the same as the old one
-		// if so, we don't need to change anything
-		if user.Node.IpAddr != myIpAddr{
-			
-			// otherwise, create a new nodeId
-			user.Node.NodeId = Sha1(myIpAddr)
-			user.Node.IpAddr = myIpAddr
+	user, err := LoadProfile(username, passphrase)
+	if err != nil {
+		return nil, err
+	}
 
-			Print(UserTag, "IP Address changed to %s, creating new NodeID=%s", myIpAddr, user.Node.NodeId)
-			
-			// and rearrange the table based on new nodeId
-			// first, get a list of all (nodeId, ipAddr) pairs
-			routingEntries := make([]RoutingEntry, 0)
-			
-			// for each k-buckets row
-			for _, row := range user.Node.RoutingTable {
-			
-				// for each RoutingEntry in row
-				for _, entry := range row {
-					routingEntries = append(routingEntries, entry)
-				}
-			}
-			
-			// now delete old routing table and replace 
-			// with a new (empty) one
-			user.Node.MakeEmptyRoutingTable()
-			
-			// then, for each pair, call:
-			// updateRoutingTable(nodeId ID, IpAddr string)
-			for _, entry := range routingEntries {
-				if user.Node.Ping(entry) {
-					Print(UserTag, "RoutingEntry %+v is online, updating routing table...", entry)
-					user.Node.updateRoutingTable(entry)
-				}			
+	// take a new snapshot so we don't append to the journal
+	// after a damaged entry
+	user.persist()
+
+	// check and see if ipaddr is the same as the old one
+	// if so, we don't need to change anything
+	if user.Node.IpAddr != myIpAddr{
+		
+		// otherwise, create a new nodeId
+		user.Node.NodeId = Sha1(myIpAddr)
+		user.Node.IpAddr = myIpAddr
+
+		Print(UserTag, "IP Address changed to %s, creating new NodeID=%s", myIpAddr, user.Node.NodeId)
+		
+		// and rearrange the table based on new nodeId
+		// first, get a list of all (nodeId, ipAddr) pairs
+		routingEntries := make([]RoutingEntry, 0)
+		
+		// for each k-buckets row
+		for _, row := range user.Node.RoutingTable {
+		
+			// for each RoutingEntry in row
+			for _, entry := range row {
+				routingEntries = append(routingEntries, entry)
 			}
 		}
-
-	// there was not, create a new User	
-	} else {
-		user = nil
+		
+		// now delete old routing table and replace 
+		// with a new (empty) one
+		user.Node.MakeEmptyRoutingTable()
+		
+		// then, for each pair, call:
+		// updateRoutingTable(nodeId ID, IpAddr string)
+		for _, entry := range routingEntries {
+			if user.Node.Ping(entry) {
+				Print(UserTag, "RoutingEntry %+v is online, updating routing table...", entry)
+				user.Node.updateRoutingTable(entry)
+			}			
+		}
 	}
-	
-	return user
+	return user, nil
 }
 
 //SendMessage RPC Handler
 func (user *User) SendMessageHandler(args *SendMessageArgs, reply *SendMessageReply) error {
 	Print(UserTag, "%s entering SendMessageHandler", user.Name)
+	// only charge who the message is really from, so nobody
+	// can use up someone else's allowance
+	if err := user.checkMessage(args); err != nil {
+		return err
+	}
+	// relayed mail is held to RelayQuota instead, and copies we
+	// already have cost nothing, so a sender retrying through
+	// several relays isn't charged again
+	if user.isNewMessage(args) {
+		if err := user.allowSender(args.FromUsername); err != nil {
+			return err
+		}
+	}
+	return user.receiveMessage(args, reply)
+}
+
+// returns true if args is addressed to us and we haven't seen it
+func (user *User) isNewMessage(args *SendMessageArgs) bool {
+	user.mu.Lock()
+	defer user.mu.Unlock()
+	if args.ToUsername != user.Name {
+		return false
+	}
+	_, seenBefore := user.ReceivedMessageIdentifiers[args.MessageIdentifier]
+	return !seenBefore
+}
+
+// verifies args is signed by its sender, once
+func (user *User) checkMessage(args *SendMessageArgs) error {
+	if args.verified {
+		return nil
+	}
+	// whoever relays it, only its sender can have signed it
+	if err := user.verifyMessage(args); err != nil {
+		Print(UserTag, "%s dropping message %v: %v", user.Name, args.MessageIdentifier, err)
+		return err
+	}
+	args.verified = true
+	return nil
+}
+
+// takes args like SendMessageHandler, without holding its sender
+// to SenderLimit
+func (user *User) receiveMessage(args *SendMessageArgs, reply *SendMessageReply) error {
+	if err := user.checkMessage(args); err != nil {
+		return err
+	}
+	user.mu.Lock()
+
+	// drop what blocked users send, without letting them know
+	if user.Blocked[args.FromUsername] {
+		reply.Status = Relayed
+		if args.ToUsername == user.Name {
+			reply.Status = Delivered
+		}
+		user.mu.Unlock()
+		return nil
+	}
 
 	// check if message is for you, and you havn’t received it before -> then process
 	if args.ToUsername == user.Name{
+		reply.Status = Delivered
+		if ! args.Relayed {
+			// they're online, so stop backing off
+			user.resetRetry(args.FromUsername)
+		}
 		_, seenBefore := user.ReceivedMessageIdentifiers[args.MessageIdentifier]
 		if ! seenBefore{
+			user.openMessage(args)
 			Print(UserTag, "%s recieved a previously unseen message meant for me!: %s, from %s at %v", user.Name, args.Content, args.FromUsername, args.Timestamp)
-			//initialize entry in messageHistory if first time hearing from user
-			if _, ok := user.MessageHistory[args.FromUsername]; !ok {
-				user.PendingMessages[args.FromUsername] = make([]*SendMessageArgs, 0)
-			}
-			user.MessageHistory[args.FromUsername] = append(user.MessageHistory[args.FromUsername], args)
 			user.ReceivedMessageIdentifiers[args.MessageIdentifier] = true
-			
-			// then notify the UI
-			user.notifications <- args
+			user.journal(journalEntry{Op: journalSeen, Ref: args.MessageIdentifier})
+
+			if args.Kind == AckKind {
+				user.applyAck(args)
+			} else if args.Kind == InviteKind {
+				user.acceptInvite(args)
+			} else if isChange(args) {
+				user.receiveChange(args)
+			} else if args.Room != "" {
+				user.receiveRoomMessage(args)
+			} else {
+				//initialize entry in messageHistory if first time hearing from user
+				if _, ok := user.MessageHistory[args.FromUsername]; !ok {
+					user.PendingMessages[args.FromUsername] = make([]*SendMessageArgs, 0)
+				}
+				args.Status = Delivered
+				if args.Kind == FileKind {
+					user.receiveFile(args)
+				}
+				user.MessageHistory[args.FromUsername] = append(user.MessageHistory[args.FromUsername], args)
+				user.observeClock(args.FromUsername, args)
+				user.indexMessage(args.FromUsername, args)
+				user.journal(journalEntry{Op: journalHistory, Key: args.FromUsername, Message: args})
+				user.applyOrphans(args.FromUsername, args)
+
+				// the sender learns it was delivered from our reply,
+				// unless it came through a relay
+				if args.Relayed {
+					user.queueAck(args, Delivered)
+				}
+
+				// then notify the UI
+				user.notify(args)
+			}
 			
 		} else {
 			Print(UserTag, "%s recieved a previously seen message meant for me! Disregarding: %s, from %s at %v", user.Name, args.Content, args.FromUsername, args.Timestamp)
 		}
 	} else {
+		if ! user.isPending(args.ToUsername, args.MessageIdentifier) && (user.relayedFor(args.ToUsername) >= RelayQuota || user.relayedTotal() >= MailboxSize) {
+			user.mu.Unlock()
+			return fmt.Errorf("%w: %s", ErrRelayQuota, args.ToUsername)
+		}
+		reply.Status = Relayed
 		// if not for you -> store in pendingMessages map
 		if _, ok := user.PendingMessages[args.ToUsername]; !ok {
 			user.PendingMessages[args.ToUsername] = make([]*SendMessageArgs, 0)
 		}
-		user.PendingMessages[args.ToUsername] = append(user.PendingMessages[args.ToUsername], args)
+		args.Relayed = true
+		// senders keep relaying until the recipient is back,
+		// so only hold one copy of each message
+		if ! user.isPending(args.ToUsername, args.MessageIdentifier) {
+			args.HeldSince = time.Now().Unix()
+			user.PendingMessages[args.ToUsername] = append(user.PendingMessages[args.ToUsername], args)
+			user.journal(journalEntry{Op: journalPending, Key: args.ToUsername, Message: args})
+			user.wakeSender()
+		}
+
+		// the recipient has the message this ack is about,
+		// so stop trying to deliver our copy of it
+		if args.Kind == AckKind {
+			user.dropPending(args.FromUsername, args.Ref)
+			user.journal(journalEntry{Op: journalDropPending, Key: args.FromUsername, Ref: args.Ref})
+		}
 	}
+	user.mu.Unlock()
 	
 	// persist to disk
-	user.Serialize()
+	user.flushJournal()
+	return nil
+}
+
+func (user *User) queueAck(msg *SendMessageArgs, status string) {
+	/*
+		Queues an ack telling the sender of msg that it
+		reached status. Acks go through the same sender
+		queue and offline relays as chat messages. Must
+		be called with user.mu held, like the helpers
+		below that touch the message maps.
+	*/
+	ack := &SendMessageArgs{Content: status, Timestamp: time.Now().Unix(), ToUsername: msg.FromUsername, FromUsername: user.Name, MessageIdentifier: nrand(), Kind: AckKind, Ref: msg.MessageIdentifier}
+	user.enqueue(msg.FromUsername, ack)
+	user.journal(journalEntry{Op: journalPending, Key: msg.FromUsername, Message: ack})
+}
+
+func (user *User) applyAck(ack *SendMessageArgs) {
+	if msg := user.findMessage(ack.FromUsername, ack.Ref); msg != nil {
+		if user.setStatus(msg, ack.Content) {
+			user.journal(journalEntry{Op: journalStatus, Key: ack.FromUsername, Ref: ack.Ref, Status: ack.Content})
+			user.notify(msg)
+		}
+	}
+}
+
+func (user *User) findMessage(peer string, messageIdentifier int64) *SendMessageArgs {
+	for _, msg := range user.MessageHistory[peer] {
+		if msg.MessageIdentifier == messageIdentifier {
+			return msg
+		}
+	}
+	return nil
+}
+
+var statusOrder = map[string]int{Queued: 1, Relayed: 2, Delivered: 3, Read: 4}
+
+// moves msg forward to status, returns false if it was
+// already there or further along
+func (user *User) setStatus(msg *SendMessageArgs, status string) bool {
+	if statusOrder[status] <= statusOrder[msg.Status] {
+		return false
+	}
+	msg.Status = status
+	return true
+}
+
+func (user *User) isPending(username string, messageIdentifier int64) bool {
+	for _, msg := range user.PendingMessages[username] {
+		if msg.MessageIdentifier == messageIdentifier {
+			return true
+		}
+	}
+	return false
+}
+
+// queues msg, which we are sending, for username and tries
+// them straight away even if they were offline last time. must
+// be called with user.mu held
+func (user *User) enqueue(username string, msg *SendMessageArgs) {
+	user.PendingMessages[username] = append(user.PendingMessages[username], msg)
+	user.retryNow(username)
+}
+
+// returns how many messages we hold for username on behalf of
+// others. must be called with user.mu held
+func (user *User) relayedFor(username string) int {
+	relayed := 0
+	for _, msg := range user.PendingMessages[username] {
+		if msg.Relayed {
+			relayed++
+		}
+	}
+	return relayed
+}
+
+func (user *User) dropPending(username string, messageIdentifier int64) {
+	pending := user.PendingMessages[username]
+	for i, msg := range pending {
+		if msg.MessageIdentifier == messageIdentifier {
+			user.PendingMessages[username] = append(pending[:i], pending[i+1:]...)
+			return
+		}
+	}
+}
+
+// returns the delivery status of a message we sent to peer,
+// or "" if there is no such message
+func (user *User) MessageStatus(peer string, messageIdentifier int64) string {
+	user.mu.Lock()
+	defer user.mu.Unlock()
+	if msg := user.findMessage(peer, messageIdentifier); msg != nil {
+		return msg.Status
+	}
+	return ""
+}
+
+func (user *User) MarkRead(peer string) {
+	/*
+		Marks every message from peer as read, and lets
+		peer know with a Read ack for each one that wasn't
+		read before.
+	*/
+	user.mu.Lock()
+	for _, msg := range user.MessageHistory[peer] {
+		if msg.FromUsername != peer {
+			continue
+		}
+		// messages from before acks existed have no status,
+		// their senders aren't waiting to hear about them
+		wasDelivered := msg.Status == Delivered
+		if user.setStatus(msg, Read) {
+			user.journal(journalEntry{Op: journalStatus, Key: peer, Ref: msg.MessageIdentifier, Status: Read})
+			if wasDelivered {
+				user.queueAck(msg, Read)
+			}
+		}
+	}
+	user.mu.Unlock()
+	user.flushJournal()
+}
+
+func (user *User) openMessage(args *SendMessageArgs) {
+	/*
+		Decrypts the sealed content of a message meant for
+		us in place. Messages that can't be opened are kept
+		with empty content and flagged with DecryptFailed
+		so the UI can show them, rather than being bounced
+		back to a sender who would retry them forever.
+	*/
+	if len(args.Sealed) > 0 {
+		plaintext, err := user.Keys.Open(args.Sealed, args.headerBytes())
+		if err != nil {
+			Print(UserTag, "%s could not decrypt message %v from %s: %v", user.Name, args.MessageIdentifier, args.FromUsername, err)
+			args.Content = ""
+			args.DecryptFailed = true
+		} else {
+			args.Content = string(plaintext)
+		}
+	}
+	if args.Attachment != nil && len(args.Attachment.Sealed) > 0 && ! args.DecryptFailed {
+		if err := user.Keys.openAttachment(args.Attachment, args.headerBytes()); err != nil {
+			Print(UserTag, "%s could not decrypt the file in message %v from %s: %v", user.Name, args.MessageIdentifier, args.FromUsername, err)
+			args.DecryptFailed = true
+		}
+	}
+	args.Sealed = nil
+}
+
+func (user *User) sealMessage(args SendMessageArgs, publicKey []byte) (SendMessageArgs, bool) {
+	/*
+		Returns the copy of args that goes on the wire, with
+		Content and any file's hashes and data sealed for the
+		recipient so relays only see the routing headers and
+		the file's size, which sealing binds to them, and
+		signed with our key. Messages we are relaying for
+		someone else were sealed and signed by their sender
+		and pass through.
+	*/
+	if args.FromUsername != user.Name {
+		return args, true
+	}
+	if (args.Content != "" || args.Attachment != nil) && len(publicKey) == 0 {
+		return args, false
+	}
+	if args.Content != "" {
+		sealed, err := Seal(publicKey, []byte(args.Content), args.headerBytes())
+		if err != nil {
+			Print(SendingTag, "Could not seal message %v for %s: %v", args.MessageIdentifier, args.ToUsername, err)
+			return args, false
+		}
+		args.Sealed = sealed
+		args.Content = ""
+	}
+	if args.Attachment != nil {
+		attachment, err := sealAttachment(args.Attachment, publicKey, args.headerBytes())
+		if err != nil {
+			Print(SendingTag, "Could not seal the file in message %v for %s: %v", args.MessageIdentifier, args.ToUsername, err)
+			return args, false
+		}
+		args.Attachment = attachment
+	}
+	args.Signature = ed25519.Sign(user.Keys.SignPrivate, args.signedBytes())
+	return args, true
+}
+
+// the routing headers of args, which relays can see. sealing
+// binds them to the content, so a relay can't put the content
+// in another message
+func (args *SendMessageArgs) headerBytes() []byte {
+	fields := [][]byte{[]byte(args.FromUsername), []byte(args.ToUsername), []byte(args.Kind), []byte(args.Room), []byte(fmt.Sprint(args.Ref)), []byte(fmt.Sprint(args.Timestamp)), []byte(fmt.Sprint(args.Clock))}
+	return signedFields(fields, args.MessageIdentifier)
+}
+
+// the bytes the sender signs: the headers and everything the
+// message carries over the wire. what relays and the recipient
+// add on the way, like Relayed and Status, is left out
+func (args *SendMessageArgs) signedBytes() []byte {
+	fields := [][]byte{args.headerBytes(), []byte(args.Content), args.Sealed}
+	if attachment := args.Attachment; attachment != nil {
+		fields = append(fields, []byte(fmt.Sprint(attachment.Size, " ", attachment.ChunkSize)), attachment.Hash, bytes.Join(attachment.ChunkHashes, nil), attachment.Data, attachment.Sealed)
+	}
+	return signedFields(fields, args.MessageIdentifier)
+}
+
+// returns ErrBadMessage unless args was signed by the key that
+// owns its FromUsername
+func (user *User) verifyMessage(args *SendMessageArgs) error {
+	signingKey := user.signingKey(args.FromUsername)
+	if len(signingKey) != ed25519.PublicKeySize || !ed25519.Verify(signingKey, args.signedBytes(), args.Signature) {
+		return fmt.Errorf("%w: %v from %s", ErrBadMessage, args.MessageIdentifier, args.FromUsername)
+	}
+	return nil
+}
+
+// returns the key username signs with: the one we pinned when
+// we first saw their record, or the one in their record if we
+// haven't yet. nil if they can't be found
+func (user *User) signingKey(username string) []byte {
+	user.Node.mu.Lock()
+	pinned := user.Node.Owners[Sha1(username)]
+	user.Node.mu.Unlock()
+	if len(pinned) > 0 {
+		return pinned
+	}
+	if record := user.Node.LookupRecord(username); record != nil {
+		return record.SigningKey
+	}
 	return nil
 }
 
@@ -297,89 +1089,105 @@ func (user *User) SendMessage(username string, content string) {
 		Sends message with content to username. In offline case, we save the message for later
 	*/
 	Print(UserTag, "Queuing message \"%s\" to %s", content, username)
+	user.mu.Lock()
 	//initilize map entry for a certain user
 	if _, ok := user.PendingMessages[username]; !ok {
 		user.PendingMessages[username] = make([]*SendMessageArgs, 0)
 	}
-	pendingMessage := &SendMessageArgs{Content: content, Timestamp: time.Now().Unix(), ToUsername: username, FromUsername: user.Name, MessageIdentifier: nrand()}
-	user.PendingMessages[username] = append(user.PendingMessages[username], pendingMessage)
+	pendingMessage := &SendMessageArgs{Content: content, Timestamp: user.now().Unix(), Clock: user.tick(username), ToUsername: username, FromUsername: user.Name, MessageIdentifier: nrand(), Status: Queued}
+	user.enqueue(username, pendingMessage)
 	user.MessageHistory[username] = append(user.MessageHistory[username], pendingMessage) 
+	user.indexMessage(username, pendingMessage)
+	user.journal(journalEntry{Op: journalPending, Key: username, Message: pendingMessage})
+	user.journal(journalEntry{Op: journalHistory, Key: username, Message: pendingMessage})
+	user.mu.Unlock()
+	user.flushJournal()
 }
 
 func (user *User) startPersistor() {
 	/*
-		Saves the user's routing table and message
-		history to disk every PERSIST_EVERY seconds.
+		Takes a snapshot of the user's routing table and
+		message history every PERSIST_EVERY seconds,
+		compacting the journal into it.
 	*/
-	for {
-		user.Serialize()
-		time.Sleep(PERSIST_EVERY * time.Second)
+	user.persist()
+	for user.sleep(PERSIST_EVERY * time.Second) {
+		user.persist()
 	}
 }
 
-func (user *User) startSender() {
+func (user *User) startRepublisher() {
 	/*
-		A separate thread which waits until Nodes 
-		are up to send them messages
+		Records in the DHT expire after RecordTTL, so while
+		we are online we sign and store our username record
+		and the rooms we own every RepublishEvery.
 	*/
-	Print(SendingTag, "Sender process for %s starting...", user.Name)
-	for user.dead == false{
-		for username, _ := range user.PendingMessages {
-			for len(user.PendingMessages[username]) > 0 {
-				
-				ip := user.Node.FindUser(username)
-				status := user.CheckStatus(ip)
-
-				// pop first message args off of slice
-				var args SendMessageArgs
-				if len(user.PendingMessages[username]) == 1 { 
-					args, user.PendingMessages[username] = *user.PendingMessages[username][0], make([]*SendMessageArgs, 0)
-				} else if len(user.PendingMessages[username]) > 1 {
-					// "Pop(0)" slice operation taken from:
-					// https://code.google.com/p/go-wiki/wiki/SliceTricks
-					args, user.PendingMessages[username] = *user.PendingMessages[username][0], user.PendingMessages[username][1:]
-				}
-				
-				// create reply and send to user
-				var reply SendMessageReply
-				
+	every := RepublishEvery
+	for user.sleep(every) {
+		Print(UserTag, "%s republishing its records", user.Name)
+		user.Node.AnnounceUser(user.Name, user.Node.IpAddr, user.Keys)
+		for _, room := range user.ownedRooms() {
+			user.republishRoom(room)
+		}
+	}
+}
 
-				if status == Online {
-					Print(SendingTag, "SenderLoop: Node %v Sending \"%s\" to %s...", user.Name, args.Content, args.ToUsername)			
-					ok := call(ip, "User.SendMessageHandler", args, &reply)
-					
-					// if our message sending failed, put back on queue
-					if ! ok {
-						// put message back on front of queue and continue
-						// "Insert" slice operation taken from:
-						// https://code.google.com/p/go-wiki/wiki/SliceTricks
-						user.PendingMessages[username] = append(
-							user.PendingMessages[username][:0], 
-							append([]*SendMessageArgs{&args}, user.PendingMessages[username][0:]...)...)
-					}
-				} else {
-					Print(SendingTag, "User is offline- wait to send his messages")
-					//forward to K nearest neighbors
-					kClosestEntryDists := user.Node.FindNearestNodes(Sha1(username))
-					for _, entryDist := range kClosestEntryDists {
-						var replyOther SendMessageReply
-						go call(entryDist.RoutingEntry.IpAddr, "User.SendMessageHandler", args, &replyOther)
-					}
-					//remove user from KV
-					delete(user.Node.Kv, Sha1(username))
-
-
-					user.PendingMessages[username] = append(
-					user.PendingMessages[username][:0], 
-					append([]*SendMessageArgs{&args}, user.PendingMessages[username][0:]...)...)
-
-					break 
-				}
-			}
+func (user *User) startMaintainer() {
+	/*
+		Runs routing table maintenance on our node every
+		MaintainEvery for as long as we are online. Every
+		ReplicateEvery the records our node holds for others
+		are stored again on the K nodes closest to them.
+	*/
+	maintain := time.NewTicker(MaintainEvery)
+	defer maintain.Stop()
+	replicate := time.NewTicker(ReplicateEvery)
+	defer replicate.Stop()
+	for {
+		select {
+		case <-user.done:
+			return
+		case <-maintain.C:
+			user.Node.Maintain()
+		case <-replicate.C:
+			user.Node.Replicate()
+		}
+	}
+}
+
+// returns the usernames we have messages queued for
+func (user *User) pendingUsernames() []string {
+	user.mu.Lock()
+	defer user.mu.Unlock()
+	usernames := make([]string, 0, len(user.PendingMessages))
+	for username, _ := range user.PendingMessages {
+		usernames = append(usernames, username)
+	}
+	return usernames
+}
+
+// returns copies of the messages queued for username
+func (user *User) pendingCopies(username string) []*SendMessageArgs {
+	user.mu.Lock()
+	defer user.mu.Unlock()
+	return copyMessages(user.PendingMessages[username])
+}
+
+// records the status a node replied with for a message we
+// sent, so the UI can show it
+func (user *User) updateSentStatus(args *SendMessageArgs, status string) {
+	if args.FromUsername != user.Name || (args.Kind != TextKind && args.Kind != FileKind) || args.Room != "" {
+		return
+	}
+	user.mu.Lock()
+	if msg := user.findMessage(args.ToUsername, args.MessageIdentifier); msg != nil {
+		if user.setStatus(msg, status) {
+			user.journal(journalEntry{Op: journalStatus, Key: args.ToUsername, Ref: args.MessageIdentifier, Status: status})
+			user.notify(msg)
 		}
-		// Print(SendingTag, "Sender loop for %s running, pending: %v...", user.Name, user.PendingMessages)
-		time.Sleep(50 * time.Millisecond)
 	}
+	user.mu.Unlock()
+	user.flushJournal()
 }
 
 func (user *User) CheckStatus(ipAddr string) string {
@@ -402,17 +1210,44 @@ func (user *User) IsOnline(username string) bool{
 }
 
 func (user *User) UpdateCurrentPeer(peer string) {
+	user.mu.Lock()
+	defer user.mu.Unlock()
 	user.Current = peer
 }
 
+func (user *User) CurrentPeer() string {
+	user.mu.Lock()
+	defer user.mu.Unlock()
+	return user.Current
+}
+
+// returns the usernames we have a conversation with
+func (user *User) Peers() []string {
+	user.mu.Lock()
+	defer user.mu.Unlock()
+	peers := make([]string, 0, len(user.MessageHistory))
+	for peer, _ := range user.MessageHistory {
+		peers = append(peers, peer)
+	}
+	return peers
+}
+
+// returns copies of the messages in our conversation with
+// other, in clock order
 func (user *User) AllMessagesFromUser(other string) []*SendMessageArgs {
+	user.mu.Lock()
+	defer user.mu.Unlock()
 	if messages, ok := user.MessageHistory[other]; ok {
-		return messages
+		copies := copyMessages(messages)
+		sortMessages(copies)
+		return copies
 	} 
 	return make([]*SendMessageArgs, 0)
 }
 
 func (user *User) AreNewMessagesFrom(other string) (bool, []SendMessageArgs) {
+	user.mu.Lock()
+	defer user.mu.Unlock()
 
 	areNew := false
 	newMessages := make([]SendMessageArgs, 0)
@@ -422,20 +1257,19 @@ func (user *User) AreNewMessagesFrom(other string) (bool, []SendMessageArgs) {
 	}
 	
 	// get messages in this conversation, and traverse
-	// messages in the conversation in order of timing
-	messagePointers := user.MessageHistory[other]
+	// messages in the conversation in clock order
+	messagePointers := copyMessages(user.MessageHistory[other])
+	sortMessages(messagePointers)
 	
 	messages := make([]SendMessageArgs, 0)
 	for _, msg := range messagePointers {
 		messages = append(messages, *msg)
 	}
 	
-	sortutil.AscByField(messages, "Timestamp")
 	for i := 0; i < len(messages); i++ {
 		message := messages[i]
-		stamp := message.Timestamp
+		stamp := message.order()
 				
-		// http://golang.org/src/pkg/time/time.go?s=2447:2479#L50
 		if stamp > mostRecent && message.FromUsername != user.Name {
 			areNew = true
 		}
@@ -447,7 +1281,7 @@ func (user *User) AreNewMessagesFrom(other string) (bool, []SendMessageArgs) {
 	
 	// update the most recent to be the last one we've seen
 	if len(messages) > 0 {
-		user.LastSeenMap[other] = messages[len(messages) - 1].Timestamp
+		user.LastSeenMap[other] = messages[len(messages) - 1].order()
 	}
 	
 	return areNew, newMessages